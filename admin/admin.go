@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"mediaserver/utils/config"
+	"mediaserver/utils/logging"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var logger = logging.For("admin")
+
+// Register mounts the admin API under /admin. Every request needs
+// "Authorization: Bearer <ADMIN_TOKEN>"; without a configured token the API
+// answers 404.
+func Register(r *mux.Router, store *config.Store) {
+	api := r.PathPrefix("/admin").Subrouter()
+	api.Use(authenticate(store))
+	api.HandleFunc("/config/reload", reloadConfig(store)).Methods(http.MethodPost)
+
+	api.HandleFunc("/rooms", listRooms).Methods(http.MethodGet)
+	api.HandleFunc("/rooms/{roomId}", getRoom).Methods(http.MethodGet)
+	api.HandleFunc("/rooms/{roomId}", closeRoom).Methods(http.MethodDelete)
+	api.HandleFunc("/rooms/{roomId}/participants/{userId}", kickParticipant).Methods(http.MethodDelete)
+	api.HandleFunc("/rooms/{roomId}/participants/{userId}/stats", participantStats).Methods(http.MethodGet)
+	api.HandleFunc("/rooms/{roomId}/messages", sendSystemMessage).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{roomId}/settings", getRoomSettings).Methods(http.MethodGet)
+	api.HandleFunc("/rooms/{roomId}/settings", putRoomSettings).Methods(http.MethodPut)
+	api.HandleFunc("/rooms/{roomId}/settings", deleteRoomSettings).Methods(http.MethodDelete)
+
+	api.HandleFunc("/history/sessions", listSessions).Methods(http.MethodGet)
+	api.HandleFunc("/history/sessions/{sessionId}", getSession).Methods(http.MethodGet)
+	api.HandleFunc("/history/attendance", listAttendance).Methods(http.MethodGet)
+	api.HandleFunc("/history/shares", listShares).Methods(http.MethodGet)
+}
+
+func authenticate(store *config.Store) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := store.Current().Admin.Token
+			if token == "" {
+				http.NotFound(w, r)
+				return
+			}
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "invalid admin token")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func reloadConfig(store *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := store.Reload()
+		if err != nil {
+			logger.Warn("config reload failed", "error", err)
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		logger.Info("config reloaded", "source", "admin", "applied", result.Applied, "restartRequired", result.RestartRequired)
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Warn("write response failed", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,160 @@
+package admin
+
+import (
+	"fmt"
+	"mediaserver/history"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// historyStore answers 404 itself when the history is disabled.
+func historyStore(w http.ResponseWriter) (history.Store, bool) {
+	store := history.Current()
+	if store == nil {
+		writeError(w, http.StatusNotFound, "history is disabled")
+		return nil, false
+	}
+	return store, true
+}
+
+// parseFilter reads roomId, sessionId, userId, from, to (RFC 3339) and limit
+// from the query string.
+func parseFilter(r *http.Request) (history.Filter, error) {
+	q := r.URL.Query()
+	f := history.Filter{
+		RoomID:    q.Get("roomId"),
+		SessionID: q.Get("sessionId"),
+		UserID:    q.Get("userId"),
+	}
+	for key, target := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if v := q.Get(key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, fmt.Errorf("%s must be an RFC 3339 time", key)
+			}
+			*target = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("limit must be a positive number")
+		}
+		f.Limit = n
+	}
+	return f, nil
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	store, ok := historyStore(w)
+	if !ok {
+		return
+	}
+	f, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sessions, err := store.Sessions(f)
+	if err != nil {
+		logger.Warn("history query failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "history query failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": sessions})
+}
+
+func getSession(w http.ResponseWriter, r *http.Request) {
+	store, ok := historyStore(w)
+	if !ok {
+		return
+	}
+	f := history.Filter{SessionID: mux.Vars(r)["sessionId"]}
+	sessions, err := store.Sessions(f)
+	if err != nil {
+		logger.Warn("history query failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "history query failed")
+		return
+	}
+	if len(sessions) == 0 {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	attendance, err := store.Attendance(f)
+	if err == nil {
+		var shares []history.Share
+		if shares, err = store.Shares(f); err == nil {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"session":    sessions[0],
+				"attendance": attendance,
+				"shares":     shares,
+			})
+			return
+		}
+	}
+	logger.Warn("history query failed", "error", err)
+	writeError(w, http.StatusInternalServerError, "history query failed")
+}
+
+// listAttendance answers JSON, or a CSV file with ?format=csv.
+func listAttendance(w http.ResponseWriter, r *http.Request) {
+	store, ok := historyStore(w)
+	if !ok {
+		return
+	}
+	f, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rows, err := store.Attendance(f)
+	if err != nil {
+		logger.Warn("history query failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "history query failed")
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		writeCSVHeaders(w, "attendance.csv")
+		if err := history.WriteAttendanceCSV(w, rows); err != nil {
+			logger.Warn("write response failed", "error", err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"attendance": rows})
+}
+
+// listShares answers JSON, or a CSV file with ?format=csv.
+func listShares(w http.ResponseWriter, r *http.Request) {
+	store, ok := historyStore(w)
+	if !ok {
+		return
+	}
+	f, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rows, err := store.Shares(f)
+	if err != nil {
+		logger.Warn("history query failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "history query failed")
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		writeCSVHeaders(w, "shares.csv")
+		if err := history.WriteSharesCSV(w, rows); err != nil {
+			logger.Warn("write response failed", "error", err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"shares": rows})
+}
+
+func writeCSVHeaders(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,177 @@
+package admin
+
+import (
+	"encoding/json"
+	"mediaserver/media"
+	"mediaserver/media/message"
+	"mediaserver/media/quality"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func listRooms(w http.ResponseWriter, r *http.Request) {
+	rooms := []media.RoomInfo{}
+	for _, room := range media.ListRooms() {
+		rooms = append(rooms, room.Info(false))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rooms": rooms})
+}
+
+func getRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := media.GetRoom(mux.Vars(r)["roomId"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, room.Info(true))
+}
+
+func closeRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := media.GetRoom(mux.Vars(r)["roomId"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	logger.Info("room closed by admin", "roomId", room.ID)
+	room.Close("room closed by an administrator")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func kickParticipant(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	room, ok := media.GetRoom(vars["roomId"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	client, ok := room.Client(vars["userId"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "participant not found")
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "removed by an administrator"
+	}
+	logger.Info("participant kicked by admin", "roomId", room.ID, "userId", client.UserID, "reason", reason)
+	client.Kick(reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// participantStats returns the last connection-quality report of a
+// participant, the same one pushed to the participant and the room's hosts.
+func participantStats(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	room, ok := media.GetRoom(vars["roomId"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	var client *media.Client
+	var collector *quality.Collector
+	room.Do(func(clients map[string]*media.Client) {
+		if client = clients[vars["userId"]]; client != nil {
+			collector = client.Quality
+		}
+	})
+	if client == nil {
+		writeError(w, http.StatusNotFound, "participant not found")
+		return
+	}
+	if collector == nil {
+		writeError(w, http.StatusNotFound, "stats are not collected for this participant")
+		return
+	}
+	report, ok := collector.Last()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no stats collected yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+type systemMessage struct {
+	Text  string `json:"text"`
+	Level string `json:"level"`
+}
+
+func sendSystemMessage(w http.ResponseWriter, r *http.Request) {
+	room, ok := media.GetRoom(mux.Vars(r)["roomId"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	var body systemMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Text == "" {
+		writeError(w, http.StatusBadRequest, "body must be {\"text\": \"...\"}")
+		return
+	}
+	if body.Level == "" {
+		body.Level = "info"
+	}
+
+	sent := room.Broadcast(&message.Message{
+		Event:  "system-message",
+		RoomID: room.ID,
+		Payload: map[string]interface{}{
+			"text":  body.Text,
+			"level": body.Level,
+		},
+	})
+	if !sent {
+		writeError(w, http.StatusGone, "room is closed")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// getRoomSettings answers the settings of the open room, or the ones
+// provisioned for a room not open yet.
+func getRoomSettings(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomId"]
+	if room, ok := media.GetRoom(roomID); ok {
+		var info media.SettingsInfo
+		if room.Do(func(map[string]*media.Client) { info = room.Settings.Info() }) {
+			writeJSON(w, http.StatusOK, info)
+			return
+		}
+	}
+	settings, ok := media.Provisioned(roomID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no settings for this room")
+		return
+	}
+	writeJSON(w, http.StatusOK, settings.Info())
+}
+
+// putRoomSettings provisions the settings of a room, whether or not it is
+// open: {"password", "maxParticipants", "maxPublishers", "locked",
+// "expiresAt", "hosts"}, all optional.
+func putRoomSettings(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomId"]
+	var fields map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON object")
+		return
+	}
+	settings, err := media.ParseSettings(fields, media.Settings{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	media.Provision(roomID, settings)
+	logger.Info("room settings provisioned", "roomId", roomID, "settings", settings.Info())
+	writeJSON(w, http.StatusOK, settings.Info())
+}
+
+func deleteRoomSettings(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomId"]
+	if !media.Unprovision(roomID) {
+		writeError(w, http.StatusNotFound, "no settings provisioned for this room")
+		return
+	}
+	logger.Info("room settings removed", "roomId", roomID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,18 +1,18 @@
 package customcors
 
 import (
-	"fmt"
-	"mediaserver/utils/dotenv"
+	"mediaserver/utils/config"
 
 	"github.com/rs/cors"
 )
 
-func SetupCors() *cors.Cors {
-	frontendHost := dotenv.GetDotEnv("FE_URL")
-	frontendPort := dotenv.GetDotEnv("FE_PORT")
-	allowedOrigin := fmt.Sprintf("%s:%s", frontendHost, frontendPort)
+// SetupCors checks origins against the live configuration so a reload takes
+// effect without rebuilding the handler.
+func SetupCors(store *config.Store) *cors.Cors {
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{allowedOrigin},
+		AllowOriginFunc: func(origin string) bool {
+			return store.Current().CORS.Policy.Allowed(origin)
+		},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Authorization", "Content-Type", "Upgrade", "Connection"},
 		AllowCredentials: true,
@@ -1,29 +1,127 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"mediaserver/admin"
 	customcors "mediaserver/cmd/config"
+	"mediaserver/history"
+	"mediaserver/history/sqlite"
+	"mediaserver/media"
+	"mediaserver/media/ice"
+	"mediaserver/media/mixer"
+	"mediaserver/metrics"
 	"mediaserver/signaling"
-	"mediaserver/utils/dotenv"
+	"mediaserver/tracing"
+	"mediaserver/utils/config"
+	"mediaserver/utils/logging"
+	"mediaserver/webhook"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/gorilla/mux"
 )
 
+var logger = logging.For("server")
+
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
-	port := dotenv.GetDotEnv("APP_PORT")
+	store, err := config.NewStore(os.Args[1:])
+	if err != nil {
+		fatal("invalid configuration", err)
+	}
+	cfg := store.Current()
+	out := os.Stderr
+	if cfg.Log.File != "" {
+		out, err = os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fatal("cannot open log file", err)
+		}
+		defer out.Close()
+	}
+	if err := logging.Setup(cfg.Log, out); err != nil {
+		fatal("invalid logging configuration", err)
+	}
+	store.OnReload(func(c *config.Config) {
+		if err := logging.SetLevels(c.Log); err != nil {
+			logger.Warn("log levels not applied", "error", err)
+		}
+	})
+
+	exporter, err := tracing.NewExporter(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("tracing exporter setup failed", err)
+	}
+	stopTracing := tracing.Start(cfg.Tracing, exporter)
+	defer stopTracing(context.Background())
+
+	webhook.Start(cfg.Webhook)
+
+	if cfg.History.Driver == history.DriverSQLite {
+		db, err := sqlite.Open(cfg.History.Path)
+		if err != nil {
+			fatal("history database failed to open", err)
+		}
+		defer db.Close()
+		history.Start(db, cfg.History.QueueSize)
+	}
+	store.OnReload(func(c *config.Config) { webhook.Configure(c.Webhook) })
+
+	settingEngine, closeMuxes, err := ice.NewSettingEngine(cfg.ICE.Network)
+	if err != nil {
+		fatal("ICE network setup failed", err)
+	}
+	defer closeMuxes()
+	if cfg.ICE.TURNServer.Enabled {
+		turnServer, err := ice.StartTURNServer(cfg.ICE.TURNServer, cfg.ICE.TURNSecret)
+		if err != nil {
+			fatal("TURN server failed to start", err)
+		}
+		defer turnServer.Close()
+	}
+	if !mixer.Available() {
+		logger.Warn("mixed audio unavailable, the server was built without -tags opus; mixed-audio clients receive every audio track")
+	}
+	signaling.Configure(store, settingEngine)
+	go reloadOnSIGHUP(store)
 
 	r := mux.NewRouter()
 	r.HandleFunc("/ws/media", signaling.HandlerConnection)
+	admin.Register(r, store)
+	if cfg.Metrics.Enabled {
+		metrics.RegisterState(media.Stats)
+		r.Handle(cfg.Metrics.Path, metrics.Handler())
+	}
 
-	httpHandler := customcors.SetupCors().Handler(r)
+	httpHandler := customcors.SetupCors(store).Handler(r)
 
-	fmt.Printf("Starting server on %s\n", port)
-	log.Printf("Server start!")
-	// log.Fatal(http.ListenAndServe(":"+port, httpHandler))
-	err := http.ListenAndServeTLS(":"+port, "cert.pem", "key.pem", httpHandler)
+	port := strconv.Itoa(cfg.Server.Port)
+	logger.Info("server starting", "port", cfg.Server.Port, "tls", cfg.Server.TLS)
+	if cfg.Server.TLS {
+		err = http.ListenAndServeTLS(":"+port, cfg.Server.TLSCert, cfg.Server.TLSKey, httpHandler)
+	} else {
+		err = http.ListenAndServe(":"+port, httpHandler)
+	}
 	if err != nil {
-		log.Fatalf("HTTPS server failed to start: %v", err)
+		fatal("HTTP server stopped", err)
+	}
+}
+
+func reloadOnSIGHUP(store *config.Store) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		result, err := store.Reload()
+		if err != nil {
+			logger.Warn("config reload failed, keeping the current config", "error", err)
+			continue
+		}
+		logger.Info("config reloaded", "source", "SIGHUP", "applied", result.Applied, "restartRequired", result.RestartRequired)
 	}
 }
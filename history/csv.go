@@ -0,0 +1,55 @@
+package history
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// WriteAttendanceCSV writes one line per attendance, with a header line. An
+// attendance still open has an empty left_at and lasts until now.
+func WriteAttendanceCSV(w io.Writer, rows []Attendance) error {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"session_id", "room_id", "user_id", "role", "joined_at", "left_at", "duration_seconds", "talk_seconds"})
+	for _, a := range rows {
+		end, leftAt := time.Now(), ""
+		if a.LeftAt != nil {
+			end, leftAt = *a.LeftAt, a.LeftAt.UTC().Format(time.RFC3339)
+		}
+		_ = out.Write([]string{
+			a.SessionID,
+			a.RoomID,
+			a.UserID,
+			a.Role,
+			a.JoinedAt.UTC().Format(time.RFC3339),
+			leftAt,
+			strconv.FormatFloat(end.Sub(a.JoinedAt).Seconds(), 'f', 0, 64),
+			strconv.FormatFloat(a.TalkSeconds, 'f', 0, 64),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// WriteSharesCSV writes one line per share session, with a header line.
+func WriteSharesCSV(w io.Writer, rows []Share) error {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"session_id", "room_id", "user_id", "started_at", "ended_at", "duration_seconds"})
+	for _, s := range rows {
+		end, endedAt := time.Now(), ""
+		if s.EndedAt != nil {
+			end, endedAt = *s.EndedAt, s.EndedAt.UTC().Format(time.RFC3339)
+		}
+		_ = out.Write([]string{
+			s.SessionID,
+			s.RoomID,
+			s.UserID,
+			s.StartedAt.UTC().Format(time.RFC3339),
+			endedAt,
+			strconv.FormatFloat(end.Sub(s.StartedAt).Seconds(), 'f', 0, 64),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
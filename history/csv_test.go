@@ -0,0 +1,60 @@
+package history
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteAttendanceCSV(t *testing.T) {
+	joined := time.Date(2026, 3, 2, 10, 0, 0, 0, time.FixedZone("CET", 3600))
+	left := joined.Add(90*time.Minute + 400*time.Millisecond)
+	const header = "session_id,room_id,user_id,role,joined_at,left_at,duration_seconds,talk_seconds\n"
+	tests := []struct {
+		name string
+		rows []Attendance
+		want string
+	}{
+		{
+			name: "header only",
+			want: header,
+		},
+		{
+			name: "times in UTC and seconds rounded",
+			rows: []Attendance{{SessionID: "s1", RoomID: "room-a", UserID: "alice", Role: "host", JoinedAt: joined, LeftAt: &left, TalkSeconds: 61.6}},
+			want: header + "s1,room-a,alice,host,2026-03-02T09:00:00Z,2026-03-02T10:30:00Z,5400,62\n",
+		},
+		{
+			name: "fields quoted",
+			rows: []Attendance{{SessionID: "s1", RoomID: "room, a", UserID: `al"ice`, Role: "guest", JoinedAt: joined, LeftAt: &left}},
+			want: header + `s1,"room, a","al""ice",guest,2026-03-02T09:00:00Z,2026-03-02T10:30:00Z,5400,0` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteAttendanceCSV(&buf, tt.rows); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteAttendanceCSVOpen(t *testing.T) {
+	var buf bytes.Buffer
+	rows := []Attendance{{SessionID: "s1", RoomID: "room-a", UserID: "alice", Role: "host", JoinedAt: time.Now().Add(-time.Minute)}}
+	if err := WriteAttendanceCSV(&buf, rows); err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Split(strings.TrimSpace(strings.Split(buf.String(), "\n")[1]), ",")
+	if fields[5] != "" {
+		t.Errorf("left_at = %q, want empty while open", fields[5])
+	}
+	if fields[6] != "60" {
+		t.Errorf("duration = %s, want 60 lasting until now", fields[6])
+	}
+}
@@ -0,0 +1,137 @@
+package history
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DriverNone   = "none"
+	DriverSQLite = "sqlite"
+)
+
+type Config struct {
+	// sqlite or none
+	Driver string
+	// database file of the sqlite driver
+	Path      string
+	QueueSize int
+}
+
+// DefaultConfig keeps no history; recording is turned on with
+// HISTORY_DRIVER=sqlite.
+func DefaultConfig() Config {
+	return Config{
+		Driver:    DriverNone,
+		Path:      "history.db",
+		QueueSize: 1000,
+	}
+}
+
+// LoadConfig reads the history settings from configuration keys, get returns
+// "" for unset keys.
+func LoadConfig(get func(key string) string) (Config, error) {
+	c := DefaultConfig()
+	if v := get("HISTORY_DRIVER"); v != "" {
+		c.Driver = strings.ToLower(v)
+	}
+	if v := get("HISTORY_PATH"); v != "" {
+		c.Path = v
+	}
+	if v := get("HISTORY_QUEUE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return c, fmt.Errorf("HISTORY_QUEUE_SIZE: %w", err)
+		}
+		c.QueueSize = n
+	}
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	switch c.Driver {
+	case DriverNone:
+	case DriverSQLite:
+		if c.Path == "" {
+			return fmt.Errorf("history: HISTORY_PATH must be set for the sqlite driver")
+		}
+	default:
+		return fmt.Errorf("history: unknown driver %q, use sqlite or none", c.Driver)
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("history: queue size must be positive")
+	}
+	return nil
+}
+
+// RoomSession is one life of a room, from its first join until it closes.
+type RoomSession struct {
+	ID          string     `json:"id"`
+	RoomID      string     `json:"roomId"`
+	StartedAt   time.Time  `json:"startedAt"`
+	EndedAt     *time.Time `json:"endedAt,omitempty"`
+	CloseReason string     `json:"closeReason,omitempty"`
+}
+
+// Attendance is one connection of a participant to a room session; a user who
+// reconnects gets one row per connection.
+type Attendance struct {
+	ID        string     `json:"id"`
+	SessionID string     `json:"sessionId"`
+	RoomID    string     `json:"roomId"`
+	UserID    string     `json:"userId"`
+	Role      string     `json:"role"`
+	JoinedAt  time.Time  `json:"joinedAt"`
+	LeftAt    *time.Time `json:"leftAt,omitempty"`
+	// time the participant's microphone carried voice
+	TalkSeconds float64 `json:"talkSeconds"`
+}
+
+type Share struct {
+	SessionID string     `json:"sessionId"`
+	RoomID    string     `json:"roomId"`
+	UserID    string     `json:"userId"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+}
+
+// Filter narrows a query; zero fields match everything. From and To bound the
+// start of the session, join or share.
+type Filter struct {
+	RoomID    string
+	SessionID string
+	UserID    string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+// Store persists the history. Implementations are only called from the
+// recorder goroutine and the HTTP handlers, so they must be safe for
+// concurrent use.
+type Store interface {
+	OpenRoom(s RoomSession) error
+	// CloseRoom also ends the attendances and shares still open in the session.
+	CloseRoom(sessionID string, at time.Time, reason string) error
+	Join(a Attendance) error
+	Leave(attendanceID string, at time.Time, talkSeconds float64) error
+	StartShare(s Share) error
+	// StopShare ends the open share of userID in the session, if any.
+	StopShare(sessionID, userID string, at time.Time) error
+
+	Sessions(f Filter) ([]RoomSession, error)
+	Attendance(f Filter) ([]Attendance, error)
+	Shares(f Filter) ([]Share, error)
+	Close() error
+}
+
+// NewID returns a random identifier for a session or an attendance.
+func NewID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
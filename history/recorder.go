@@ -0,0 +1,160 @@
+package history
+
+import (
+	"mediaserver/utils/logging"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("history")
+
+// maxQueries bounds the queries running at once; more are refused.
+const maxQueries = 4
+
+// recorder writes the events to the store from a single goroutine, in the
+// order they happened. Room and share events beyond the queue size are
+// dropped; attendance is kept whatever the backlog, so a slow database delays
+// the report instead of losing who was there.
+type recorder struct {
+	store Store
+	size  int
+
+	mu      sync.Mutex
+	pending []func(Store) error
+	// events queued and written since Start, for queries to wait on
+	queued, written uint64
+	flushed         *sync.Cond
+	wake            chan struct{}
+
+	queries chan struct{}
+}
+
+var current *recorder
+
+// Start records every following event in s. Without Start the events are
+// discarded.
+func Start(s Store, queueSize int) {
+	current = newRecorder(s, queueSize)
+}
+
+func newRecorder(s Store, size int) *recorder {
+	r := &recorder{
+		store:   s,
+		size:    size,
+		wake:    make(chan struct{}, 1),
+		queries: make(chan struct{}, maxQueries),
+	}
+	r.flushed = sync.NewCond(&r.mu)
+	go r.run()
+	return r
+}
+
+// Current returns the started store, nil when history is disabled.
+func Current() Store {
+	if current == nil {
+		return nil
+	}
+	return current.store
+}
+
+func (r *recorder) run() {
+	for range r.wake {
+		r.mu.Lock()
+		ops := r.pending
+		r.pending = nil
+		r.mu.Unlock()
+		for _, op := range ops {
+			if err := op(r.store); err != nil {
+				logger.Warn("history write failed", "error", err)
+			}
+		}
+		r.mu.Lock()
+		r.written += uint64(len(ops))
+		r.flushed.Broadcast()
+		r.mu.Unlock()
+	}
+}
+
+// enqueue never blocks the media and signaling paths. When the database falls
+// behind, the event is lost unless keep is set.
+func (r *recorder) enqueue(event string, keep bool, op func(Store) error) {
+	r.mu.Lock()
+	if len(r.pending) >= r.size && !keep {
+		r.mu.Unlock()
+		logger.Warn("history queue full, event dropped", "event", event)
+		return
+	}
+	r.pending = append(r.pending, op)
+	r.queued++
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// query runs fn on its own goroutine once the events queued before it are
+// written, so it neither waits behind later writes nor takes a place in the
+// queue.
+func (r *recorder) query(fn func(Store)) bool {
+	select {
+	case r.queries <- struct{}{}:
+	default:
+		return false
+	}
+	r.mu.Lock()
+	upTo := r.queued
+	r.mu.Unlock()
+	go func() {
+		defer func() { <-r.queries }()
+		r.mu.Lock()
+		for r.written < upTo {
+			r.flushed.Wait()
+		}
+		r.mu.Unlock()
+		fn(r.store)
+	}()
+	return true
+}
+
+func enqueue(event string, keep bool, op func(Store) error) {
+	if current != nil {
+		current.enqueue(event, keep, op)
+	}
+}
+
+func RoomOpened(sessionID, roomID string, at time.Time) {
+	enqueue("room-opened", true, func(s Store) error {
+		return s.OpenRoom(RoomSession{ID: sessionID, RoomID: roomID, StartedAt: at})
+	})
+}
+
+func RoomClosed(sessionID string, at time.Time, reason string) {
+	enqueue("room-closed", true, func(s Store) error { return s.CloseRoom(sessionID, at, reason) })
+}
+
+func Joined(a Attendance) {
+	enqueue("joined", true, func(s Store) error { return s.Join(a) })
+}
+
+func Left(attendanceID string, at time.Time, talk time.Duration) {
+	enqueue("left", true, func(s Store) error { return s.Leave(attendanceID, at, talk.Seconds()) })
+}
+
+func ShareStarted(sh Share) {
+	enqueue("share-started", false, func(s Store) error { return s.StartShare(sh) })
+}
+
+func ShareStopped(sessionID, userID string, at time.Time) {
+	enqueue("share-stopped", false, func(s Store) error { return s.StopShare(sessionID, userID, at) })
+}
+
+// Query runs fn on the store after the events recorded so far were written,
+// so a report includes the joins that just happened. fn does not run when
+// history is disabled or too many queries are running.
+func Query(fn func(Store)) bool {
+	if current == nil {
+		return false
+	}
+	return current.query(fn)
+}
@@ -0,0 +1,153 @@
+package history
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore remembers the attendances and shares written to it. Until gate is
+// closed every write blocks, like a database that fell behind.
+type fakeStore struct {
+	gate chan struct{}
+
+	mu         sync.Mutex
+	attendance []string
+	shares     []string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{gate: make(chan struct{})}
+}
+
+func (s *fakeStore) OpenRoom(RoomSession) error                { <-s.gate; return nil }
+func (s *fakeStore) CloseRoom(string, time.Time, string) error { <-s.gate; return nil }
+func (s *fakeStore) Leave(string, time.Time, float64) error    { <-s.gate; return nil }
+func (s *fakeStore) StopShare(string, string, time.Time) error { <-s.gate; return nil }
+func (s *fakeStore) Sessions(Filter) ([]RoomSession, error)    { return nil, nil }
+func (s *fakeStore) Shares(Filter) ([]Share, error)            { return nil, nil }
+func (s *fakeStore) Close() error                              { return nil }
+func (s *fakeStore) Attendance(Filter) ([]Attendance, error)   { return nil, nil }
+
+func (s *fakeStore) Join(a Attendance) error {
+	<-s.gate
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attendance = append(s.attendance, a.ID)
+	return nil
+}
+
+func (s *fakeStore) StartShare(sh Share) error {
+	<-s.gate
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shares = append(s.shares, sh.UserID)
+	return nil
+}
+
+func (s *fakeStore) written() (attendance, shares int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.attendance), len(s.shares)
+}
+
+// waitQuery runs a query on r and returns what it saw of the store.
+func waitQuery(t *testing.T, r *recorder, s *fakeStore) (attendance, shares int) {
+	t.Helper()
+	done := make(chan struct{})
+	if !r.query(func(Store) { attendance, shares = s.written(); close(done) }) {
+		t.Fatal("query refused")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("query did not run")
+	}
+	return attendance, shares
+}
+
+func TestRecorderKeepsAttendance(t *testing.T) {
+	tests := []struct {
+		name   string
+		joins  int
+		shares int
+		// shares past the queue size are dropped, joins never
+		wantShares int
+	}{
+		{"within the queue", 2, 1, 1},
+		{"joins past the queue", 10, 0, 0},
+		{"shares dropped once full", 4, 3, 0},
+		{"shares before the joins fill it", 0, 6, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeStore()
+			r := newRecorder(s, 4)
+			// the worker takes the first event and blocks on it, the rest wait
+			// in the queue
+			r.enqueue("joined", true, func(s Store) error { return s.Join(Attendance{ID: "first"}) })
+			for taken := false; !taken; {
+				r.mu.Lock()
+				taken = len(r.pending) == 0
+				r.mu.Unlock()
+			}
+			for i := 0; i < tt.joins; i++ {
+				r.enqueue("joined", true, func(s Store) error { return s.Join(Attendance{ID: "a"}) })
+			}
+			for i := 0; i < tt.shares; i++ {
+				r.enqueue("share-started", false, func(s Store) error { return s.StartShare(Share{UserID: "u"}) })
+			}
+			close(s.gate)
+			attendance, shares := waitQuery(t, r, s)
+			if attendance != tt.joins+1 {
+				t.Errorf("%d attendances written, want %d", attendance, tt.joins+1)
+			}
+			if shares != tt.wantShares {
+				t.Errorf("%d shares written, want %d", shares, tt.wantShares)
+			}
+		})
+	}
+}
+
+func TestQuerySeesEarlierWrites(t *testing.T) {
+	s := newFakeStore()
+	r := newRecorder(s, 100)
+	for i := 0; i < 20; i++ {
+		r.enqueue("joined", true, func(s Store) error { return s.Join(Attendance{ID: "a"}) })
+	}
+	ran := make(chan int, 1)
+	if !r.query(func(Store) { n, _ := s.written(); ran <- n }) {
+		t.Fatal("query refused")
+	}
+	// a join after the query does not hold it back
+	r.enqueue("joined", true, func(s Store) error { return s.Join(Attendance{ID: "late"}) })
+	select {
+	case n := <-ran:
+		t.Fatalf("query ran with %d of 20 joins written", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(s.gate)
+	select {
+	case n := <-ran:
+		if n < 20 {
+			t.Errorf("query saw %d joins, want the 20 before it", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query did not run")
+	}
+}
+
+func TestQueryLimit(t *testing.T) {
+	s := newFakeStore()
+	r := newRecorder(s, 100)
+	r.enqueue("joined", true, func(s Store) error { return s.Join(Attendance{ID: "a"}) })
+	for i := 0; i < maxQueries; i++ {
+		if !r.query(func(Store) {}) {
+			t.Fatalf("query %d refused", i+1)
+		}
+	}
+	if r.query(func(Store) {}) {
+		t.Error("query past the limit accepted while the others wait")
+	}
+	close(s.gate)
+}
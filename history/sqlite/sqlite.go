@@ -0,0 +1,257 @@
+// Package sqlite stores the history in a SQLite database file.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"mediaserver/history"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// times are stored as unix milliseconds, NULL while a session is open
+const schema = `
+CREATE TABLE IF NOT EXISTS room_sessions (
+	id           TEXT PRIMARY KEY,
+	room_id      TEXT NOT NULL,
+	started_at   INTEGER NOT NULL,
+	ended_at     INTEGER,
+	close_reason TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS room_sessions_room ON room_sessions (room_id, started_at);
+
+CREATE TABLE IF NOT EXISTS attendance (
+	id           TEXT PRIMARY KEY,
+	session_id   TEXT NOT NULL,
+	room_id      TEXT NOT NULL,
+	user_id      TEXT NOT NULL,
+	role         TEXT NOT NULL,
+	joined_at    INTEGER NOT NULL,
+	left_at      INTEGER,
+	talk_seconds REAL NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS attendance_session ON attendance (session_id);
+CREATE INDEX IF NOT EXISTS attendance_room ON attendance (room_id, joined_at);
+
+CREATE TABLE IF NOT EXISTS shares (
+	session_id TEXT NOT NULL,
+	room_id    TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	ended_at   INTEGER
+);
+CREATE INDEX IF NOT EXISTS shares_session ON shares (session_id, user_id);
+`
+
+// an interrupted session ends with the last join or leave seen in it, and so
+// do its open attendances and shares
+const closeInterrupted = `
+UPDATE room_sessions SET close_reason = 'interrupted', ended_at = COALESCE(
+	(SELECT MAX(COALESCE(left_at, joined_at)) FROM attendance WHERE session_id = room_sessions.id),
+	started_at)
+WHERE ended_at IS NULL;
+UPDATE attendance SET left_at = (SELECT ended_at FROM room_sessions WHERE id = attendance.session_id)
+WHERE left_at IS NULL;
+UPDATE shares SET ended_at = (SELECT ended_at FROM room_sessions WHERE id = shares.session_id)
+WHERE ended_at IS NULL;
+`
+
+type Store struct {
+	db *sql.DB
+}
+
+// Open creates the database file and its tables when missing. Sessions left
+// open by a previous run that stopped without closing them are closed as
+// "interrupted".
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// one connection serializes the writes and keeps the WAL readers simple
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: create schema: %w", err)
+	}
+	if _, err := db.Exec(closeInterrupted); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: close interrupted sessions: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) OpenRoom(r history.RoomSession) error {
+	_, err := s.db.Exec(`INSERT INTO room_sessions (id, room_id, started_at) VALUES (?, ?, ?)`,
+		r.ID, r.RoomID, millis(r.StartedAt))
+	return err
+}
+
+func (s *Store) CloseRoom(sessionID string, at time.Time, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	end := millis(at)
+	if _, err := tx.Exec(`UPDATE room_sessions SET ended_at = ?, close_reason = ? WHERE id = ?`, end, reason, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE attendance SET left_at = ? WHERE session_id = ? AND left_at IS NULL`, end, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE shares SET ended_at = ? WHERE session_id = ? AND ended_at IS NULL`, end, sessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) Join(a history.Attendance) error {
+	_, err := s.db.Exec(`INSERT INTO attendance (id, session_id, room_id, user_id, role, joined_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		a.ID, a.SessionID, a.RoomID, a.UserID, a.Role, millis(a.JoinedAt))
+	return err
+}
+
+func (s *Store) Leave(attendanceID string, at time.Time, talkSeconds float64) error {
+	_, err := s.db.Exec(`UPDATE attendance SET left_at = ?, talk_seconds = ? WHERE id = ?`,
+		millis(at), talkSeconds, attendanceID)
+	return err
+}
+
+func (s *Store) StartShare(sh history.Share) error {
+	_, err := s.db.Exec(`INSERT INTO shares (session_id, room_id, user_id, started_at) VALUES (?, ?, ?, ?)`,
+		sh.SessionID, sh.RoomID, sh.UserID, millis(sh.StartedAt))
+	return err
+}
+
+func (s *Store) StopShare(sessionID, userID string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE shares SET ended_at = ? WHERE session_id = ? AND user_id = ? AND ended_at IS NULL`,
+		millis(at), sessionID, userID)
+	return err
+}
+
+func (s *Store) Sessions(f history.Filter) ([]history.RoomSession, error) {
+	where, args := conditions(f, "started_at", false)
+	rows, err := s.db.Query(`SELECT id, room_id, started_at, ended_at, close_reason FROM room_sessions`+where+` ORDER BY started_at DESC`+limit(f), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []history.RoomSession{}
+	for rows.Next() {
+		var r history.RoomSession
+		var started int64
+		var ended sql.NullInt64
+		if err := rows.Scan(&r.ID, &r.RoomID, &started, &ended, &r.CloseReason); err != nil {
+			return nil, err
+		}
+		r.StartedAt, r.EndedAt = fromMillis(started), nullTime(ended)
+		sessions = append(sessions, r)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *Store) Attendance(f history.Filter) ([]history.Attendance, error) {
+	where, args := conditions(f, "joined_at", true)
+	rows, err := s.db.Query(`SELECT id, session_id, room_id, user_id, role, joined_at, left_at, talk_seconds FROM attendance`+where+` ORDER BY joined_at`+limit(f), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attendance := []history.Attendance{}
+	for rows.Next() {
+		var a history.Attendance
+		var joined int64
+		var left sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.SessionID, &a.RoomID, &a.UserID, &a.Role, &joined, &left, &a.TalkSeconds); err != nil {
+			return nil, err
+		}
+		a.JoinedAt, a.LeftAt = fromMillis(joined), nullTime(left)
+		attendance = append(attendance, a)
+	}
+	return attendance, rows.Err()
+}
+
+func (s *Store) Shares(f history.Filter) ([]history.Share, error) {
+	where, args := conditions(f, "started_at", true)
+	rows, err := s.db.Query(`SELECT session_id, room_id, user_id, started_at, ended_at FROM shares`+where+` ORDER BY started_at`+limit(f), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shares := []history.Share{}
+	for rows.Next() {
+		var sh history.Share
+		var started int64
+		var ended sql.NullInt64
+		if err := rows.Scan(&sh.SessionID, &sh.RoomID, &sh.UserID, &started, &ended); err != nil {
+			return nil, err
+		}
+		sh.StartedAt, sh.EndedAt = fromMillis(started), nullTime(ended)
+		shares = append(shares, sh)
+	}
+	return shares, rows.Err()
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// conditions builds the WHERE clause of f; the room_sessions table has its
+// session in the id column and no user.
+func conditions(f history.Filter, timeColumn string, perUser bool) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	add := func(clause string, arg interface{}) {
+		clauses = append(clauses, clause)
+		args = append(args, arg)
+	}
+	if f.RoomID != "" {
+		add("room_id = ?", f.RoomID)
+	}
+	if f.SessionID != "" {
+		if perUser {
+			add("session_id = ?", f.SessionID)
+		} else {
+			add("id = ?", f.SessionID)
+		}
+	}
+	if f.UserID != "" && perUser {
+		add("user_id = ?", f.UserID)
+	}
+	if !f.From.IsZero() {
+		add(timeColumn+" >= ?", millis(f.From))
+	}
+	if !f.To.IsZero() {
+		add(timeColumn+" < ?", millis(f.To))
+	}
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(clauses, " AND "), args
+}
+
+func limit(f history.Filter) string {
+	if f.Limit <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" LIMIT %d", f.Limit)
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.UnixMilli(ms).UTC()
+}
+
+func nullTime(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := fromMillis(v.Int64)
+	return &t
+}
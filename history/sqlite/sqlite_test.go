@@ -0,0 +1,218 @@
+package sqlite
+
+import (
+	"bytes"
+	"mediaserver/history"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+
+func at(minutes int) time.Time {
+	return t0.Add(time.Duration(minutes) * time.Minute)
+}
+
+func openMemory(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seed records two sessions of room-a and one of room-b:
+//
+//	s1 room-a 0..60: alice 0..30 talking 120s, bob 10..60 (left open, ended by the close)
+//	s2 room-a 120..:  alice 120.. still there
+//	s3 room-b 30..90: carol 30..90 talking 45.5s
+func seed(t *testing.T, s *Store) {
+	t.Helper()
+	must(t, s.OpenRoom(history.RoomSession{ID: "s1", RoomID: "room-a", StartedAt: at(0)}))
+	must(t, s.Join(history.Attendance{ID: "a1", SessionID: "s1", RoomID: "room-a", UserID: "alice", Role: "host", JoinedAt: at(0)}))
+	must(t, s.Join(history.Attendance{ID: "a2", SessionID: "s1", RoomID: "room-a", UserID: "bob", Role: "guest", JoinedAt: at(10)}))
+	must(t, s.StartShare(history.Share{SessionID: "s1", RoomID: "room-a", UserID: "bob", StartedAt: at(20)}))
+	must(t, s.Leave("a1", at(30), 120))
+	must(t, s.CloseRoom("s1", at(60), "empty"))
+
+	must(t, s.OpenRoom(history.RoomSession{ID: "s3", RoomID: "room-b", StartedAt: at(30)}))
+	must(t, s.Join(history.Attendance{ID: "a3", SessionID: "s3", RoomID: "room-b", UserID: "carol", Role: "host", JoinedAt: at(30)}))
+	must(t, s.Leave("a3", at(90), 45.5))
+	must(t, s.CloseRoom("s3", at(90), "empty"))
+
+	must(t, s.OpenRoom(history.RoomSession{ID: "s2", RoomID: "room-a", StartedAt: at(120)}))
+	must(t, s.Join(history.Attendance{ID: "a4", SessionID: "s2", RoomID: "room-a", UserID: "alice", Role: "host", JoinedAt: at(120)}))
+}
+
+func ids(rows []history.Attendance) string {
+	var out []string
+	for _, a := range rows {
+		out = append(out, a.ID)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestAttendanceFilter(t *testing.T) {
+	s := openMemory(t)
+	seed(t, s)
+	tests := []struct {
+		name   string
+		filter history.Filter
+		want   string
+	}{
+		{"everything in join order", history.Filter{}, "a1,a2,a3,a4"},
+		{"room", history.Filter{RoomID: "room-a"}, "a1,a2,a4"},
+		{"session", history.Filter{SessionID: "s1"}, "a1,a2"},
+		{"user", history.Filter{UserID: "alice"}, "a1,a4"},
+		{"from is inclusive", history.Filter{From: at(30)}, "a3,a4"},
+		{"to is exclusive", history.Filter{To: at(30)}, "a1,a2"},
+		{"room and time", history.Filter{RoomID: "room-a", From: at(5), To: at(200)}, "a2,a4"},
+		{"limit", history.Filter{Limit: 2}, "a1,a2"},
+		{"no match", history.Filter{RoomID: "room-c"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := s.Attendance(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(rows); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttendanceTimes(t *testing.T) {
+	s := openMemory(t)
+	seed(t, s)
+	rows, err := s.Attendance(history.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := map[string]history.Attendance{}
+	for _, a := range rows {
+		byID[a.ID] = a
+	}
+	tests := []struct {
+		id     string
+		joined time.Time
+		// nil while the attendance is open
+		left *time.Time
+		talk float64
+	}{
+		{"a1", at(0), ptr(at(30)), 120},
+		{"a2", at(10), ptr(at(60)), 0}, // ended with its session
+		{"a3", at(30), ptr(at(90)), 45.5},
+		{"a4", at(120), nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			a := byID[tt.id]
+			if !a.JoinedAt.Equal(tt.joined) {
+				t.Errorf("joined at %v, want %v", a.JoinedAt, tt.joined)
+			}
+			switch {
+			case tt.left == nil && a.LeftAt != nil:
+				t.Errorf("left at %v, want still open", *a.LeftAt)
+			case tt.left != nil && (a.LeftAt == nil || !a.LeftAt.Equal(*tt.left)):
+				t.Errorf("left at %v, want %v", a.LeftAt, *tt.left)
+			}
+			if a.TalkSeconds != tt.talk {
+				t.Errorf("talked %vs, want %vs", a.TalkSeconds, tt.talk)
+			}
+		})
+	}
+}
+
+func TestSessionsAndShares(t *testing.T) {
+	s := openMemory(t)
+	seed(t, s)
+
+	sessions, err := s.Sessions(history.Filter{RoomID: "room-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "s2" || sessions[1].ID != "s1" {
+		t.Fatalf("sessions = %+v, want s2 then s1", sessions)
+	}
+	if sessions[0].EndedAt != nil {
+		t.Errorf("open session ended at %v", *sessions[0].EndedAt)
+	}
+	if sessions[1].CloseReason != "empty" || sessions[1].EndedAt == nil || !sessions[1].EndedAt.Equal(at(60)) {
+		t.Errorf("closed session = %+v, want ended at %v for empty", sessions[1], at(60))
+	}
+
+	shares, err := s.Shares(history.Filter{SessionID: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 1 || shares[0].EndedAt == nil || !shares[0].EndedAt.Equal(at(60)) {
+		t.Errorf("shares = %+v, want bob's share ended by the close", shares)
+	}
+}
+
+func TestOpenClosesInterruptedSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	must(t, s.OpenRoom(history.RoomSession{ID: "s1", RoomID: "room-a", StartedAt: at(0)}))
+	must(t, s.Join(history.Attendance{ID: "a1", SessionID: "s1", RoomID: "room-a", UserID: "alice", Role: "host", JoinedAt: at(0)}))
+	must(t, s.Join(history.Attendance{ID: "a2", SessionID: "s1", RoomID: "room-a", UserID: "bob", Role: "guest", JoinedAt: at(5)}))
+	must(t, s.Leave("a2", at(15), 0))
+	must(t, s.Close())
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sessions, err := s.Sessions(history.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].CloseReason != "interrupted" || sessions[0].EndedAt == nil || !sessions[0].EndedAt.Equal(at(15)) {
+		t.Fatalf("sessions = %+v, want s1 interrupted at the last leave", sessions)
+	}
+	rows, err := s.Attendance(history.Filter{UserID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].LeftAt == nil || !rows[0].LeftAt.Equal(at(15)) {
+		t.Errorf("attendance = %+v, want alice left when the session ended", rows)
+	}
+}
+
+func TestAttendanceCSVFromStore(t *testing.T) {
+	s := openMemory(t)
+	seed(t, s)
+	rows, err := s.Attendance(history.Filter{SessionID: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	must(t, history.WriteAttendanceCSV(&buf, rows))
+	want := "session_id,room_id,user_id,role,joined_at,left_at,duration_seconds,talk_seconds\n" +
+		"s1,room-a,alice,host,2026-03-02T09:00:00Z,2026-03-02T09:30:00Z,1800,120\n" +
+		"s1,room-a,bob,guest,2026-03-02T09:10:00Z,2026-03-02T10:00:00Z,3000,0\n"
+	if buf.String() != want {
+		t.Errorf("csv:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func ptr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,64 @@
+package activity
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// levels are in -dBov, 127 being silence; browsers report background
+	// noise well below this
+	voiceLevel = 50
+	// a pause shorter than this still counts as talking
+	maxGap = 300 * time.Millisecond
+)
+
+// Talk adds up how long a participant spoke, from the audio level header
+// extension (RFC 6464) of its audio packets.
+type Talk struct {
+	mu    sync.Mutex
+	last  time.Time
+	total time.Duration
+}
+
+// LevelExtension returns the id negotiated for the audio level extension on
+// receiver, 0 when the browser does not send it.
+func LevelExtension(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.AudioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// Observe accounts for one audio packet received at the given time.
+func (t *Talk) Observe(header *rtp.Header, extID uint8, at time.Time) {
+	if extID == 0 {
+		return
+	}
+	raw := header.GetExtension(extID)
+	if raw == nil {
+		return
+	}
+	var level rtp.AudioLevelExtension
+	if err := level.Unmarshal(raw); err != nil || level.Level > voiceLevel {
+		return
+	}
+	t.mu.Lock()
+	if gap := at.Sub(t.last); gap > 0 && gap < maxGap {
+		t.total += gap
+	}
+	t.last = at
+	t.mu.Unlock()
+}
+
+func (t *Talk) Total() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
@@ -0,0 +1,109 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrBreakoutsOpen = errors.New("the room already has breakout rooms")
+	ErrRoomTaken     = errors.New("a room with this ID is already open")
+)
+
+// Breakouts are the breakout rooms a host split a room into. They belong to
+// the parent room's loop.
+type Breakouts struct {
+	Rooms []Breakout
+	// zero when they last until a host closes them
+	EndsAt time.Time
+	timer  *time.Timer
+	closed bool
+}
+
+type Breakout struct {
+	Room *Room
+	Name string
+}
+
+// BreakoutInfo describes a breakout room to the participants.
+type BreakoutInfo struct {
+	RoomID string `json:"roomId"`
+	Name   string `json:"name"`
+}
+
+// OpenBreakouts opens a breakout room of parent per name, with the IDs
+// "<parent>:breakout-<n>"; setup runs on each before it opens. The rooms
+// count against maxRooms, 0 meaning unlimited.
+func OpenBreakouts(parent *Room, names []string, maxRooms int, setup func(*Room)) (*Breakouts, error) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	if maxRooms > 0 && len(rooms)+len(names) > maxRooms {
+		return nil, ErrTooManyRooms
+	}
+	ids := make([]string, len(names))
+	for i := range names {
+		ids[i] = fmt.Sprintf("%s:breakout-%d", parent.ID, i+1)
+		if _, taken := rooms[ids[i]]; taken {
+			return nil, fmt.Errorf("%w: %s", ErrRoomTaken, ids[i])
+		}
+	}
+	b := &Breakouts{}
+	for i, name := range names {
+		room := open(ids[i], func(r *Room) {
+			r.Parent = parent
+			if setup != nil {
+				setup(r)
+			}
+		})
+		b.Rooms = append(b.Rooms, Breakout{Room: room, Name: name})
+	}
+	return b, nil
+}
+
+// Find returns the breakout room roomID.
+func (b *Breakouts) Find(roomID string) (*Room, bool) {
+	for _, br := range b.Rooms {
+		if br.Room.ID == roomID {
+			return br.Room, true
+		}
+	}
+	return nil, false
+}
+
+func (b *Breakouts) Info() []BreakoutInfo {
+	info := make([]BreakoutInfo, 0, len(b.Rooms))
+	for _, br := range b.Rooms {
+		info = append(info, BreakoutInfo{RoomID: br.Room.ID, Name: br.Name})
+	}
+	return info
+}
+
+// SetTimer calls end after d, 0 for never, replacing the previous timer.
+func (b *Breakouts) SetTimer(d time.Duration, end func()) {
+	b.Stop()
+	b.EndsAt = time.Time{}
+	if d > 0 {
+		b.EndsAt = time.Now().Add(d)
+		b.timer = time.AfterFunc(d, end)
+	}
+}
+
+// Close stops the timer and tells whether the breakouts were still open: the
+// first caller, a host or the timer, is the one bringing everyone back.
+func (b *Breakouts) Close() bool {
+	b.Stop()
+	if b.closed {
+		return false
+	}
+	b.closed = true
+	return true
+}
+
+// Stop cancels the timer of breakouts being closed.
+func (b *Breakouts) Stop() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
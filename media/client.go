@@ -1,73 +1,198 @@
 package media
 
 import (
-	"log"
+	"log/slog"
+	"mediaserver/history"
+	"mediaserver/media/activity"
 	"mediaserver/media/message"
+	"mediaserver/media/quality"
+	"mediaserver/media/socket"
+	"mediaserver/metrics"
+	"mediaserver/tracing"
+	"mediaserver/utils/logging"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 )
 
+const (
+	AudioModeSFU   = "sfu"
+	AudioModeMixed = "mixed"
+)
+
+// Roles allowed to moderate a room and to see everyone's connection quality.
+const (
+	RoleHost    = "host"
+	RoleTeacher = "teacher"
+)
+
+// WebSocket close codes sent to a client removed by a host or an admin, to
+// one whose send queue stayed full, to one whose peer connection failed and
+// to one a host did not let in from the lobby.
+const (
+	CloseCodeKicked       = 4000
+	CloseCodeSlowConsumer = 4001
+	CloseCodeMediaLost    = 4002
+	CloseCodeDenied       = 4003
+)
+
+// sendPriorities tells SafeSend how to queue each event, the others are
+// socket.Normal. Losing an offer, answer or candidate breaks the peer
+// connection; a connection-quality report only matters until the next one.
+var sendPriorities = map[string]socket.Priority{
+	"offer":              socket.Critical,
+	"answer":             socket.Critical,
+	"ice-candidate":      socket.Critical,
+	"joined":             socket.Critical,
+	"error":              socket.Critical,
+	"connection-quality": socket.Latest,
+}
+
+var logger = logging.For("media")
+
+// Client fields are set before the client joins its room and only read
+// afterwards, except the ones marked as owned by the room: those are read and
+// written on the room's loop, through Room.Do.
 type Client struct {
-	UserID      string
-	RoomID      string
-	Role        string
-	IsCamOn     bool
-	IsMicOn     bool
-	PeerConn    *webrtc.PeerConnection
-	Conn        *websocket.Conn
-	AudioTrack  *webrtc.TrackLocalStaticRTP
-	VideoTrack  *webrtc.TrackLocalStaticRTP
-	ScreenTrack *webrtc.TrackLocalStaticRTP
-	Send        chan message.Message
-	Read        chan message.Message
-	Done        chan struct{}
-	Streams     *[]interface{}
-	CloseOnce   sync.Once
-}
-
-func CreateClientConnection(userId string, roomId string, role string, isCamOn bool, isMicOn bool, connection *websocket.Conn) *Client {
-	log.Println("Create user")
+	UserID string
+	// the room the client connected to, a breakout move does not change it
+	RoomID string
+	Role   string
+	// the server verified that the client hosts the room, see VerifyHost
+	Host bool
+	Conn *websocket.Conn
+	// the room the client is in now, set when it joins one
+	room atomic.Pointer[Room]
+	// owned by the room
+	IsCamOn    bool
+	IsMicOn    bool
+	PeerConn   *webrtc.PeerConnection
+	AudioMode  string
+	MixedTrack *webrtc.TrackLocalStaticSample
+	Quality    *quality.Collector
+	// what the client said about its tracks, by track ID; the published
+	// tracks themselves are in Room.Tracks
+	Announced map[string]Announcement
+
+	ICEServers []webrtc.ICEServer
+	// messages waiting for WritePump
+	Outbox *socket.Queue
+	Socket socket.Config
+	// closed by ReadPump when the WebSocket stops
+	Read chan message.Message
+	// closed by Close
+	Done      chan struct{}
+	CloseOnce sync.Once
+	slowOnce  sync.Once
+	// set by ReadPump before it closes Read
+	lost atomic.Bool
+	// carries the room and user IDs
+	Log      *slog.Logger
+	JoinedAt time.Time
+	// row of this connection in the attendance history
+	AttendanceID string
+	Talk         activity.Talk
+	// open from the join message until the first media packet reaches the
+	// client
+	JoinSpan tracing.Pending
+	// open from a server offer until the client's answer
+	NegotiationSpan tracing.Pending
+	// held while an offer or answer is applied to the peer connection, so a
+	// renegotiation never interleaves with the client's own descriptions
+	Negotiation sync.Mutex
+	// held while the client moves between a room and its breakouts
+	Moving sync.Mutex
+}
+
+func CreateClientConnection(userId string, roomId string, role string, isCamOn bool, isMicOn bool, connection *websocket.Conn, settings socket.Config) *Client {
+	clientLog := logger.With("roomId", roomId, "userId", userId)
+	clientLog.Info("client connected", "role", role)
 	return &Client{
-		UserID:  userId,
-		RoomID:  roomId,
-		Role:    role,
-		Conn:    connection,
-		IsCamOn: isCamOn,
-		IsMicOn: isMicOn,
-		Send:    make(chan message.Message, 256),
-		Read:    make(chan message.Message, 256),
-		Done:    make(chan struct{}),
+		UserID:       userId,
+		RoomID:       roomId,
+		Role:         role,
+		Conn:         connection,
+		IsCamOn:      isCamOn,
+		IsMicOn:      isMicOn,
+		AudioMode:    AudioModeSFU,
+		Announced:    make(map[string]Announcement),
+		Outbox:       socket.NewQueue(settings.QueueSize),
+		Socket:       settings,
+		Read:         make(chan message.Message, 256),
+		Done:         make(chan struct{}),
+		Log:          clientLog,
+		JoinedAt:     time.Now(),
+		AttendanceID: history.NewID(),
 	}
 }
 
-func ReadPump(user *Client, room *Room) {
-	defer func() {
-		if r := recover(); r != nil {
-		}
-		delete(room.Clients, user.UserID)
-		log.Println("Delete user")
-		user.CloseOnce.Do(func() {
-			close(user.Done)
-			close(user.Read)
-			close(user.Send)
-			user.Conn.Close()
-		})
-	}()
+// ReadPump feeds Read until the WebSocket fails or the client is closed. A
+// client that sends nothing, not even a pong, for the pong timeout is
+// considered gone.
+func ReadPump(user *Client) {
+	defer close(user.Read)
+	defer user.Close()
+	user.Conn.SetReadLimit(user.Socket.MaxMessageSize)
+	extend := func() error {
+		return user.Conn.SetReadDeadline(time.Now().Add(user.Socket.PongTimeout))
+	}
+	_ = extend()
+	user.Conn.SetPongHandler(func(string) error { return extend() })
 	for {
 		var msg message.Message
 		if err := user.Conn.ReadJSON(&msg); err != nil {
-			log.Println("Error read:", err)
-			break
+			select {
+			case <-user.Done:
+			default:
+				user.lost.Store(!websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway))
+			}
+			user.Log.Info("websocket read stopped", "error", err, "lost", user.lost.Load())
+			return
+		}
+		_ = extend()
+		metrics.WebSocketMessage("in", msg.Event)
+		select {
+		case user.Read <- msg:
+		case <-user.Done:
+			return
 		}
-		user.Read <- msg
 	}
 }
 
+// WritePump drains Outbox and pings the client until the client is closed. A
+// write that does not complete within the write timeout closes the client.
 func WritePump(user *Client) {
-	for msg := range user.Send {
-		log.Println(user.UserID, " send: ", msg.Event)
+	ping := time.NewTicker(user.Socket.PingInterval)
+	defer ping.Stop()
+	for {
+		// a busy queue must not hold back the pings the read deadline relies on
+		select {
+		case <-user.Done:
+			return
+		case <-ping.C:
+			if !user.ping() {
+				return
+			}
+		default:
+		}
+		msg, ok := user.Outbox.Pop()
+		if !ok {
+			select {
+			case <-user.Outbox.Ready():
+			case <-ping.C:
+				if !user.ping() {
+					return
+				}
+			case <-user.Done:
+				return
+			}
+			continue
+		}
+		user.Log.Debug("message sent", "event", msg.Event)
+		_ = user.Conn.SetWriteDeadline(time.Now().Add(user.Socket.WriteTimeout))
 		err := user.Conn.WriteJSON(map[string]interface{}{
 			"event":   msg.Event,
 			"userId":  msg.UserID,
@@ -75,26 +200,111 @@ func WritePump(user *Client) {
 			"payload": msg.Payload,
 		})
 		if err != nil {
-			log.Println(err)
-			user.CloseOnce.Do(func() {
-				close(user.Done)
-				close(user.Read)
-				close(user.Send)
-				user.Conn.Close()
-			})
-			break
+			user.writeFailed(msg.Event, err)
+			return
 		}
+		metrics.WebSocketMessage("out", msg.Event)
 	}
 }
+
+func (c *Client) ping() bool {
+	deadline := time.Now().Add(c.Socket.WriteTimeout)
+	if err := c.Conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+		c.writeFailed("ping", err)
+		return false
+	}
+	return true
+}
+
+func (c *Client) writeFailed(event string, err error) {
+	select {
+	case <-c.Done:
+		// closed while writing, by a kick or the slow consumer check
+	default:
+		c.Log.Warn("websocket write failed", "event", event, "error", err)
+		c.Close()
+	}
+}
+
+// Lost tells, once Read is closed, whether the WebSocket dropped without a
+// close handshake and without the server closing it: the browser may still
+// be there and reconnect.
+func (c *Client) Lost() bool {
+	return c.lost.Load()
+}
+
+func (c *Client) Close() {
+	c.CloseOnce.Do(func() {
+		close(c.Done)
+		c.Conn.Close()
+	})
+}
+
+// Kick tells the browser why with a close frame, then drops the connection;
+// the signaling loop sees the closed socket and cleans up as for a normal leave.
+func (c *Client) Kick(reason string) {
+	c.CloseWith(CloseCodeKicked, reason)
+}
+
+// CloseWith sends a close frame with code and reason, then drops the
+// connection.
+func (c *Client) CloseWith(code int, reason string) {
+	deadline := time.Now().Add(time.Second)
+	_ = c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	c.Close()
+}
+
+// Room returns the room the client is in now, which changes when it moves to
+// or from a breakout room.
+func (c *Client) Room() *Room {
+	return c.room.Load()
+}
+
+// IsHost tells whether the client hosts its room; a host role the server did
+// not verify does not count.
+func (c *Client) IsHost() bool {
+	return c.Host
+}
+
+func IsHostRole(role string) bool {
+	return role == RoleHost || role == RoleTeacher
+}
+
+func (c *Client) IsMixedAudio() bool {
+	return c.AudioMode == AudioModeMixed
+}
+
+// SafeSend queues msg for the WebSocket without blocking. While the queue is
+// full, messages are dropped by priority; a client whose queue stays full for
+// the stall timeout, or that cannot even take critical messages anymore, is
+// disconnected.
 func (c *Client) SafeSend(msg message.Message) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Recovered from send panic:", r)
-		}
-	}()
 	select {
 	case <-c.Done:
+		metrics.SendDrops.WithLabelValues("closed").Inc()
 		return
-	case c.Send <- msg:
+	default:
+	}
+	switch c.Outbox.Push(msg, sendPriorities[msg.Event], msg.Event+"/"+msg.UserID) {
+	case socket.Coalesced:
+		metrics.SendDrops.WithLabelValues("coalesced").Inc()
+	case socket.Dropped:
+		metrics.SendDrops.WithLabelValues("full").Inc()
+		if stalled := c.Outbox.StalledFor(time.Now()); stalled >= c.Socket.StallTimeout {
+			c.dropSlow(stalled)
+		}
+	case socket.Overflow:
+		metrics.SendDrops.WithLabelValues("overflow").Inc()
+		c.dropSlow(c.Outbox.StalledFor(time.Now()))
 	}
 }
+
+// dropSlow disconnects a client that stopped reading; SafeSend runs on room
+// loops, so the close frame is written from another goroutine.
+func (c *Client) dropSlow(stalled time.Duration) {
+	c.slowOnce.Do(func() {
+		c.Log.Warn("disconnecting slow client", "queued", c.Outbox.Len(), "stalled", stalled)
+		metrics.SlowConsumers.Inc()
+		go c.CloseWith(CloseCodeSlowConsumer, "connection too slow")
+	})
+}
@@ -0,0 +1,343 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	ErrNoCommonCodec = errors.New("no codec in the offer is allowed by the room")
+	ErrVideoDisabled = errors.New("video is disabled in this room")
+)
+
+type videoCodec struct {
+	mimeType    string
+	payloadType webrtc.PayloadType
+	rtxType     webrtc.PayloadType
+	fmtp        string
+}
+
+// same payload types as webrtc.MediaEngine.RegisterDefaultCodecs so browsers
+// see the numbers they are used to
+var videoCodecs = map[string][]videoCodec{
+	"vp8": {
+		{webrtc.MimeTypeVP8, 96, 97, ""},
+	},
+	"h264": {
+		{webrtc.MimeTypeH264, 102, 103, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"},
+		{webrtc.MimeTypeH264, 104, 105, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f"},
+		{webrtc.MimeTypeH264, 106, 107, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		{webrtc.MimeTypeH264, 108, 109, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f"},
+		{webrtc.MimeTypeH264, 127, 125, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f"},
+		{webrtc.MimeTypeH264, 39, 40, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=4d001f"},
+		{webrtc.MimeTypeH264, 112, 113, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f"},
+	},
+	"vp9": {
+		{webrtc.MimeTypeVP9, 98, 99, "profile-id=0"},
+		{webrtc.MimeTypeVP9, 100, 101, "profile-id=2"},
+	},
+	"av1": {
+		{webrtc.MimeTypeAV1, 45, 46, ""},
+	},
+}
+
+var audioCodecs = map[string]webrtc.RTPCodecParameters{
+	"opus": {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, PayloadType: 111},
+	"g722": {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000}, PayloadType: 9},
+	"pcmu": {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0},
+	"pcma": {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, PayloadType: 8},
+}
+
+var feedbackTypes = map[string]webrtc.RTCPFeedback{
+	"goog-remb":    {Type: "goog-remb"},
+	"ccm fir":      {Type: "ccm", Parameter: "fir"},
+	"nack":         {Type: "nack"},
+	"nack pli":     {Type: "nack", Parameter: "pli"},
+	"transport-cc": {Type: "transport-cc"},
+}
+
+// Policy lists the codecs a room accepts. The order of Audio and Video is the
+// order of preference in the answer; an empty Video list makes the room
+// audio-only.
+type Policy struct {
+	Audio      []string `json:"audio"`
+	Video      []string `json:"video"`
+	Feedback   []string `json:"feedback"`
+	OpusDTX    bool     `json:"opusDtx"`
+	OpusFEC    bool     `json:"opusFec"`
+	OpusStereo bool     `json:"opusStereo"`
+}
+
+// H.264 goes first so Safari always has a common codec with everyone else.
+func DefaultPolicy() Policy {
+	return Policy{
+		Audio:    []string{"opus"},
+		Video:    []string{"h264", "vp8", "vp9", "av1"},
+		Feedback: []string{"goog-remb", "ccm fir", "nack", "nack pli"},
+		OpusFEC:  true,
+	}
+}
+
+// LoadPolicy reads the policy from configuration keys, get returns "" for
+// unset keys.
+func LoadPolicy(get func(key string) string) (Policy, error) {
+	p := DefaultPolicy()
+	if v := get("CODEC_AUDIO"); v != "" {
+		p.Audio = splitList(v)
+	}
+	if v := get("CODEC_VIDEO"); v != "" {
+		p.Video = splitList(v)
+	}
+	if v := get("CODEC_FEEDBACK"); v != "" {
+		p.Feedback = splitList(v)
+	}
+	for _, b := range []struct {
+		key    string
+		target *bool
+	}{
+		{"OPUS_DTX", &p.OpusDTX},
+		{"OPUS_FEC", &p.OpusFEC},
+		{"OPUS_STEREO", &p.OpusStereo},
+	} {
+		v := get(b.key)
+		if v == "" {
+			continue
+		}
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, fmt.Errorf("%s: %w", b.key, err)
+		}
+		*b.target = on
+	}
+	return p, p.Validate()
+}
+
+// WithOverrides applies the "codecs" object of a join payload on top of p.
+func (p Policy) WithOverrides(overrides map[string]interface{}) (Policy, error) {
+	out := p.clone()
+	if v, ok := overrides["audio"]; ok {
+		out.Audio = toStrings(v)
+	}
+	if v, ok := overrides["video"]; ok {
+		out.Video = toStrings(v)
+	}
+	if v, ok := overrides["feedback"]; ok {
+		out.Feedback = toStrings(v)
+	}
+	if v, ok := overrides["opusDtx"].(bool); ok {
+		out.OpusDTX = v
+	}
+	if v, ok := overrides["opusFec"].(bool); ok {
+		out.OpusFEC = v
+	}
+	if v, ok := overrides["opusStereo"].(bool); ok {
+		out.OpusStereo = v
+	}
+	return out, out.Validate()
+}
+
+// WithFeedback adds RTCP feedback types that are not already in the policy.
+func (p Policy) WithFeedback(extra ...string) Policy {
+	out := p.clone()
+	for _, name := range extra {
+		found := false
+		for _, existing := range out.Feedback {
+			if existing == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out.Feedback = append(out.Feedback, name)
+		}
+	}
+	return out
+}
+
+func (p Policy) Validate() error {
+	if len(p.Audio) == 0 {
+		return errors.New("codec policy: at least one audio codec is required")
+	}
+	for _, name := range p.Audio {
+		if _, ok := audioCodecs[name]; !ok {
+			return fmt.Errorf("codec policy: unknown audio codec %q", name)
+		}
+	}
+	for _, name := range p.Video {
+		if _, ok := videoCodecs[name]; !ok {
+			return fmt.Errorf("codec policy: unknown video codec %q", name)
+		}
+	}
+	for _, name := range p.Feedback {
+		if _, ok := feedbackTypes[name]; !ok {
+			return fmt.Errorf("codec policy: unknown RTCP feedback %q", name)
+		}
+	}
+	return nil
+}
+
+func (p Policy) AudioOnly() bool {
+	return len(p.Video) == 0
+}
+
+func (p Policy) NewMediaEngine() (*webrtc.MediaEngine, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	var feedback, audioFeedback []webrtc.RTCPFeedback
+	for _, name := range p.Feedback {
+		feedback = append(feedback, feedbackTypes[name])
+		// NACK, PLI, FIR and REMB are video feedback
+		if name == "transport-cc" {
+			audioFeedback = append(audioFeedback, feedbackTypes[name])
+		}
+	}
+	for _, name := range p.Audio {
+		params := audioCodecs[name]
+		if name == "opus" {
+			params.SDPFmtpLine = p.opusFmtp()
+		}
+		params.RTCPFeedback = audioFeedback
+		if err := mediaEngine.RegisterCodec(params, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
+	// audio levels of published tracks measure each participant's talk time
+	err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range p.Video {
+		for _, c := range videoCodecs[name] {
+			err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: c.mimeType, ClockRate: 90000, SDPFmtpLine: c.fmtp, RTCPFeedback: feedback},
+				PayloadType:        c.payloadType,
+			}, webrtc.RTPCodecTypeVideo)
+			if err != nil {
+				return nil, err
+			}
+			err = mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", c.payloadType)},
+				PayloadType:        c.rtxType,
+			}, webrtc.RTPCodecTypeVideo)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return mediaEngine, nil
+}
+
+// CheckOffer returns an error when a sending media section of the offer has no
+// codec in common with the policy, so the client can be told why instead of
+// getting an answer with the section rejected.
+func (p Policy) CheckOffer(offerSDP string) error {
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(offerSDP)); err != nil {
+		return err
+	}
+	for _, m := range desc.MediaDescriptions {
+		kind := m.MediaName.Media
+		if m.MediaName.Port.Value == 0 || (kind != "audio" && kind != "video") {
+			continue
+		}
+		_, recvOnly := m.Attribute("recvonly")
+		_, inactive := m.Attribute("inactive")
+		if recvOnly || inactive {
+			continue
+		}
+
+		allowed := p.Audio
+		if kind == "video" {
+			if p.AudioOnly() {
+				return ErrVideoDisabled
+			}
+			allowed = p.Video
+		}
+
+		var offered []string
+		found := false
+		for _, attr := range m.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			name := rtpmapCodec(attr.Value)
+			if name == "rtx" || name == "red" || name == "ulpfec" {
+				continue
+			}
+			offered = append(offered, name)
+			for _, a := range allowed {
+				if a == name {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %s offers %v, room allows %v", ErrNoCommonCodec, kind, offered, allowed)
+		}
+	}
+	return nil
+}
+
+func (p Policy) opusFmtp() string {
+	fmtp := "minptime=10"
+	if p.OpusFEC {
+		fmtp += ";useinbandfec=1"
+	}
+	if p.OpusDTX {
+		fmtp += ";usedtx=1"
+	}
+	if p.OpusStereo {
+		fmtp += ";stereo=1;sprop-stereo=1"
+	}
+	return fmtp
+}
+
+func (p Policy) clone() Policy {
+	out := p
+	out.Audio = append([]string(nil), p.Audio...)
+	out.Video = append([]string(nil), p.Video...)
+	out.Feedback = append([]string(nil), p.Feedback...)
+	return out
+}
+
+// "111 opus/48000/2" -> "opus"
+func rtpmapCodec(value string) string {
+	_, encoding, ok := strings.Cut(value, " ")
+	if !ok {
+		return ""
+	}
+	name, _, _ := strings.Cut(encoding, "/")
+	return strings.ToLower(name)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" && item != "none" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func toStrings(v interface{}) []string {
+	switch list := v.(type) {
+	case string:
+		return splitList(list)
+	case []interface{}:
+		var out []string
+		for _, item := range list {
+			if s, ok := item.(string); ok {
+				out = append(out, strings.ToLower(s))
+			}
+		}
+		return out
+	}
+	return nil
+}
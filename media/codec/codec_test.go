@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// offer builds an SDP offer with one media section per entry of sections.
+func offer(sections ...string) string {
+	lines := []string{
+		"v=0",
+		"o=- 4611731400430051336 2 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+	}
+	for _, s := range sections {
+		lines = append(lines, strings.Split(s, "\n")...)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+const (
+	opusAudio = "m=audio 9 UDP/TLS/RTP/SAVPF 111\nc=IN IP4 0.0.0.0\na=mid:0\na=sendrecv\na=rtpmap:111 opus/48000/2"
+	pcmuAudio = "m=audio 9 UDP/TLS/RTP/SAVPF 0\nc=IN IP4 0.0.0.0\na=mid:0\na=sendrecv\na=rtpmap:0 PCMU/8000"
+	vp8Video  = "m=video 9 UDP/TLS/RTP/SAVPF 96 97\nc=IN IP4 0.0.0.0\na=mid:1\na=sendrecv\na=rtpmap:96 VP8/90000\na=rtpmap:97 rtx/90000"
+	h264Video = "m=video 9 UDP/TLS/RTP/SAVPF 102\nc=IN IP4 0.0.0.0\na=mid:1\na=sendonly\na=rtpmap:102 H264/90000"
+	vp9Recv   = "m=video 9 UDP/TLS/RTP/SAVPF 98\nc=IN IP4 0.0.0.0\na=mid:1\na=recvonly\na=rtpmap:98 VP9/90000"
+	av1Closed = "m=video 0 UDP/TLS/RTP/SAVPF 45\nc=IN IP4 0.0.0.0\na=mid:2\na=sendrecv\na=rtpmap:45 AV1/90000"
+	rtxOnly   = "m=video 9 UDP/TLS/RTP/SAVPF 97\nc=IN IP4 0.0.0.0\na=mid:1\na=sendrecv\na=rtpmap:97 rtx/90000"
+)
+
+func TestCheckOffer(t *testing.T) {
+	vp8Only := DefaultPolicy()
+	vp8Only.Video = []string{"vp8"}
+	audioOnly := DefaultPolicy()
+	audioOnly.Video = nil
+
+	tests := []struct {
+		name   string
+		policy Policy
+		sdp    string
+		want   error
+	}{
+		{"default accepts opus and vp8", DefaultPolicy(), offer(opusAudio, vp8Video), nil},
+		{"default accepts h264", DefaultPolicy(), offer(opusAudio, h264Video), nil},
+		{"codec names are case insensitive", vp8Only, offer(vp8Video), nil},
+		{"no common audio codec", DefaultPolicy(), offer(pcmuAudio), ErrNoCommonCodec},
+		{"no common video codec", vp8Only, offer(h264Video), ErrNoCommonCodec},
+		{"rtx alone is no codec", DefaultPolicy(), offer(rtxOnly), ErrNoCommonCodec},
+		{"recvonly sections are not checked", vp8Only, offer(opusAudio, vp9Recv), nil},
+		{"rejected sections are not checked", vp8Only, offer(opusAudio, av1Closed), nil},
+		{"audio-only room refuses video", audioOnly, offer(opusAudio, vp8Video), ErrVideoDisabled},
+		{"audio-only room lets video be received", audioOnly, offer(opusAudio, vp9Recv), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.CheckOffer(tt.sdp)
+			if tt.want == nil && err != nil {
+				t.Fatalf("CheckOffer() = %v, want nil", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("CheckOffer() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckOfferInvalidSDP(t *testing.T) {
+	if err := DefaultPolicy().CheckOffer("not an sdp"); err == nil {
+		t.Fatal("CheckOffer() = nil for an invalid SDP")
+	}
+}
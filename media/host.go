@@ -0,0 +1,39 @@
+package media
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HostToken is what the application gives a user it lets host roomID: the
+// hex HMAC-SHA256 of "roomID:userID" with the server's host token secret.
+func HostToken(secret, roomID, userID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(roomID + ":" + userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidHostToken checks token against the one HostToken gives.
+func ValidHostToken(secret, roomID, userID, token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(HostToken(secret, roomID, userID)))
+}
+
+// VerifyHost tells whether userID, joining room with role, is a host. The
+// role alone proves nothing: the user also needs to be listed in the room's
+// settings, or with a secret to hold a host token, and without one to have
+// created the room as a host.
+func VerifyHost(room *Room, userID, role, secret, token string) bool {
+	if !IsHostRole(role) {
+		return false
+	}
+	if secret != "" && ValidHostToken(secret, room.ID, userID, token) {
+		return true
+	}
+	if secret == "" && room.Creator != "" && room.Creator == userID {
+		return true
+	}
+	var listed bool
+	room.Do(func(map[string]*Client) { listed = room.Settings.Lists(userID) })
+	return listed
+}
@@ -0,0 +1,43 @@
+package media
+
+import "testing"
+
+func TestVerifyHost(t *testing.T) {
+	room, _, err := Admit("test-verify-host", "alice", Pass{}, Limits{}, func(r *Room) {
+		r.Creator = "alice"
+		r.Settings.Hosts = []string{"dave"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer room.Close("test over")
+	token := HostToken("secret", room.ID, "bob")
+	tests := []struct {
+		name   string
+		userID string
+		role   string
+		secret string
+		token  string
+		want   bool
+	}{
+		{"creator without a secret", "alice", RoleHost, "", "", true},
+		{"teacher creator", "alice", RoleTeacher, "", "", true},
+		{"creator joining as a student", "alice", "student", "", "", false},
+		{"claimed role without a secret", "bob", RoleHost, "", token, false},
+		{"valid token", "bob", RoleHost, "secret", token, true},
+		{"valid token for a student", "bob", "student", "secret", token, false},
+		{"token of another user", "carol", RoleHost, "secret", token, false},
+		{"token signed with another secret", "bob", RoleHost, "other", token, false},
+		{"creator without a token once a secret is set", "alice", RoleHost, "secret", "", false},
+		{"listed host", "dave", RoleHost, "", "", true},
+		{"listed host with a secret", "dave", RoleHost, "secret", "", true},
+		{"listed host joining as a student", "dave", "student", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyHost(room, tt.userID, tt.role, tt.secret, tt.token); got != tt.want {
+				t.Fatalf("VerifyHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
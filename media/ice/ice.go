@@ -0,0 +1,147 @@
+package ice
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"mediaserver/utils/logging"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var logger = logging.For("ice")
+
+// Config holds the ICE servers handed to clients and used by the server side
+// PeerConnections. When TURNSecret is set, TURN servers get time-limited
+// credentials in the TURN REST API format instead of a static password.
+type Config struct {
+	STUNURLs       []string
+	TURNURLs       []string
+	TURNUsername   string
+	TURNCredential string
+	TURNSecret     string
+	CredentialTTL  time.Duration
+	TURNServer     TURNServerConfig
+	Network        NetworkConfig
+}
+
+func DefaultConfig() Config {
+	return Config{
+		STUNURLs:      []string{"stun:stun.l.google.com:19302"},
+		CredentialTTL: 12 * time.Hour,
+		TURNServer:    DefaultTURNServerConfig(),
+		Network:       DefaultNetworkConfig(),
+	}
+}
+
+// LoadConfig reads the ICE settings from configuration keys, get returns ""
+// for unset keys.
+func LoadConfig(get func(key string) string) (Config, error) {
+	c := DefaultConfig()
+	if v := get("ICE_STUN_URLS"); v != "" {
+		c.STUNURLs = splitList(v)
+	}
+	c.TURNURLs = splitList(get("ICE_TURN_URLS"))
+	c.TURNUsername = get("ICE_TURN_USERNAME")
+	c.TURNCredential = get("ICE_TURN_CREDENTIAL")
+	c.TURNSecret = get("TURN_SECRET")
+	if v := get("TURN_CREDENTIAL_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("TURN_CREDENTIAL_TTL: %w", err)
+		}
+		c.CredentialTTL = ttl
+	}
+
+	turnServer, err := loadTURNServerConfig(get)
+	if err != nil {
+		return c, err
+	}
+	c.TURNServer = turnServer
+
+	network, err := loadNetworkConfig(get)
+	if err != nil {
+		return c, err
+	}
+	c.Network = network
+	// advertise the embedded relay when no external TURN server is configured
+	if c.TURNServer.Enabled && len(c.TURNURLs) == 0 {
+		c.TURNURLs = c.TURNServer.URLs()
+	}
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	if len(c.TURNURLs) > 0 && c.TURNSecret == "" && (c.TURNUsername == "" || c.TURNCredential == "") {
+		return fmt.Errorf("ice: TURN servers need either TURN_SECRET or ICE_TURN_USERNAME and ICE_TURN_CREDENTIAL")
+	}
+	if c.TURNSecret != "" && c.CredentialTTL <= 0 {
+		return fmt.Errorf("ice: TURN credential TTL must be positive")
+	}
+	if c.TURNServer.Enabled && c.TURNSecret == "" {
+		return fmt.Errorf("ice: the embedded TURN server requires TURN_SECRET")
+	}
+	if err := c.TURNServer.Validate(); err != nil {
+		return err
+	}
+	return c.Network.Validate()
+}
+
+// ServersFor returns the ICE servers for one client, with fresh TURN
+// credentials bound to userID when a shared secret is configured.
+func (c Config) ServersFor(userID string) []webrtc.ICEServer {
+	var servers []webrtc.ICEServer
+	if len(c.STUNURLs) > 0 {
+		servers = append(servers, webrtc.ICEServer{URLs: c.STUNURLs})
+	}
+	if len(c.TURNURLs) == 0 {
+		return servers
+	}
+
+	username, credential := c.TURNUsername, c.TURNCredential
+	if c.TURNSecret != "" {
+		username, credential = RESTCredentials(c.TURNSecret, userID, c.CredentialTTL)
+	}
+	return append(servers, webrtc.ICEServer{
+		URLs:       c.TURNURLs,
+		Username:   username,
+		Credential: credential,
+	})
+}
+
+// RESTCredentials builds "<expiry>:<userID>" and its base64 HMAC-SHA1, the
+// format understood by coturn's use-auth-secret and by our embedded server.
+func RESTCredentials(secret, userID string, ttl time.Duration) (string, string) {
+	username := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + ":" + userID
+	return username, restPassword(secret, username)
+}
+
+func restPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// restExpiry returns the expiry encoded in a REST username.
+func restExpiry(username string) (time.Time, bool) {
+	expiry, _, _ := strings.Cut(username, ":")
+	t, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(t, 0), true
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
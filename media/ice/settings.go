@@ -0,0 +1,151 @@
+package ice
+
+import (
+	"fmt"
+	"net"
+
+	pionice "github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// NetworkConfig controls how server side PeerConnections gather candidates.
+// With UDPMuxPort set every PeerConnection shares a single UDP port, so only
+// that port (and TCPMuxPort for ICE-TCP) has to be opened on the firewall.
+type NetworkConfig struct {
+	UDPMuxPort        int
+	TCPMuxPort        int
+	NAT1To1IPs        []string
+	NAT1To1Type       webrtc.ICECandidateType
+	Interfaces        []string
+	EphemeralPortMin  uint16
+	EphemeralPortMax  uint16
+	TCPReadBufferSize int
+}
+
+func DefaultNetworkConfig() NetworkConfig {
+	return NetworkConfig{
+		NAT1To1Type:       webrtc.ICECandidateTypeHost,
+		TCPReadBufferSize: 8,
+	}
+}
+
+func loadNetworkConfig(get func(string) string) (NetworkConfig, error) {
+	c := DefaultNetworkConfig()
+	var err error
+	if c.UDPMuxPort, err = getInt(get, "ICE_UDP_MUX_PORT", c.UDPMuxPort); err != nil {
+		return c, err
+	}
+	if c.TCPMuxPort, err = getInt(get, "ICE_TCP_MUX_PORT", c.TCPMuxPort); err != nil {
+		return c, err
+	}
+	c.NAT1To1IPs = splitList(get("ICE_NAT_1TO1_IPS"))
+	if v := get("ICE_NAT_1TO1_CANDIDATE_TYPE"); v != "" {
+		if c.NAT1To1Type, err = webrtc.NewICECandidateType(v); err != nil {
+			return c, fmt.Errorf("ICE_NAT_1TO1_CANDIDATE_TYPE: %w", err)
+		}
+	}
+	c.Interfaces = splitList(get("ICE_INTERFACES"))
+
+	// 0 leaves the range to the operating system
+	minPort, err := getPort(get, "ICE_PORT_MIN", 0, true)
+	if err != nil {
+		return c, err
+	}
+	maxPort, err := getPort(get, "ICE_PORT_MAX", 0, true)
+	if err != nil {
+		return c, err
+	}
+	c.EphemeralPortMin, c.EphemeralPortMax = uint16(minPort), uint16(maxPort)
+	return c, nil
+}
+
+func (c NetworkConfig) Validate() error {
+	if c.UDPMuxPort < 0 || c.UDPMuxPort > 65535 || c.TCPMuxPort < 0 || c.TCPMuxPort > 65535 {
+		return fmt.Errorf("ice: mux ports must be between 0 and 65535")
+	}
+	if (c.EphemeralPortMin == 0) != (c.EphemeralPortMax == 0) || c.EphemeralPortMin > c.EphemeralPortMax {
+		return fmt.Errorf("ice: invalid ephemeral port range %d-%d", c.EphemeralPortMin, c.EphemeralPortMax)
+	}
+	for _, ip := range c.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("ice: NAT 1:1 address %q is not a valid IP", ip)
+		}
+	}
+	if c.NAT1To1Type != webrtc.ICECandidateTypeHost && c.NAT1To1Type != webrtc.ICECandidateTypeSrflx {
+		return fmt.Errorf("ice: NAT 1:1 candidate type must be host or srflx")
+	}
+	return nil
+}
+
+func (c NetworkConfig) interfaceFilter() func(string) bool {
+	if len(c.Interfaces) == 0 {
+		return nil
+	}
+	return func(name string) bool {
+		for _, allowed := range c.Interfaces {
+			if allowed == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// NewSettingEngine opens the shared muxes and returns a SettingEngine meant to
+// be reused by every API. The returned func closes the muxes.
+func NewSettingEngine(c NetworkConfig) (webrtc.SettingEngine, func(), error) {
+	settingEngine := webrtc.SettingEngine{}
+	var closers []func() error
+	closeAll := func() {
+		for _, closer := range closers {
+			_ = closer()
+		}
+	}
+
+	filter := c.interfaceFilter()
+	if filter != nil {
+		settingEngine.SetInterfaceFilter(filter)
+	}
+	if c.EphemeralPortMin != 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(c.EphemeralPortMin, c.EphemeralPortMax); err != nil {
+			return settingEngine, closeAll, err
+		}
+	}
+	if len(c.NAT1To1IPs) > 0 {
+		settingEngine.SetNAT1To1IPs(c.NAT1To1IPs, c.NAT1To1Type)
+	}
+
+	if c.UDPMuxPort != 0 {
+		var opts []pionice.UDPMuxFromPortOption
+		if filter != nil {
+			opts = append(opts, pionice.UDPMuxFromPortWithInterfaceFilter(filter))
+		}
+		udpMux, err := pionice.NewMultiUDPMuxFromPort(c.UDPMuxPort, opts...)
+		if err != nil {
+			return settingEngine, closeAll, fmt.Errorf("ice: UDP mux on port %d: %w", c.UDPMuxPort, err)
+		}
+		closers = append(closers, udpMux.Close)
+		settingEngine.SetICEUDPMux(udpMux)
+		logger.Info("UDP mux listening", "port", c.UDPMuxPort)
+	}
+
+	if c.TCPMuxPort != 0 {
+		tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: c.TCPMuxPort})
+		if err != nil {
+			closeAll()
+			return settingEngine, func() {}, fmt.Errorf("ice: TCP mux on port %d: %w", c.TCPMuxPort, err)
+		}
+		tcpMux := webrtc.NewICETCPMux(nil, tcpListener, c.TCPReadBufferSize)
+		closers = append(closers, tcpMux.Close)
+		settingEngine.SetICETCPMux(tcpMux)
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4,
+			webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4,
+			webrtc.NetworkTypeTCP6,
+		})
+		logger.Info("TCP mux listening", "port", c.TCPMuxPort)
+	}
+
+	return settingEngine, closeAll, nil
+}
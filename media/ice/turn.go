@@ -0,0 +1,187 @@
+package ice
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+type TURNServerConfig struct {
+	Enabled      bool
+	Realm        string
+	PublicIP     string
+	ListenIP     string
+	UDPPort      int
+	TCPPort      int
+	RelayMinPort uint16
+	RelayMaxPort uint16
+}
+
+func DefaultTURNServerConfig() TURNServerConfig {
+	return TURNServerConfig{
+		Realm:        "mediaserver",
+		ListenIP:     "0.0.0.0",
+		UDPPort:      3478,
+		TCPPort:      3478,
+		RelayMinPort: 49160,
+		RelayMaxPort: 49200,
+	}
+}
+
+func loadTURNServerConfig(get func(string) string) (TURNServerConfig, error) {
+	c := DefaultTURNServerConfig()
+	if v := get("TURN_ENABLED"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("TURN_ENABLED: %w", err)
+		}
+		c.Enabled = enabled
+	}
+	if v := get("TURN_REALM"); v != "" {
+		c.Realm = v
+	}
+	c.PublicIP = get("TURN_PUBLIC_IP")
+	if v := get("TURN_LISTEN_IP"); v != "" {
+		c.ListenIP = v
+	}
+
+	var err error
+	// 0 turns the UDP or the TCP listener off
+	if c.UDPPort, err = getPort(get, "TURN_UDP_PORT", c.UDPPort, true); err != nil {
+		return c, err
+	}
+	if c.TCPPort, err = getPort(get, "TURN_TCP_PORT", c.TCPPort, true); err != nil {
+		return c, err
+	}
+	minPort, err := getPort(get, "TURN_RELAY_MIN_PORT", int(c.RelayMinPort), false)
+	if err != nil {
+		return c, err
+	}
+	maxPort, err := getPort(get, "TURN_RELAY_MAX_PORT", int(c.RelayMaxPort), false)
+	if err != nil {
+		return c, err
+	}
+	c.RelayMinPort, c.RelayMaxPort = uint16(minPort), uint16(maxPort)
+	return c, nil
+}
+
+func (c TURNServerConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if net.ParseIP(c.PublicIP) == nil {
+		return fmt.Errorf("ice: TURN_PUBLIC_IP %q is not a valid IP", c.PublicIP)
+	}
+	if c.UDPPort == 0 && c.TCPPort == 0 {
+		return fmt.Errorf("ice: the embedded TURN server needs a UDP or TCP port")
+	}
+	if c.RelayMinPort == 0 || c.RelayMinPort > c.RelayMaxPort {
+		return fmt.Errorf("ice: invalid TURN relay port range %d-%d", c.RelayMinPort, c.RelayMaxPort)
+	}
+	return nil
+}
+
+// URLs returns the stun/turn URLs clients use to reach the embedded server.
+func (c TURNServerConfig) URLs() []string {
+	var urls []string
+	if c.UDPPort != 0 {
+		urls = append(urls, fmt.Sprintf("turn:%s:%d?transport=udp", c.PublicIP, c.UDPPort))
+	}
+	if c.TCPPort != 0 {
+		urls = append(urls, fmt.Sprintf("turn:%s:%d?transport=tcp", c.PublicIP, c.TCPPort))
+	}
+	return urls
+}
+
+// StartTURNServer runs a TURN/STUN server that accepts the REST credentials
+// produced by RESTCredentials with the same secret.
+func StartTURNServer(c TURNServerConfig, secret string) (*turn.Server, error) {
+	relayIP := net.ParseIP(c.PublicIP)
+	relayGenerator := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: relayIP,
+			Address:      c.ListenIP,
+			MinPort:      c.RelayMinPort,
+			MaxPort:      c.RelayMaxPort,
+		}
+	}
+
+	serverConfig := turn.ServerConfig{
+		Realm:       c.Realm,
+		AuthHandler: restAuthHandler(secret),
+	}
+	if c.UDPPort != 0 {
+		udpConn, err := net.ListenPacket("udp4", net.JoinHostPort(c.ListenIP, strconv.Itoa(c.UDPPort)))
+		if err != nil {
+			return nil, err
+		}
+		serverConfig.PacketConnConfigs = append(serverConfig.PacketConnConfigs, turn.PacketConnConfig{
+			PacketConn:            udpConn,
+			RelayAddressGenerator: relayGenerator(),
+		})
+	}
+	if c.TCPPort != 0 {
+		tcpListener, err := net.Listen("tcp4", net.JoinHostPort(c.ListenIP, strconv.Itoa(c.TCPPort)))
+		if err != nil {
+			for _, pc := range serverConfig.PacketConnConfigs {
+				pc.PacketConn.Close()
+			}
+			return nil, err
+		}
+		serverConfig.ListenerConfigs = append(serverConfig.ListenerConfigs, turn.ListenerConfig{
+			Listener:              tcpListener,
+			RelayAddressGenerator: relayGenerator(),
+		})
+	}
+
+	server, err := turn.NewServer(serverConfig)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("TURN server listening", "udpPort", c.UDPPort, "tcpPort", c.TCPPort,
+		"relayIp", c.PublicIP, "relayMinPort", c.RelayMinPort, "relayMaxPort", c.RelayMaxPort)
+	return server, nil
+}
+
+func restAuthHandler(secret string) turn.AuthHandler {
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		expiry, ok := restExpiry(username)
+		if !ok || time.Now().After(expiry) {
+			logger.Warn("TURN credentials rejected", "username", username, "remoteAddr", srcAddr.String())
+			return nil, false
+		}
+		return turn.GenerateAuthKey(username, realm, restPassword(secret, username)), true
+	}
+}
+
+func getInt(get func(string) string, key string, fallback int) (int, error) {
+	v := get(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+// getPort is getInt for a port number, checked before it is narrowed to a
+// uint16; zero tells whether 0 is allowed.
+func getPort(get func(string) string, key string, fallback int, zero bool) (int, error) {
+	port, err := getInt(get, key, fallback)
+	if err != nil {
+		return 0, err
+	}
+	min := 1
+	if zero {
+		min = 0
+	}
+	if port < min || port > 65535 {
+		return 0, fmt.Errorf("%s: port %d is not between %d and 65535", key, port, min)
+	}
+	return port, nil
+}
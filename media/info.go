@@ -0,0 +1,151 @@
+package media
+
+import (
+	"mediaserver/media/quality"
+	"mediaserver/media/share"
+	"mediaserver/metrics"
+	"sort"
+)
+
+type ClientInfo struct {
+	UserID          string          `json:"userId"`
+	Role            string          `json:"role"`
+	Host            bool            `json:"host"`
+	CamOn           bool            `json:"camState"`
+	MicOn           bool            `json:"micState"`
+	AudioMode       string          `json:"audioMode"`
+	PublishedTracks []Track         `json:"publishedTracks"`
+	SubscribedCount int             `json:"subscribedTracks"`
+	PeerState       string          `json:"peerState"`
+	ICEState        string          `json:"iceState"`
+	SignalingState  string          `json:"signalingState"`
+	SendQueue       int             `json:"sendQueue"`
+	Quality         *quality.Report `json:"quality,omitempty"`
+}
+
+type RoomInfo struct {
+	ID           string         `json:"id"`
+	Participants int            `json:"participants"`
+	Shares       []share.Share  `json:"shares,omitempty"`
+	Lobby        []Waiting      `json:"lobby,omitempty"`
+	Settings     SettingsInfo   `json:"settings"`
+	ParentID     string         `json:"parentId,omitempty"`
+	Breakouts    []BreakoutInfo `json:"breakouts,omitempty"`
+	Clients      []ClientInfo   `json:"clients,omitempty"`
+}
+
+// Info describes the client and the tracks it publishes in tracks; it reads
+// room-owned fields, so it runs on the room's loop.
+func (c *Client) Info(tracks *Tracks) ClientInfo {
+	info := ClientInfo{
+		UserID:          c.UserID,
+		Role:            c.Role,
+		Host:            c.Host,
+		CamOn:           c.IsCamOn,
+		MicOn:           c.IsMicOn,
+		AudioMode:       c.AudioMode,
+		PublishedTracks: []Track{},
+		PeerState:       "none",
+		ICEState:        "none",
+		SignalingState:  "none",
+		SendQueue:       c.Outbox.Len(),
+	}
+	for _, t := range tracks.Of(c.UserID) {
+		published := *t
+		published.Layers = append([]string(nil), t.Layers...)
+		info.PublishedTracks = append(info.PublishedTracks, published)
+	}
+	if c.Quality != nil {
+		if report, ok := c.Quality.Last(); ok {
+			info.Quality = &report
+		}
+	}
+	if pc := c.PeerConn; pc != nil {
+		info.PeerState = pc.ConnectionState().String()
+		info.ICEState = pc.ICEConnectionState().String()
+		info.SignalingState = pc.SignalingState().String()
+		for _, sender := range pc.GetSenders() {
+			if sender.Track() != nil {
+				info.SubscribedCount++
+			}
+		}
+	}
+	return info
+}
+
+// Info describes the room, with its participants when withClients is set.
+func (r *Room) Info(withClients bool) RoomInfo {
+	info := RoomInfo{ID: r.ID}
+	r.Do(func(clients map[string]*Client) {
+		info.Participants = len(clients)
+		info.Shares = r.Shares.Active()
+		info.Lobby = r.Lobby.Waiting()
+		info.Settings = r.Settings.Info()
+		if r.Parent != nil {
+			info.ParentID = r.Parent.ID
+		}
+		if r.Breakouts != nil {
+			info.Breakouts = r.Breakouts.Info()
+		}
+		if !withClients {
+			return
+		}
+		info.Clients = []ClientInfo{}
+		for _, c := range clients {
+			info.Clients = append(info.Clients, c.Info(r.Tracks))
+		}
+	})
+	sort.Slice(info.Clients, func(i, j int) bool { return info.Clients[i].UserID < info.Clients[j].UserID })
+	return info
+}
+
+func ListRooms() []*Room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	list := make([]*Room, 0, len(rooms))
+	for _, room := range rooms {
+		list = append(list, room)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func GetRoom(roomID string) (*Room, bool) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	room, ok := rooms[roomID]
+	return room, ok
+}
+
+// Stats counts rooms, participants, peer connection states and tracks for the
+// metrics endpoint.
+func Stats() metrics.Snapshot {
+	s := metrics.Snapshot{
+		PeerConnections:  map[string]int{},
+		PublishedTracks:  map[string]int{},
+		SubscribedTracks: map[string]int{},
+	}
+	for _, room := range ListRooms() {
+		s.Rooms++
+		room.Do(func(clients map[string]*Client) { countClients(&s, clients, room.Tracks) })
+	}
+	return s
+}
+
+func countClients(s *metrics.Snapshot, clients map[string]*Client, tracks *Tracks) {
+	for _, t := range tracks.All() {
+		s.PublishedTracks[t.Type()]++
+	}
+	for _, c := range clients {
+		s.Participants++
+		if c.PeerConn == nil {
+			continue
+		}
+		s.PeerConnections[c.PeerConn.ConnectionState().String()]++
+		for _, sender := range c.PeerConn.GetSenders() {
+			if track := sender.Track(); track != nil {
+				s.SubscribedTracks[track.Kind().String()]++
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package keyframe
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// IsKeyframe tells whether an RTP payload starts or carries a keyframe, from
+// the payload descriptor of each codec the server accepts.
+func IsKeyframe(mimeType string, payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return vp8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		// start of a frame (B) that is not inter-picture predicted (P)
+		return payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return h264Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		// N: first packet of a coded video sequence
+		return payload[0]&0x08 != 0
+	}
+	return false
+}
+
+// RFC 7741: the descriptor, then the VP8 header whose P bit is 0 on keyframes.
+func vp8Keyframe(payload []byte) bool {
+	start, pid := payload[0]&0x10 != 0, payload[0]&0x07
+	if !start || pid != 0 {
+		return false
+	}
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		i++
+		if ext&0x80 != 0 { // picture ID, 7 or 15 bits
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 { // TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 { // TID and KEYIDX
+			i++
+		}
+	}
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+// RFC 6184: an IDR slice or a sequence parameter set, alone, aggregated in a
+// STAP-A or at the start of a FU-A.
+func h264Keyframe(payload []byte) bool {
+	isKey := func(nalType byte) bool { return nalType == 5 || nalType == 7 }
+	switch nalType := payload[0] & 0x1f; nalType {
+	case 24: // STAP-A
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if isKey(payload[i+2] & 0x1f) {
+				return true
+			}
+			i += 2 + size
+		}
+		return false
+	case 28: // FU-A
+		return len(payload) > 1 && payload[1]&0x80 != 0 && isKey(payload[1]&0x1f)
+	default:
+		return isKey(nalType)
+	}
+}
@@ -0,0 +1,57 @@
+package keyframe
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{"empty payload", webrtc.MimeTypeVP8, nil, false},
+		{"unknown codec", webrtc.MimeTypeOpus, []byte{0x10, 0x00}, false},
+
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 mime type in lower case", "video/vp8", []byte{0x10, 0x00}, true},
+		{"vp8 not the start of a partition", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 later partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00}, false},
+		{"vp8 7 bit picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x05, 0x00}, true},
+		{"vp8 15 bit picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x05, 0x00}, true},
+		{"vp8 15 bit picture id interframe", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x05, 0x01}, false},
+		{"vp8 all extensions", webrtc.MimeTypeVP8, []byte{0x90, 0xf0, 0x05, 0x01, 0x20, 0x00}, true},
+		{"vp8 truncated extension", webrtc.MimeTypeVP8, []byte{0x90}, false},
+		{"vp8 truncated picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80}, false},
+		{"vp8 no header after the descriptor", webrtc.MimeTypeVP8, []byte{0x90, 0x40, 0x05}, false},
+
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x08}, true},
+		{"vp9 predicted frame", webrtc.MimeTypeVP9, []byte{0x48}, false},
+		{"vp9 not the start of a frame", webrtc.MimeTypeVP9, []byte{0x00}, false},
+
+		{"h264 idr slice", webrtc.MimeTypeH264, []byte{0x65}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67}, true},
+		{"h264 non-idr slice", webrtc.MimeTypeH264, []byte{0x41}, false},
+		{"h264 stap-a with sps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x67}, true},
+		{"h264 stap-a with idr second", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x41, 0x00, 0x01, 0x65}, true},
+		{"h264 stap-a without key", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x41, 0x00, 0x01, 0x41}, false},
+		{"h264 fu-a start of idr", webrtc.MimeTypeH264, []byte{0x7c, 0x85}, true},
+		{"h264 fu-a middle of idr", webrtc.MimeTypeH264, []byte{0x7c, 0x05}, false},
+		{"h264 fu-a start of non-idr", webrtc.MimeTypeH264, []byte{0x7c, 0x81}, false},
+		{"h264 truncated fu-a", webrtc.MimeTypeH264, []byte{0x7c}, false},
+
+		{"av1 new sequence", webrtc.MimeTypeAV1, []byte{0x08}, true},
+		{"av1 within a sequence", webrtc.MimeTypeAV1, []byte{0x10}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsKeyframe(tt.mimeType, tt.payload); got != tt.want {
+				t.Fatalf("IsKeyframe(%s, % x) = %v, want %v", tt.mimeType, tt.payload, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Package keyframe asks publishers for keyframes on behalf of the viewers of
+// their video, without flooding the publisher's uplink with requests.
+package keyframe
+
+import (
+	"fmt"
+	"mediaserver/metrics"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+type Config struct {
+	// shortest time between two requests sent for the same track
+	MinInterval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{MinInterval: time.Second}
+}
+
+// LoadConfig reads the keyframe settings from configuration keys, get returns
+// "" for unset keys.
+func LoadConfig(get func(key string) string) (Config, error) {
+	c := DefaultConfig()
+	if v := get("KEYFRAME_MIN_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("KEYFRAME_MIN_INTERVAL: %w", err)
+		}
+		c.MinInterval = interval
+	}
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	if c.MinInterval < 0 || c.MinInterval > 10*time.Second {
+		return fmt.Errorf("keyframe: min interval must be between 0 and 10s")
+	}
+	return nil
+}
+
+// Manager handles the keyframe requests of one published video track.
+type Manager struct {
+	pc          *webrtc.PeerConnection
+	ssrc        uint32
+	mimeType    string
+	minInterval time.Duration
+
+	mu           sync.Mutex
+	lastRequest  time.Time
+	lastKeyframe time.Time
+	// a request held back by the rate limit, full when one of the merged
+	// requests asked for a FIR
+	deferred     *time.Timer
+	deferredFull bool
+	firSeq       uint8
+	closed       bool
+}
+
+// NewManager manages the keyframes of track, received on the publisher's pc.
+func NewManager(c Config, pc *webrtc.PeerConnection, track *webrtc.TrackRemote) *Manager {
+	return &Manager{
+		pc:          pc,
+		ssrc:        uint32(track.SSRC()),
+		mimeType:    track.Codec().MimeType,
+		minInterval: c.MinInterval,
+	}
+}
+
+// Request asks the publisher for a keyframe, with a FIR when full is set and
+// a PLI otherwise. Requests within the minimum interval of the last one are
+// merged into a single request sent when the interval ends, which is skipped
+// if a keyframe goes through in the meantime.
+func (m *Manager) Request(reason string, full bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	wait := m.minInterval - time.Since(m.lastRequest)
+	if wait <= 0 {
+		m.send(reason, full)
+		return
+	}
+	metrics.KeyframeRequests.WithLabelValues(reason, "merged").Inc()
+	m.deferredFull = m.deferredFull || full
+	if m.deferred == nil {
+		requested := time.Now()
+		m.deferred = time.AfterFunc(wait, func() { m.flush(reason, requested) })
+	}
+}
+
+func (m *Manager) flush(reason string, requested time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	full := m.deferredFull
+	m.deferred, m.deferredFull = nil, false
+	if m.closed || m.lastKeyframe.After(requested) {
+		return
+	}
+	m.send(reason, full)
+}
+
+// send writes the request; m.mu is held.
+func (m *Manager) send(reason string, full bool) {
+	m.lastRequest = time.Now()
+	var pkt rtcp.Packet = &rtcp.PictureLossIndication{MediaSSRC: m.ssrc}
+	if full {
+		m.firSeq++
+		pkt = &rtcp.FullIntraRequest{
+			MediaSSRC: m.ssrc,
+			FIR:       []rtcp.FIREntry{{SSRC: m.ssrc, SequenceNumber: m.firSeq}},
+		}
+	}
+	if err := m.pc.WriteRTCP([]rtcp.Packet{pkt}); err != nil {
+		metrics.KeyframeRequests.WithLabelValues(reason, "failed").Inc()
+		return
+	}
+	metrics.KeyframeRequests.WithLabelValues(reason, "sent").Inc()
+}
+
+// Observe looks at a packet forwarded from the publisher and remembers when
+// the last keyframe went through.
+func (m *Manager) Observe(pkt *rtp.Packet, at time.Time) {
+	if !IsKeyframe(m.mimeType, pkt.Payload) {
+		return
+	}
+	m.mu.Lock()
+	m.lastKeyframe = at
+	m.mu.Unlock()
+}
+
+// LastKeyframe is when the last keyframe was forwarded, zero before the first.
+func (m *Manager) LastKeyframe() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastKeyframe
+}
+
+// Reopen lets a closed manager send requests again, for a track forwarded
+// anew.
+func (m *Manager) Reopen() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = false
+}
+
+// Close drops a pending request once the track ended or stopped being
+// forwarded.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.deferred != nil {
+		m.deferred.Stop()
+		m.deferred = nil
+	}
+}
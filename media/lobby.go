@@ -0,0 +1,102 @@
+package media
+
+import (
+	"sort"
+	"time"
+)
+
+// Lobby holds the users waiting for a host to let them into a room. It
+// belongs to the room's loop: use it inside Room.Do.
+type Lobby struct {
+	// set by the host creating the room or with set-lobby, hosts never wait
+	Enabled bool
+	waiting map[string]*lobbyEntry
+	// users a host let in, who skip the lobby when they reconnect
+	admitted map[string]bool
+}
+
+type lobbyEntry struct {
+	client   *Client
+	since    time.Time
+	decision chan bool
+}
+
+// Waiting is a user in the lobby, as shown to hosts.
+type Waiting struct {
+	UserID string    `json:"userId"`
+	Role   string    `json:"role"`
+	Since  time.Time `json:"since"`
+}
+
+func newLobby() *Lobby {
+	return &Lobby{waiting: make(map[string]*lobbyEntry), admitted: make(map[string]bool)}
+}
+
+// Holds tells whether c has to wait for a host.
+func (l *Lobby) Holds(c *Client) bool {
+	return l.Enabled && !c.IsHost() && !l.admitted[c.UserID]
+}
+
+// Hold puts c in the lobby. The returned channel gets the host's decision,
+// true to admit; an older waiting connection of the same user is denied.
+func (l *Lobby) Hold(c *Client) <-chan bool {
+	if old, ok := l.waiting[c.UserID]; ok {
+		old.decision <- false
+	}
+	entry := &lobbyEntry{client: c, since: time.Now(), decision: make(chan bool, 1)}
+	l.waiting[c.UserID] = entry
+	return entry.decision
+}
+
+// Decide admits or denies userID and tells whether the user was waiting.
+func (l *Lobby) Decide(userID string, admit bool) bool {
+	entry, ok := l.waiting[userID]
+	if !ok {
+		return false
+	}
+	delete(l.waiting, userID)
+	if admit {
+		l.admitted[userID] = true
+	}
+	entry.decision <- admit
+	return true
+}
+
+// DecideAll admits or denies everyone waiting and returns who was.
+func (l *Lobby) DecideAll(admit bool) []string {
+	var decided []string
+	for _, w := range l.Waiting() {
+		l.Decide(w.UserID, admit)
+		decided = append(decided, w.UserID)
+	}
+	return decided
+}
+
+// Remove takes c out of the lobby when it leaves before a decision; it tells
+// whether c was still waiting.
+func (l *Lobby) Remove(c *Client) bool {
+	entry, ok := l.waiting[c.UserID]
+	if !ok || entry.client != c {
+		return false
+	}
+	delete(l.waiting, c.UserID)
+	return true
+}
+
+// Waiting returns the users waiting, longest waiting first.
+func (l *Lobby) Waiting() []Waiting {
+	waiting := make([]Waiting, 0, len(l.waiting))
+	for _, entry := range l.waiting {
+		waiting = append(waiting, Waiting{UserID: entry.client.UserID, Role: entry.client.Role, Since: entry.since})
+	}
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].Since.Before(waiting[j].Since) })
+	return waiting
+}
+
+func (l *Lobby) clients() []*Client {
+	clients := make([]*Client, 0, len(l.waiting))
+	for _, entry := range l.waiting {
+		clients = append(clients, entry.client)
+	}
+	return clients
+}
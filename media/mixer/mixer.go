@@ -0,0 +1,255 @@
+// Package mixer mixes the voices of a room into one track per listener for
+// clients in the "mixed" audio mode. It needs libopus: build the server with
+// -tags opus, which links gopkg.in/hraban/opus.v2 through cgo and finds the
+// opus and opusfile libraries with pkg-config (libopus-dev and
+// libopusfile-dev on Debian). Without the tag Available is false and mixed
+// clients receive every audio track instead.
+package mixer
+
+import (
+	"errors"
+	"mediaserver/utils/logging"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	SampleRate    = 48000
+	Channels      = 1
+	FrameDuration = 20 * time.Millisecond
+	FrameSize     = SampleRate / 1000 * int(FrameDuration/time.Millisecond)
+
+	// keep at most 100ms of audio per source so latency cannot build up
+	maxBufferedSamples = FrameSize * 5
+	maxOpusPacket      = 4000
+)
+
+var logger = logging.For("mixer")
+
+var ErrUnavailable = errors.New("mixer: opus codec not available, build with -tags opus")
+
+type decoder interface {
+	Decode(data []byte, pcm []int16) (int, error)
+}
+
+type encoder interface {
+	Encode(pcm []int16, data []byte) (int, error)
+}
+
+type source struct {
+	dec decoder
+	pcm []int16
+}
+
+type sink struct {
+	track *webrtc.TrackLocalStaticSample
+	enc   encoder
+	buf   []byte
+}
+
+// Mixer decodes the Opus audio tracks of a room and sends every sink a single
+// mixed track that leaves out the listener's own voice.
+type Mixer struct {
+	mu      sync.Mutex
+	sources map[string]*source
+	sinks   map[string]*sink
+	quit    chan struct{}
+
+	// the Opus codec, replaced in tests
+	newDecoder func() (decoder, error)
+	newEncoder func() (encoder, error)
+}
+
+func New() *Mixer {
+	return &Mixer{
+		sources:    make(map[string]*source),
+		sinks:      make(map[string]*sink),
+		newDecoder: newDecoder,
+		newEncoder: newEncoder,
+	}
+}
+
+func Available() bool {
+	return opusEnabled
+}
+
+func (m *Mixer) AddSink(userID string) (*webrtc.TrackLocalStaticSample, error) {
+	enc, err := m.newEncoder()
+	if err != nil {
+		return nil, err
+	}
+	// RFC 7587 has Opus always signalled as opus/48000/2 whatever the
+	// encoder sends, here mono, which every Opus decoder plays
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: SampleRate, Channels: 2},
+		"mixed-audio",
+		"mixed_"+userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sinks[userID] = &sink{track: track, enc: enc, buf: make([]byte, maxOpusPacket)}
+	if m.quit == nil {
+		m.quit = make(chan struct{})
+		go m.run(m.quit)
+	}
+	return track, nil
+}
+
+func (m *Mixer) RemoveSink(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sinks, userID)
+	if len(m.sinks) == 0 && m.quit != nil {
+		close(m.quit)
+		m.quit = nil
+		// nobody is listening, drop whatever was decoded
+		for _, src := range m.sources {
+			src.pcm = src.pcm[:0]
+		}
+	}
+}
+
+func (m *Mixer) HasSinks() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sinks) > 0
+}
+
+// Push takes the Opus payload of one RTP packet from userID's audio track.
+func (m *Mixer) Push(userID string, payload []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sinks) == 0 || len(payload) == 0 {
+		return
+	}
+	src, ok := m.sources[userID]
+	if !ok {
+		dec, err := m.newDecoder()
+		if err != nil {
+			return
+		}
+		src = &source{dec: dec}
+		m.sources[userID] = src
+	}
+
+	var frame [SampleRate / 1000 * 120 * Channels]int16
+	n, err := src.dec.Decode(payload, frame[:])
+	if err != nil {
+		logger.Debug("decode failed", "userId", userID, "error", err)
+		return
+	}
+	src.pcm = append(src.pcm, frame[:n*Channels]...)
+	if over := len(src.pcm) - maxBufferedSamples; over > 0 {
+		src.pcm = append(src.pcm[:0], src.pcm[over:]...)
+	}
+}
+
+func (m *Mixer) RemoveSource(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sources, userID)
+}
+
+func (m *Mixer) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.quit != nil {
+		close(m.quit)
+		m.quit = nil
+	}
+	m.sinks = make(map[string]*sink)
+	m.sources = make(map[string]*source)
+}
+
+func (m *Mixer) run(quit chan struct{}) {
+	ticker := time.NewTicker(FrameDuration)
+	defer ticker.Stop()
+
+	f := newFrame()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		m.mix(f)
+		m.mu.Unlock()
+	}
+}
+
+// frame holds the buffers of one mixing step, reused from one to the next.
+type frame struct {
+	total  []int32
+	voices map[string][]int16
+	out    []int16
+}
+
+func newFrame() *frame {
+	return &frame{
+		total:  make([]int32, FrameSize*Channels),
+		voices: make(map[string][]int16),
+		out:    make([]int16, FrameSize*Channels),
+	}
+}
+
+// mix takes a frame from every source with one buffered and sends each sink
+// the sum of them without its own voice. m.mu is held.
+func (m *Mixer) mix(f *frame) {
+	total := f.total
+	for i := range total {
+		total[i] = 0
+	}
+	clear(f.voices)
+	for userID, src := range m.sources {
+		if len(src.pcm) < len(total) {
+			continue
+		}
+		voice := make([]int16, len(total))
+		copy(voice, src.pcm)
+		src.pcm = append(src.pcm[:0], src.pcm[len(total):]...)
+		f.voices[userID] = voice
+		for i, s := range voice {
+			total[i] += int32(s)
+		}
+	}
+
+	out := f.out
+	for userID, snk := range m.sinks {
+		own := f.voices[userID]
+		for i := range out {
+			v := total[i]
+			if own != nil {
+				v -= int32(own[i])
+			}
+			out[i] = clip(v)
+		}
+		n, err := snk.enc.Encode(out, snk.buf)
+		if err != nil {
+			logger.Warn("encode failed", "userId", userID, "error", err)
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, snk.buf[:n])
+		if err := snk.track.WriteSample(media.Sample{Data: data, Duration: FrameDuration}); err != nil {
+			logger.Warn("write sample failed", "userId", userID, "error", err)
+		}
+	}
+}
+
+func clip(v int32) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
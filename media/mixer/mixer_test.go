@@ -0,0 +1,176 @@
+package mixer
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// fakeDecoder turns a payload holding one little-endian int16 into a frame of
+// that sample.
+type fakeDecoder struct{}
+
+func (fakeDecoder) Decode(data []byte, pcm []int16) (int, error) {
+	v := int16(binary.LittleEndian.Uint16(data))
+	for i := 0; i < FrameSize*Channels; i++ {
+		pcm[i] = v
+	}
+	return FrameSize, nil
+}
+
+// fakeEncoder keeps the last frame it was given.
+type fakeEncoder struct {
+	last []int16
+}
+
+func (e *fakeEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	e.last = append(e.last[:0], pcm...)
+	data[0] = 0
+	return 1, nil
+}
+
+func payload(v int16) []byte {
+	return binary.LittleEndian.AppendUint16(nil, uint16(v))
+}
+
+// newTestMixer returns a mixer with fake codecs and a sink per listener whose
+// encoder records what the listener hears. Nothing runs the mixing loop, the
+// tests call mix themselves.
+func newTestMixer(t *testing.T, listeners ...string) (*Mixer, map[string]*fakeEncoder) {
+	t.Helper()
+	m := New()
+	m.newDecoder = func() (decoder, error) { return fakeDecoder{}, nil }
+	encoders := map[string]*fakeEncoder{}
+	for _, userID := range listeners {
+		track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "mixed-audio", "mixed_"+userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoders[userID] = &fakeEncoder{}
+		m.sinks[userID] = &sink{track: track, enc: encoders[userID], buf: make([]byte, maxOpusPacket)}
+	}
+	return m, encoders
+}
+
+func TestMix(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners []string
+		voices    map[string]int16
+		// the sample each listener hears
+		want map[string]int16
+	}{
+		{
+			name:      "own voice left out",
+			listeners: []string{"alice", "bob", "carol"},
+			voices:    map[string]int16{"alice": 100, "bob": 200, "carol": -50},
+			want:      map[string]int16{"alice": 150, "bob": 50, "carol": 300},
+		},
+		{
+			name:      "listener who does not speak hears everyone",
+			listeners: []string{"alice", "dave"},
+			voices:    map[string]int16{"alice": 100, "bob": 200},
+			want:      map[string]int16{"alice": 200, "dave": 300},
+		},
+		{
+			name:      "lone speaker hears silence",
+			listeners: []string{"alice"},
+			voices:    map[string]int16{"alice": 1000},
+			want:      map[string]int16{"alice": 0},
+		},
+		{
+			name:      "clipped above",
+			listeners: []string{"dave"},
+			voices:    map[string]int16{"alice": 30000, "bob": 30000},
+			want:      map[string]int16{"dave": 32767},
+		},
+		{
+			name:      "clipped below",
+			listeners: []string{"dave"},
+			voices:    map[string]int16{"alice": -30000, "bob": -30000},
+			want:      map[string]int16{"dave": -32768},
+		},
+		{
+			name:      "own voice taken out before clipping",
+			listeners: []string{"alice"},
+			voices:    map[string]int16{"alice": 30000, "bob": 30000, "carol": -20000},
+			want:      map[string]int16{"alice": 10000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, encoders := newTestMixer(t, tt.listeners...)
+			for userID, v := range tt.voices {
+				m.Push(userID, payload(v))
+			}
+			m.mix(newFrame())
+			for userID, want := range tt.want {
+				heard := encoders[userID].last
+				if len(heard) != FrameSize*Channels {
+					t.Fatalf("%s got %d samples, want %d", userID, len(heard), FrameSize*Channels)
+				}
+				for i, s := range heard {
+					if s != want {
+						t.Fatalf("%s heard %d at sample %d, want %d", userID, s, i, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMixWaitsForAFullFrame(t *testing.T) {
+	m, encoders := newTestMixer(t, "bob")
+	m.Push("alice", payload(100))
+	src := m.sources["alice"]
+	src.pcm = src.pcm[:FrameSize/2]
+	m.mix(newFrame())
+	for _, s := range encoders["bob"].last {
+		if s != 0 {
+			t.Fatalf("half a frame was mixed: %d", s)
+		}
+	}
+	if len(src.pcm) != FrameSize/2 {
+		t.Errorf("%d samples buffered, want the %d not mixed yet", len(src.pcm), FrameSize/2)
+	}
+}
+
+func TestPushBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		sinks   []string
+		pushes  int
+		payload []byte
+		want    int
+	}{
+		{"buffered", []string{"bob"}, 2, payload(1), 2 * FrameSize},
+		{"oldest dropped past the limit", []string{"bob"}, 8, payload(1), maxBufferedSamples},
+		{"nothing kept without listeners", nil, 2, payload(1), 0},
+		{"empty payload ignored", []string{"bob"}, 2, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestMixer(t, tt.sinks...)
+			for i := 0; i < tt.pushes; i++ {
+				m.Push("alice", tt.payload)
+			}
+			var got int
+			if src, ok := m.sources["alice"]; ok {
+				got = len(src.pcm)
+			}
+			if got != tt.want {
+				t.Errorf("%d samples buffered, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddSinkWithoutOpus(t *testing.T) {
+	if Available() {
+		t.Skip("built with opus")
+	}
+	if _, err := New().AddSink("alice"); err != ErrUnavailable {
+		t.Errorf("AddSink = %v, want ErrUnavailable", err)
+	}
+}
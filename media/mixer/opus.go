@@ -0,0 +1,20 @@
+//go:build opus
+
+package mixer
+
+import "gopkg.in/hraban/opus.v2"
+
+const opusEnabled = true
+
+func newDecoder() (decoder, error) {
+	return opus.NewDecoder(SampleRate, Channels)
+}
+
+func newEncoder() (encoder, error) {
+	enc, err := opus.NewEncoder(SampleRate, Channels, opus.AppVoIP)
+	if err != nil {
+		return nil, err
+	}
+	_ = enc.SetInBandFEC(true)
+	return enc, nil
+}
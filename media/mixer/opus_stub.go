@@ -0,0 +1,13 @@
+//go:build !opus
+
+package mixer
+
+const opusEnabled = false
+
+func newDecoder() (decoder, error) {
+	return nil, ErrUnavailable
+}
+
+func newEncoder() (encoder, error) {
+	return nil, ErrUnavailable
+}
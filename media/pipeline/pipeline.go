@@ -0,0 +1,194 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Config chooses the interceptors registered on every PeerConnection. Publish
+// options act on the RTP the server receives from a publisher, subscribe
+// options on the RTP it forwards to each viewer.
+type Config struct {
+	// ask the publisher to retransmit packets lost on the way to the server
+	PublishNACK bool
+	// send receiver reports to the publisher
+	PublishReports bool
+	// send transport-wide congestion control feedback to the publisher
+	PublishTWCC bool
+
+	// answer a viewer's NACKs from a per-subscriber cache of sent packets; the
+	// responder only sees the NACKs of senders whose RTCP is read
+	SubscribeNACK bool
+	// number of packets kept per subscribed stream, must be a power of two
+	SubscribeNACKCacheSize uint16
+	// send sender reports to viewers
+	SubscribeReports bool
+	// stamp forwarded packets with transport-wide sequence numbers
+	SubscribeTWCC bool
+
+	ReportInterval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PublishNACK:            true,
+		PublishReports:         true,
+		PublishTWCC:            true,
+		SubscribeNACK:          true,
+		SubscribeNACKCacheSize: 1024,
+		SubscribeReports:       true,
+		SubscribeTWCC:          false,
+		ReportInterval:         time.Second,
+	}
+}
+
+// LoadConfig reads the interceptor settings from configuration keys, get
+// returns "" for unset keys.
+func LoadConfig(get func(key string) string) (Config, error) {
+	c := DefaultConfig()
+	for _, b := range []struct {
+		key    string
+		target *bool
+	}{
+		{"PUBLISH_NACK", &c.PublishNACK},
+		{"PUBLISH_RTCP_REPORTS", &c.PublishReports},
+		{"PUBLISH_TWCC", &c.PublishTWCC},
+		{"SUBSCRIBE_NACK", &c.SubscribeNACK},
+		{"SUBSCRIBE_RTCP_REPORTS", &c.SubscribeReports},
+		{"SUBSCRIBE_TWCC", &c.SubscribeTWCC},
+	} {
+		if err := getBool(get, b.key, b.target); err != nil {
+			return c, err
+		}
+	}
+
+	if v := get("SUBSCRIBE_NACK_CACHE"); v != "" {
+		size, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return c, fmt.Errorf("SUBSCRIBE_NACK_CACHE: %w", err)
+		}
+		c.SubscribeNACKCacheSize = uint16(size)
+	}
+	if v := get("RTCP_REPORT_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("RTCP_REPORT_INTERVAL: %w", err)
+		}
+		c.ReportInterval = interval
+	}
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	size := c.SubscribeNACKCacheSize
+	if c.SubscribeNACK && (size == 0 || size&(size-1) != 0) {
+		return fmt.Errorf("pipeline: NACK cache size %d is not a power of two", size)
+	}
+	if (c.PublishReports || c.SubscribeReports) && c.ReportInterval <= 0 {
+		return fmt.Errorf("pipeline: report interval must be positive")
+	}
+	return nil
+}
+
+// Feedback returns the RTCP feedback the codec policy has to advertise for
+// these interceptors to be useful.
+func (c Config) Feedback() []string {
+	var feedback []string
+	if c.PublishNACK || c.SubscribeNACK {
+		feedback = append(feedback, "nack", "nack pli")
+	}
+	if c.PublishTWCC || c.SubscribeTWCC {
+		feedback = append(feedback, "transport-cc")
+	}
+	return feedback
+}
+
+// Registry builds the interceptors for one PeerConnection and registers the
+// header extensions they rely on in mediaEngine. extra interceptors are added
+// first, so they see RTP and RTCP as it is on the wire.
+func (c Config) Registry(mediaEngine *webrtc.MediaEngine, extra ...interceptor.Factory) (*interceptor.Registry, error) {
+	registry := &interceptor.Registry{}
+	for _, factory := range extra {
+		registry.Add(factory)
+	}
+
+	if c.PublishNACK {
+		generator, err := nack.NewGeneratorInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(generator)
+	}
+	if c.SubscribeNACK {
+		responder, err := nack.NewResponderInterceptor(nack.ResponderSize(c.SubscribeNACKCacheSize))
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(responder)
+	}
+
+	if c.PublishReports {
+		receiver, err := report.NewReceiverInterceptor(report.ReceiverInterval(c.ReportInterval))
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(receiver)
+	}
+	if c.SubscribeReports {
+		sender, err := report.NewSenderInterceptor(report.SenderInterval(c.ReportInterval))
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(sender)
+	}
+
+	// transport-wide sequence numbers cover the audio and the video of a peer
+	// connection alike
+	if c.PublishTWCC || c.SubscribeTWCC {
+		for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+			err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, kind)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.PublishTWCC {
+		generator, err := twcc.NewSenderInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(generator)
+	}
+	if c.SubscribeTWCC {
+		headerExtension, err := twcc.NewHeaderExtensionInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(headerExtension)
+	}
+
+	return registry, nil
+}
+
+// getBool sets *target from key when it is set, rejecting values
+// strconv.ParseBool does not read.
+func getBool(get func(string) string, key string, target *bool) error {
+	v := get(key)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*target = b
+	return nil
+}
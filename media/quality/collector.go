@@ -0,0 +1,226 @@
+package quality
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v3"
+)
+
+// TrackStats describes one RTP stream of a peer connection. Publish streams
+// go from the browser to the server, subscribe streams from the server to the
+// browser.
+type TrackStats struct {
+	TrackID   string `json:"trackId"`
+	Kind      string `json:"kind"`
+	Direction string `json:"direction"`
+	// bits per second over the last interval
+	Bitrate uint64 `json:"bitrate"`
+	// fraction of packets lost over the last interval for publish streams,
+	// as last reported by the browser for subscribe streams
+	PacketLoss float64 `json:"packetLoss"`
+	JitterMs   float64 `json:"jitterMs"`
+}
+
+type Report struct {
+	Timestamp time.Time `json:"timestamp"`
+	RTTMs     float64   `json:"rttMs"`
+	// candidate types of the selected pair: host, srflx, prflx or relay
+	LocalCandidate  string       `json:"localCandidate"`
+	RemoteCandidate string       `json:"remoteCandidate"`
+	Relayed         bool         `json:"relayed"`
+	PacketLoss      float64      `json:"packetLoss"`
+	JitterMs        float64      `json:"jitterMs"`
+	Tracks          []TrackStats `json:"tracks"`
+	Score           int          `json:"score"`
+	Quality         string       `json:"quality"`
+}
+
+type counters struct {
+	bytes    uint64
+	received uint64
+	lost     int64
+}
+
+// Collector turns the RTP stats of one peer connection into periodic
+// reports. The counters come from the interceptors returned by Interceptors,
+// the candidate pair from PeerConnection.GetStats.
+type Collector struct {
+	mu      sync.Mutex
+	getter  stats.Getter
+	jitters map[uint32]*jitter
+	prev    map[uint32]counters
+	prevAt  time.Time
+	last    *Report
+}
+
+func NewCollector() *Collector {
+	return &Collector{jitters: map[uint32]*jitter{}, prev: map[uint32]counters{}}
+}
+
+// Interceptors must be registered on the peer connection the collector
+// reports on, and on no other.
+func (c *Collector) Interceptors() ([]interceptor.Factory, error) {
+	statsFactory, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	statsFactory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.getter = getter
+	})
+	return []interceptor.Factory{statsFactory, jitterFactory{collector: c}}, nil
+}
+
+// Last returns the most recent report.
+func (c *Collector) Last() (Report, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last == nil {
+		return Report{}, false
+	}
+	return *c.last, true
+}
+
+// Run collects a report every interval and hands it to fn until done is
+// closed.
+func (c *Collector) Run(pc *webrtc.PeerConnection, interval time.Duration, done <-chan struct{}, fn func(Report)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+				continue
+			}
+			fn(c.Collect(pc))
+		}
+	}
+}
+
+// Collect builds a report from the counters accumulated since the previous
+// call.
+func (c *Collector) Collect(pc *webrtc.PeerConnection) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	report := Report{Timestamp: now, Tracks: []TrackStats{}}
+	elapsed := now.Sub(c.prevAt).Seconds()
+	if c.prevAt.IsZero() {
+		elapsed = 0
+	}
+	next := map[uint32]counters{}
+
+	var rtt time.Duration
+	var worstLoss float64
+	var worstJitter time.Duration
+	account := func(t TrackStats) {
+		report.Tracks = append(report.Tracks, t)
+		if t.PacketLoss > worstLoss {
+			worstLoss = t.PacketLoss
+		}
+		if j := time.Duration(t.JitterMs * float64(time.Millisecond)); j > worstJitter {
+			worstJitter = j
+		}
+	}
+
+	if c.getter != nil {
+		for _, receiver := range pc.GetReceivers() {
+			for _, track := range receiver.Tracks() {
+				ssrc := uint32(track.SSRC())
+				s := c.getter.Get(ssrc)
+				if s == nil {
+					continue
+				}
+				in := s.InboundRTPStreamStats
+				cur := counters{bytes: in.BytesReceived, received: in.PacketsReceived, lost: in.PacketsLost}
+				next[ssrc] = cur
+				t := TrackStats{TrackID: track.ID(), Kind: track.Kind().String(), Direction: "publish"}
+				if prev, ok := c.prev[ssrc]; ok && elapsed > 0 {
+					t.Bitrate = uint64(float64(cur.bytes-prev.bytes) * 8 / elapsed)
+					lost := cur.lost - prev.lost
+					expected := int64(cur.received-prev.received) + lost
+					if expected > 0 && lost > 0 {
+						t.PacketLoss = float64(lost) / float64(expected)
+					}
+				}
+				if j, ok := c.jitters[ssrc]; ok {
+					t.JitterMs = j.milliseconds()
+				}
+				account(t)
+			}
+		}
+
+		for _, sender := range pc.GetSenders() {
+			track := sender.Track()
+			if track == nil {
+				continue
+			}
+			for _, encoding := range sender.GetParameters().Encodings {
+				ssrc := uint32(encoding.SSRC)
+				s := c.getter.Get(ssrc)
+				if s == nil {
+					continue
+				}
+				out := s.OutboundRTPStreamStats
+				next[ssrc] = counters{bytes: out.BytesSent}
+				t := TrackStats{
+					TrackID:    track.ID(),
+					Kind:       track.Kind().String(),
+					Direction:  "subscribe",
+					PacketLoss: s.RemoteInboundRTPStreamStats.FractionLost,
+					JitterMs:   s.RemoteInboundRTPStreamStats.Jitter * 1000,
+				}
+				if prev, ok := c.prev[ssrc]; ok && elapsed > 0 {
+					t.Bitrate = uint64(float64(out.BytesSent-prev.bytes) * 8 / elapsed)
+				}
+				if s.RemoteInboundRTPStreamStats.RoundTripTime > rtt {
+					rtt = s.RemoteInboundRTPStreamStats.RoundTripTime
+				}
+				account(t)
+			}
+		}
+	}
+
+	if pairRTT := candidatePair(pc, &report); pairRTT > 0 {
+		rtt = pairRTT
+	}
+
+	report.RTTMs = float64(rtt) / float64(time.Millisecond)
+	report.PacketLoss = worstLoss
+	report.JitterMs = float64(worstJitter) / float64(time.Millisecond)
+	report.Score = score(rtt, worstLoss, worstJitter)
+	report.Quality = levels[report.Score]
+
+	c.prev = next
+	c.prevAt = now
+	c.last = &report
+	return report
+}
+
+// candidatePair fills the candidate types of the selected pair and returns
+// its STUN round trip time.
+func candidatePair(pc *webrtc.PeerConnection, report *Report) time.Duration {
+	all := pc.GetStats()
+	for _, s := range all {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		if local, ok := all[pair.LocalCandidateID].(webrtc.ICECandidateStats); ok {
+			report.LocalCandidate = local.CandidateType.String()
+		}
+		if remote, ok := all[pair.RemoteCandidateID].(webrtc.ICECandidateStats); ok {
+			report.RemoteCandidate = remote.CandidateType.String()
+		}
+		report.Relayed = report.LocalCandidate == "relay" || report.RemoteCandidate == "relay"
+		return time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+	}
+	return 0
+}
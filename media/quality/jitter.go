@@ -0,0 +1,91 @@
+package quality
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+)
+
+// jitter is the RFC 3550 interarrival jitter of one received stream. The stats
+// interceptor has its own estimate but it compares interarrival times with
+// absolute RTP timestamps, which makes it converge to the packet interval.
+type jitter struct {
+	mu          sync.Mutex
+	clockRate   float64
+	start       time.Time
+	lastTransit float64
+	started     bool
+	// in RTP timestamp units
+	value float64
+}
+
+func (j *jitter) update(arrival time.Time, timestamp uint32) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.started {
+		j.start = arrival
+	}
+	transit := arrival.Sub(j.start).Seconds()*j.clockRate - float64(timestamp)
+	if j.started {
+		d := transit - j.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		// RTP timestamps wrap around, ignore the jump instead of reporting it
+		if d < 1<<31 {
+			j.value += (d - j.value) / 16
+		}
+	}
+	j.lastTransit = transit
+	j.started = true
+}
+
+func (j *jitter) milliseconds() float64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.value / j.clockRate * 1000
+}
+
+type jitterFactory struct {
+	collector *Collector
+}
+
+func (f jitterFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &jitterInterceptor{collector: f.collector}, nil
+}
+
+type jitterInterceptor struct {
+	interceptor.NoOp
+	collector *Collector
+}
+
+func (i *jitterInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	if info.ClockRate == 0 {
+		return reader
+	}
+	j := &jitter{clockRate: float64(info.ClockRate)}
+	i.collector.mu.Lock()
+	i.collector.jitters[info.SSRC] = j
+	i.collector.mu.Unlock()
+
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err != nil {
+			return n, a, err
+		}
+		if a == nil {
+			a = interceptor.Attributes{}
+		}
+		if header, err := a.GetRTPHeader(b[:n]); err == nil {
+			j.update(time.Now(), header.Timestamp)
+		}
+		return n, a, nil
+	})
+}
+
+func (i *jitterInterceptor) UnbindRemoteStream(info *interceptor.StreamInfo) {
+	i.collector.mu.Lock()
+	delete(i.collector.jitters, info.SSRC)
+	i.collector.mu.Unlock()
+}
@@ -0,0 +1,73 @@
+package quality
+
+import (
+	"fmt"
+	"time"
+)
+
+// Config controls the per-connection stats collector.
+type Config struct {
+	// how often each client gets a connection-quality report, 0 disables
+	// the collector
+	Interval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{Interval: 5 * time.Second}
+}
+
+// LoadConfig reads the collector settings from configuration keys, get
+// returns "" for unset keys.
+func LoadConfig(get func(key string) string) (Config, error) {
+	c := DefaultConfig()
+	if v := get("STATS_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("STATS_INTERVAL: %w", err)
+		}
+		c.Interval = interval
+	}
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	if c.Interval < 0 || (c.Interval > 0 && c.Interval < time.Second) {
+		return fmt.Errorf("quality: stats interval must be 0 or at least 1s")
+	}
+	return nil
+}
+
+func (c Config) Enabled() bool {
+	return c.Interval > 0
+}
+
+// Score levels, from best to worst.
+var levels = []string{"", "bad", "poor", "fair", "good", "excellent"}
+
+// score rates a connection from 1 (bad) to 5 (excellent). Loss hurts the most
+// because it shows up as frozen video and robotic audio, then round trip time
+// (talking over each other), then jitter.
+func score(rtt time.Duration, loss float64, jitter time.Duration) int {
+	s := 5
+	switch {
+	case loss > 0.10:
+		s -= 3
+	case loss > 0.05:
+		s -= 2
+	case loss > 0.02:
+		s--
+	}
+	switch {
+	case rtt > 500*time.Millisecond:
+		s -= 2
+	case rtt > 250*time.Millisecond:
+		s--
+	}
+	if jitter > 50*time.Millisecond {
+		s--
+	}
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
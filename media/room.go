@@ -1,66 +1,431 @@
 package media
 
 import (
-	"log"
+	"errors"
+	"log/slog"
+	"mediaserver/history"
+	"mediaserver/media/codec"
 	"mediaserver/media/message"
+	"mediaserver/media/mixer"
+	"mediaserver/media/share"
+	"mediaserver/webhook"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 )
 
+var (
+	ErrTooManyRooms = errors.New("the server has reached its room limit")
+	ErrRoomFull     = errors.New("the room has reached its participant limit")
+	ErrRoomClosed   = errors.New("the room is closed")
+)
+
+// Limits bound Admit, 0 means unlimited.
+type Limits struct {
+	MaxRooms        int
+	MaxParticipants int
+}
+
+// Room state, its clients and the fields of each client documented as owned
+// by the room, belongs to the goroutine running the room's loop. Every other
+// goroutine goes through the commands below: Join, Leave, Broadcast, Do and
+// the close commands. ID, Mixer, CodecPolicy and the other exported fields are
+// set before the room is shared and only read afterwards.
 type Room struct {
-	ID        string
-	ShareConn *webrtc.PeerConnection
-	Clients   map[string]*Client
-	MsgChan   chan *message.Message
-	Mu        sync.RWMutex
-	QuitChan  chan struct{}
-}
-
-var Rooms = make(map[string]*Room)
-var RoomsMutex sync.RWMutex
-
-func CreateRoom(roomID string, shareConn *webrtc.PeerConnection) *Room {
-	room := &Room{
-		ID:        roomID,
-		ShareConn: shareConn,
-		MsgChan:   make(chan *message.Message),
-		Clients:   make(map[string]*Client),
-		QuitChan:  make(chan struct{}),
-	}
-	Rooms[roomID] = room
+	ID          string
+	ShareConn   *webrtc.PeerConnection
+	Mixer       *mixer.Mixer
+	CodecPolicy codec.Policy
+	Log         *slog.Logger
+	CreatedAt   time.Time
+	// identifies this life of the room in the history
+	SessionID string
+	// the room took its settings from the admin API, the host creating it
+	// cannot replace them
+	Provisioned bool
+	// the room a breakout room was split from, nil for the others
+	Parent *Room
+	// the user who created the room as a host, trusted as its host when no
+	// host token secret is set; set before the room is shared
+	Creator string
+
+	commands chan interface{}
+	// closed when the loop stops, commands sent afterwards are refused
+	done chan struct{}
+
+	// owned by the loop, Tracks, Shares, Lobby and Settings are for use
+	// inside Do
+	clients  map[string]*Client
+	Tracks   *Tracks
+	Shares   *share.Registry
+	Lobby    *Lobby
+	Settings Settings
+	expiry   *time.Timer
+	// the breakout rooms split from this one, nil when there are none
+	Breakouts *Breakouts
+	// clients admitted but not joined yet
+	pending int
+}
+
+type reserveCommand struct {
+	userID          string
+	pass            Pass
+	creating        bool
+	maxParticipants int
+	reply           chan error
+}
+
+type joinCommand struct {
+	client *Client
+	// moved from a room of the same breakout family, without a reservation
+	moved bool
+	reply chan joinResult
+}
+
+type joinResult struct {
+	replaced     *Client
+	participants int
+}
+
+type leaveCommand struct {
+	client *Client
+	reply  chan leaveResult
+}
+
+type leaveResult struct {
+	current bool
+	removed []*Track
+}
+
+type broadcastCommand struct {
+	msg *message.Message
+}
+
+type doCommand struct {
+	fn    func(clients map[string]*Client)
+	reply chan struct{}
+}
+
+type closeCommand struct {
+	reason      string
+	onlyIfEmpty bool
+	reply       chan []*Client
+}
+
+var (
+	rooms   = make(map[string]*Room)
+	roomsMu sync.Mutex
+)
+
+// newRoom runs with roomsMu held.
+func newRoom(roomID string) *Room {
+	r := &Room{
+		ID:          roomID,
+		Mixer:       mixer.New(),
+		CodecPolicy: codec.DefaultPolicy(),
+		Log:         logger.With("roomId", roomID),
+		CreatedAt:   time.Now(),
+		SessionID:   history.NewID(),
+		commands:    make(chan interface{}, 64),
+		done:        make(chan struct{}),
+		clients:     make(map[string]*Client),
+		Tracks:      newTracks(),
+		Shares:      share.NewRegistry(share.DefaultPolicy()),
+		Lobby:       newLobby(),
+	}
+	if s, ok := provisioned[roomID]; ok {
+		if s.Expired(time.Now()) {
+			delete(provisioned, roomID)
+		} else {
+			r.Settings, r.Provisioned = s, true
+		}
+	}
+	return r
+}
+
+// Admit returns the room roomID with a place reserved for userID, who joins
+// next with Join, if the room's settings let them in with pass. A missing room
+// is created and given to setup before anyone else can see it; created tells
+// whether that happened.
+func Admit(roomID, userID string, pass Pass, limits Limits, setup func(*Room)) (room *Room, created bool, err error) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	room, exists := rooms[roomID]
+	if !exists {
+		if limits.MaxRooms > 0 && len(rooms) >= limits.MaxRooms {
+			return nil, false, ErrTooManyRooms
+		}
+		room = open(roomID, setup)
+	}
+	reply := make(chan error, 1)
+	reserve := reserveCommand{
+		userID:          userID,
+		pass:            pass,
+		creating:        !exists && !room.Provisioned,
+		maxParticipants: limits.MaxParticipants,
+		reply:           reply,
+	}
+	if !room.send(reserve) {
+		return nil, false, ErrRoomClosed
+	}
+	if err, ok := await(room, reply); !ok {
+		return nil, false, ErrRoomClosed
+	} else if err != nil {
+		return nil, false, err
+	}
+	return room, !exists, nil
+}
+
+// open creates and starts the room roomID, with roomsMu held.
+func open(roomID string, setup func(*Room)) *Room {
+	room := newRoom(roomID)
+	if setup != nil {
+		setup(room)
+	}
+	room.armExpiry()
+	rooms[roomID] = room
+	go room.run()
+	room.Log.Info("room created")
+	history.RoomOpened(room.SessionID, roomID, room.CreatedAt)
+	webhook.Emit(webhook.RoomCreated, roomID, "", nil)
 	return room
 }
 
-func (r *Room) Run() {
-	for {
-		select {
-		case msg := <-r.MsgChan:
-			r.broadcast(msg)
-		case <-r.QuitChan:
+func (r *Room) run() {
+	defer close(r.done)
+	for cmd := range r.commands {
+		switch c := cmd.(type) {
+		case reserveCommand:
+			_, rejoin := r.clients[c.userID]
+			if err := r.admit(c, rejoin); err != nil {
+				c.reply <- err
+				continue
+			}
+			limit := r.Settings.participantLimit(c.maxParticipants)
+			if !rejoin && limit > 0 && len(r.clients)+r.pending >= limit {
+				c.reply <- ErrRoomFull
+				continue
+			}
+			r.pending++
+			c.reply <- nil
+		case joinCommand:
+			replaced := r.clients[c.client.UserID]
+			r.clients[c.client.UserID] = c.client
+			c.client.room.Store(r)
+			if r.pending > 0 && !c.moved {
+				r.pending--
+			}
+			c.reply <- joinResult{replaced: replaced, participants: len(r.clients)}
+		case leaveCommand:
+			current := r.clients[c.client.UserID] == c.client
+			if current {
+				delete(r.clients, c.client.UserID)
+				r.Shares.Stop(c.client.UserID)
+			}
+			removed := r.Tracks.removePublisher(c.client)
+			for _, t := range removed {
+				if t.Keyframes != nil {
+					t.Keyframes.Close()
+				}
+			}
+			c.reply <- leaveResult{current: current, removed: removed}
+		case broadcastCommand:
+			for _, client := range r.clients {
+				if client.UserID != c.msg.UserID {
+					client.SafeSend(*c.msg)
+				}
+			}
+		case doCommand:
+			c.fn(r.clients)
+			close(c.reply)
+		case closeCommand:
+			// breakout rooms close with their parent's breakouts
+			if c.onlyIfEmpty && (len(r.clients) > 0 || r.pending > 0 || r.Parent != nil || r.Breakouts != nil) {
+				c.reply <- nil
+				continue
+			}
+			clients := r.Lobby.clients()
+			for _, client := range r.clients {
+				clients = append(clients, client)
+			}
+			r.shutdown(c.reason, len(clients))
+			c.reply <- clients
 			return
 		}
 	}
 }
-func (r *Room) broadcast(msg *message.Message) {
-	r.Mu.RLock()
-	defer func() {
-		if recover := recover(); recover != nil {
 
+// send hands cmd to the loop; it returns false once the room is closed.
+func (r *Room) send(cmd interface{}) bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+	}
+	select {
+	case r.commands <- cmd:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// await waits for the loop's reply to a command; ok is false when the room
+// closed before answering.
+func await[T any](r *Room, reply chan T) (v T, ok bool) {
+	select {
+	case v = <-reply:
+		return v, true
+	case <-r.done:
+		// the loop may have answered right before stopping
+		select {
+		case v = <-reply:
+			return v, true
+		default:
+			return v, false
 		}
-		r.Mu.RUnlock()
-	}()
-	for _, c := range r.Clients {
-		if c.UserID == msg.UserID {
-			continue
+	}
+}
+
+// Join adds a client admitted by Admit. An older connection of the same user
+// is replaced and returned for the caller to close. ok is false when the room
+// closed in between.
+func (r *Room) Join(c *Client) (replaced *Client, participants int, ok bool) {
+	return r.join(joinCommand{client: c})
+}
+
+// Transfer adds c, moved out of the parent or a breakout room, without a
+// reservation: moves between a room and its breakouts ignore the limits.
+func (r *Room) Transfer(c *Client) (replaced *Client, participants int, ok bool) {
+	return r.join(joinCommand{client: c, moved: true})
+}
+
+func (r *Room) join(cmd joinCommand) (replaced *Client, participants int, ok bool) {
+	cmd.reply = make(chan joinResult, 1)
+	if !r.send(cmd) {
+		return nil, 0, false
+	}
+	result, ok := await(r, cmd.reply)
+	return result.replaced, result.participants, ok
+}
+
+// Leave removes c and the tracks it published, which it returns for their
+// senders to be removed from the other clients. current tells whether c was
+// still the user's connection, false when the user already reconnected with a
+// newer client.
+func (r *Room) Leave(c *Client) (current bool, removed []*Track) {
+	reply := make(chan leaveResult, 1)
+	if !r.send(leaveCommand{client: c, reply: reply}) {
+		return false, nil
+	}
+	result, _ := await(r, reply)
+	return result.current, result.removed
+}
+
+// Withdraw gives back the place Admit reserved for c, which leaves without
+// joining, from the lobby for instance.
+func (r *Room) Withdraw(c *Client) {
+	r.Do(func(map[string]*Client) {
+		r.Lobby.Remove(c)
+		if r.pending > 0 {
+			r.pending--
+		}
+	})
+}
+
+// Broadcast queues msg for every client except msg.UserID. It returns false
+// when the room is already closed.
+func (r *Room) Broadcast(msg *message.Message) bool {
+	return r.send(broadcastCommand{msg: msg})
+}
+
+// Do runs fn on the room's loop and waits for it. fn may read and change the
+// clients and their room-owned fields, and must not call other Room methods.
+// It returns false, without running fn, when the room is closed.
+func (r *Room) Do(fn func(clients map[string]*Client)) bool {
+	reply := make(chan struct{}, 1)
+	if !r.send(doCommand{fn: fn, reply: reply}) {
+		return false
+	}
+	_, ok := await(r, reply)
+	return ok
+}
+
+// Clients returns the clients present now.
+func (r *Room) Clients() []*Client {
+	var clients []*Client
+	r.Do(func(all map[string]*Client) {
+		clients = make([]*Client, 0, len(all))
+		for _, c := range all {
+			clients = append(clients, c)
+		}
+	})
+	return clients
+}
+
+// Client returns the current connection of userID.
+func (r *Room) Client(userID string) (*Client, bool) {
+	var client *Client
+	r.Do(func(all map[string]*Client) { client = all[userID] })
+	return client, client != nil
+}
+
+// Close removes the room from the registry, stops its loop and kicks every
+// client.
+func (r *Room) Close(reason string) {
+	roomsMu.Lock()
+	if rooms[r.ID] == r {
+		delete(rooms, r.ID)
+	}
+	roomsMu.Unlock()
+
+	clients, _ := r.stop(reason, false)
+	for _, c := range clients {
+		c.Kick(reason)
+	}
+}
+
+// CloseIfEmpty closes the room once its last client left and nobody is
+// joining.
+func (r *Room) CloseIfEmpty() bool {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	if _, closed := r.stop("empty", true); !closed {
+		return false
+	}
+	if rooms[r.ID] == r {
+		delete(rooms, r.ID)
+	}
+	return true
+}
+
+func (r *Room) stop(reason string, onlyIfEmpty bool) ([]*Client, bool) {
+	reply := make(chan []*Client, 1)
+	if !r.send(closeCommand{reason: reason, onlyIfEmpty: onlyIfEmpty, reply: reply}) {
+		return nil, false
+	}
+	clients, ok := await(r, reply)
+	return clients, ok && clients != nil
+}
+
+func (r *Room) shutdown(reason string, kicked int) {
+	r.Log.Info("room closed", "reason", reason, "kicked", kicked)
+	if r.expiry != nil {
+		r.expiry.Stop()
+	}
+	if r.Breakouts != nil {
+		r.Breakouts.Stop()
+		for _, b := range r.Breakouts.Rooms {
+			// Close waits for roomsMu, which CloseIfEmpty holds while this
+			// loop stops
+			go b.Room.Close(reason)
 		}
-		func(c *Client) {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("Recovered from panic when sending to %s: %v", c.UserID, r)
-				}
-			}()
-			c.Send <- *msg
-		}(c)
 	}
+	r.Mixer.Close()
+	history.RoomClosed(r.SessionID, time.Now(), reason)
+	webhook.Emit(webhook.RoomClosed, r.ID, "", map[string]interface{}{
+		"reason":   reason,
+		"duration": time.Since(r.CreatedAt).Seconds(),
+	})
 }
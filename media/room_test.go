@@ -0,0 +1,409 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"mediaserver/media/socket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestClient returns a client whose WebSocket goes to a browser stand-in
+// that reads until the server closes it.
+func newTestClient(t *testing.T, roomID, userID string) *Client {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	browser, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { browser.Close() })
+	go func() {
+		for {
+			if _, _, err := browser.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return CreateClientConnection(userID, roomID, "student", false, false, <-conns, socket.DefaultConfig())
+}
+
+// pendingOf reads the places reserved but not joined yet; ok is false once
+// the room is closed.
+func pendingOf(r *Room) (pending int, ok bool) {
+	ok = r.Do(func(map[string]*Client) { pending = r.pending })
+	return pending, ok
+}
+
+func TestConcurrentAdmitJoinLeave(t *testing.T) {
+	const users, rounds = 20, 10
+	roomID := "test-concurrent"
+	clients := make([][]*Client, users)
+	for u := range clients {
+		for i := 0; i < rounds; i++ {
+			clients[u] = append(clients[u], newTestClient(t, roomID, fmt.Sprintf("user-%d", u)))
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		opened = map[*Room]bool{}
+		wg     sync.WaitGroup
+	)
+	// watches the rooms while they are used
+	stop := make(chan struct{})
+	var negative atomic.Bool
+	watcher := make(chan struct{})
+	go func() {
+		defer close(watcher)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mu.Lock()
+			rooms := make([]*Room, 0, len(opened))
+			for r := range opened {
+				rooms = append(rooms, r)
+			}
+			mu.Unlock()
+			for _, r := range rooms {
+				if p, ok := pendingOf(r); ok && p < 0 {
+					negative.Store(true)
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for u := 0; u < users; u++ {
+		wg.Add(1)
+		go func(u int) {
+			defer wg.Done()
+			for i, c := range clients[u] {
+				room, _, err := Admit(roomID, c.UserID, Pass{}, Limits{}, nil)
+				if err != nil {
+					t.Errorf("Admit: %v", err)
+					return
+				}
+				mu.Lock()
+				opened[room] = true
+				mu.Unlock()
+				// every third round leaves from the lobby without joining
+				if i%3 == 2 {
+					room.Withdraw(c)
+					room.CloseIfEmpty()
+					continue
+				}
+				if _, _, ok := room.Join(c); !ok {
+					t.Errorf("Join refused by a room with a reserved place")
+					return
+				}
+				if current, _ := room.Leave(c); !current {
+					t.Errorf("Leave of the current connection returned false")
+				}
+				room.CloseIfEmpty()
+			}
+		}(u)
+	}
+	wg.Wait()
+	close(stop)
+	<-watcher
+
+	if negative.Load() {
+		t.Error("pending went negative")
+	}
+	for r := range opened {
+		if p, ok := pendingOf(r); ok && p != 0 {
+			t.Errorf("room %p has %d places reserved after everyone left", r, p)
+		}
+		if ok := r.Do(func(clients map[string]*Client) {
+			if len(clients) != 0 {
+				t.Errorf("room %p still has %d clients", r, len(clients))
+			}
+		}); ok {
+			r.CloseIfEmpty()
+		}
+	}
+	if _, open := GetRoom(roomID); open {
+		t.Error("the room stayed open after everyone left")
+	}
+}
+
+func TestParticipantLimitUnderContention(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		room   int
+		want   int
+	}{
+		{"server limit", Limits{MaxParticipants: 5}, 0, 5},
+		{"room limit", Limits{MaxParticipants: 8}, 3, 3},
+		{"server limit below the room's", Limits{MaxParticipants: 4}, 6, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomID := "test-limit-" + strings.ReplaceAll(tt.name, " ", "-")
+			setup := func(r *Room) { r.Settings.MaxParticipants = tt.room }
+			const candidates = 40
+			clients := make([]*Client, candidates)
+			for i := range clients {
+				clients[i] = newTestClient(t, roomID, fmt.Sprintf("user-%d", i))
+			}
+			// the room exists before the rush so nobody is its creator
+			first, _, err := Admit(roomID, "opener", Pass{}, tt.limits, setup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var admitted, full atomic.Int32
+			var wg sync.WaitGroup
+			for _, c := range clients {
+				wg.Add(1)
+				go func(c *Client) {
+					defer wg.Done()
+					room, _, err := Admit(roomID, c.UserID, Pass{}, tt.limits, setup)
+					switch {
+					case errors.Is(err, ErrRoomFull):
+						full.Add(1)
+					case err != nil:
+						t.Errorf("Admit: %v", err)
+					default:
+						admitted.Add(1)
+						if _, _, ok := room.Join(c); !ok {
+							t.Errorf("Join refused")
+						}
+					}
+				}(c)
+			}
+			wg.Wait()
+			// the opener's reservation counts against the limit
+			if got := int(admitted.Load()) + 1; got != tt.want {
+				t.Errorf("%d places given, want %d", got, tt.want)
+			}
+			if int(admitted.Load()+full.Load()) != candidates {
+				t.Errorf("%d admitted and %d refused out of %d", admitted.Load(), full.Load(), candidates)
+			}
+			first.Withdraw(&Client{UserID: "opener"})
+			if p, _ := pendingOf(first); p != 0 {
+				t.Errorf("%d places still reserved", p)
+			}
+			first.Close("test over")
+		})
+	}
+}
+
+func TestReplacedClientLeave(t *testing.T) {
+	roomID := "test-replaced"
+	older := newTestClient(t, roomID, "alice")
+	newer := newTestClient(t, roomID, "alice")
+
+	room, _, err := Admit(roomID, "alice", Pass{}, Limits{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced, _, ok := room.Join(older); !ok || replaced != nil {
+		t.Fatalf("first Join = %v, %v", replaced, ok)
+	}
+	if _, _, err := Admit(roomID, "alice", Pass{}, Limits{MaxParticipants: 1}, nil); err != nil {
+		t.Fatalf("a reconnect was refused by a full room: %v", err)
+	}
+	replaced, participants, ok := room.Join(newer)
+	if !ok || replaced != older || participants != 1 {
+		t.Fatalf("second Join = %v, %d, %v, want the older client", replaced, participants, ok)
+	}
+	if current, _ := room.Leave(older); current {
+		t.Error("Leave of the replaced client returned true")
+	}
+	if current, ok := room.Client("alice"); !ok || current != newer {
+		t.Error("the replaced client's Leave removed the newer connection")
+	}
+	if room.CloseIfEmpty() {
+		t.Error("the room closed while the newer connection is in it")
+	}
+	if current, _ := room.Leave(newer); !current {
+		t.Error("Leave of the current client returned false")
+	}
+	if !room.CloseIfEmpty() {
+		t.Error("the empty room did not close")
+	}
+}
+
+func TestTransferBetweenBreakouts(t *testing.T) {
+	roomID := "test-transfer"
+	c := newTestClient(t, roomID, "bob")
+	parent, _, err := Admit(roomID, "bob", Pass{}, Limits{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.Join(c)
+	breakouts, err := OpenBreakouts(parent, []string{"A", "B"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.Do(func(map[string]*Client) { parent.Breakouts = breakouts })
+	child := breakouts.Rooms[0].Room
+
+	var wg sync.WaitGroup
+	// moves back and forth while others look the client up
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		from, to := parent, child
+		for i := 0; i < 50; i++ {
+			if current, _ := from.Leave(c); !current {
+				t.Errorf("Leave from %s returned false", from.ID)
+				return
+			}
+			if _, _, ok := to.Transfer(c); !ok {
+				t.Errorf("Transfer to %s refused", to.ID)
+				return
+			}
+			from, to = to, from
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				parent.Client("bob")
+				child.Client("bob")
+				c.Room()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if c.Room() != parent {
+		t.Fatalf("client in %s, want the parent", c.Room().ID)
+	}
+	for _, r := range []*Room{parent, child} {
+		if p, _ := pendingOf(r); p != 0 {
+			t.Errorf("a transfer changed the reservations of %s: %d", r.ID, p)
+		}
+	}
+	if child.CloseIfEmpty() {
+		t.Error("an empty breakout room closed before its parent's breakouts")
+	}
+	parent.Leave(c)
+	if parent.CloseIfEmpty() {
+		t.Error("a room with breakout rooms closed when empty")
+	}
+	parent.Close("test over")
+	deadline := time.Now().Add(time.Second)
+	for _, b := range breakouts.Rooms {
+		for b.Room.Do(func(map[string]*Client) {}) {
+			if time.Now().After(deadline) {
+				t.Fatalf("breakout room %s still open after its parent closed", b.Room.ID)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestCloseDuringJoins(t *testing.T) {
+	roomID := "test-close"
+	const users = 30
+	clients := make([]*Client, users)
+	for i := range clients {
+		clients[i] = newTestClient(t, roomID, fmt.Sprintf("user-%d", i))
+	}
+	room, _, err := Admit(roomID, "host", Pass{}, Limits{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var joined []*Client
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			r, _, err := Admit(roomID, c.UserID, Pass{}, Limits{}, nil)
+			if err != nil {
+				return
+			}
+			if _, _, ok := r.Join(c); ok && r == room {
+				mu.Lock()
+				joined = append(joined, c)
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		room.Close("closed by a test")
+	}()
+	wg.Wait()
+
+	for _, c := range joined {
+		select {
+		case <-c.Done:
+		case <-time.After(time.Second):
+			t.Errorf("%s joined the closed room and was not kicked", c.UserID)
+		}
+	}
+	if room.Do(func(map[string]*Client) {}) {
+		t.Error("Do ran on a closed room")
+	}
+	if _, _, ok := room.Join(newTestClient(t, roomID, "late")); ok {
+		t.Error("Join succeeded on a closed room")
+	}
+	// later joiners got a new life of the room
+	if r, ok := GetRoom(roomID); ok {
+		if r == room {
+			t.Error("the closed room is still registered")
+		}
+		r.Close("test over")
+	}
+}
+
+func TestLeaveReturnsPublishedTracks(t *testing.T) {
+	roomID := "test-leave-tracks"
+	older := newTestClient(t, roomID, "carol")
+	newer := newTestClient(t, roomID, "carol")
+	room, _, err := Admit(roomID, "carol", Pass{}, Limits{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.Join(older)
+	stale := &Track{ID: "camera"}
+	room.Do(func(map[string]*Client) { room.Tracks.Add(older, stale) })
+	Admit(roomID, "carol", Pass{}, Limits{}, nil)
+	room.Join(newer)
+	fresh := &Track{ID: "microphone"}
+	room.Do(func(map[string]*Client) { room.Tracks.Add(newer, fresh) })
+
+	// a reconnect keeps the newer connection's tracks
+	if current, removed := room.Leave(older); current || len(removed) != 1 || removed[0] != stale {
+		t.Errorf("Leave(older) = %v, %v, want false and its camera", current, removed)
+	}
+	if current, removed := room.Leave(newer); !current || len(removed) != 1 || removed[0] != fresh {
+		t.Errorf("Leave(newer) = %v, %v, want true and its microphone", current, removed)
+	}
+	room.Do(func(map[string]*Client) {
+		if n := len(room.Tracks.All()); n != 0 {
+			t.Errorf("%d tracks left after everyone left", n)
+		}
+	})
+	room.Close("test over")
+}
@@ -0,0 +1,267 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrRoomLocked    = errors.New("the room is locked")
+	ErrWrongPassword = errors.New("wrong room password")
+	ErrRoomExpired   = errors.New("the room has expired")
+	// a track refused because the room has its maximum of publishers
+	ErrTooManyPublishers = errors.New("the room has reached its publisher limit")
+)
+
+// bcrypt ignores what follows
+const maxPasswordLength = 72
+
+// Settings are the rules a room admits participants and publishers by, set by
+// the host creating the room or provisioned through the admin API.
+type Settings struct {
+	// bcrypt hash, no password when empty
+	PasswordHash []byte
+	// 0 means no limit beyond the server's
+	MaxParticipants int
+	// users publishing tracks at once, 0 means unlimited
+	MaxPublishers int
+	// a locked room only lets its participants reconnect
+	Locked bool
+	// the room closes then, zero means never
+	ExpiresAt time.Time
+	// users trusted as hosts when they join with a host role, like with a
+	// host token
+	Hosts []string
+}
+
+// SettingsInfo is what hosts and admins see of the settings.
+type SettingsInfo struct {
+	Password        bool       `json:"password"`
+	MaxParticipants int        `json:"maxParticipants"`
+	MaxPublishers   int        `json:"maxPublishers"`
+	Locked          bool       `json:"locked"`
+	ExpiresAt       *time.Time `json:"expiresAt,omitempty"`
+	Hosts           []string   `json:"hosts,omitempty"`
+}
+
+func (s Settings) Info() SettingsInfo {
+	info := SettingsInfo{
+		Password:        len(s.PasswordHash) > 0,
+		MaxParticipants: s.MaxParticipants,
+		MaxPublishers:   s.MaxPublishers,
+		Locked:          s.Locked,
+		Hosts:           s.Hosts,
+	}
+	if !s.ExpiresAt.IsZero() {
+		expiresAt := s.ExpiresAt
+		info.ExpiresAt = &expiresAt
+	}
+	return info
+}
+
+// Lists tells whether the settings make userID a host.
+func (s Settings) Lists(userID string) bool {
+	return slices.Contains(s.Hosts, userID)
+}
+
+func (s Settings) Expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// ParseSettings applies the fields present in fields to base: "password"
+// ("" removes it), "maxParticipants", "maxPublishers", "locked", "expiresAt"
+// (RFC 3339, "" for never) and "hosts", a list of user IDs.
+func ParseSettings(fields map[string]interface{}, base Settings) (Settings, error) {
+	s := base
+	if v, ok := fields["password"]; ok {
+		password, isString := v.(string)
+		if !isString || len(password) > maxPasswordLength {
+			return base, fmt.Errorf("password must be a string of at most %d bytes", maxPasswordLength)
+		}
+		s.PasswordHash = nil
+		if password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				return base, err
+			}
+			s.PasswordHash = hash
+		}
+	}
+	for key, target := range map[string]*int{"maxParticipants": &s.MaxParticipants, "maxPublishers": &s.MaxPublishers} {
+		v, ok := fields[key]
+		if !ok {
+			continue
+		}
+		n, isNumber := v.(float64)
+		if !isNumber || n < 0 || n != math.Trunc(n) || n > math.MaxInt32 {
+			return base, fmt.Errorf("%s must be a non-negative whole number (0 = unlimited)", key)
+		}
+		*target = int(n)
+	}
+	if v, ok := fields["locked"]; ok {
+		locked, isBool := v.(bool)
+		if !isBool {
+			return base, errors.New("locked must be true or false")
+		}
+		s.Locked = locked
+	}
+	if v, ok := fields["expiresAt"]; ok {
+		text, isString := v.(string)
+		if !isString {
+			return base, errors.New("expiresAt must be an RFC 3339 time")
+		}
+		s.ExpiresAt = time.Time{}
+		if text != "" {
+			expiresAt, err := time.Parse(time.RFC3339, text)
+			if err != nil {
+				return base, errors.New("expiresAt must be an RFC 3339 time")
+			}
+			if !expiresAt.After(time.Now()) {
+				return base, errors.New("expiresAt must be in the future")
+			}
+			s.ExpiresAt = expiresAt
+		}
+	}
+	if v, ok := fields["hosts"]; ok {
+		items, isList := v.([]interface{})
+		if !isList {
+			return base, errors.New("hosts must be a list of user IDs")
+		}
+		s.Hosts = nil
+		for _, item := range items {
+			userID, isString := item.(string)
+			if !isString || userID == "" {
+				return base, errors.New("hosts must be a list of user IDs")
+			}
+			s.Hosts = append(s.Hosts, userID)
+		}
+	}
+	return s, nil
+}
+
+// Pass is the proof VerifyPassword gives Admit that the password of the room
+// was checked.
+type Pass struct {
+	checked []byte
+}
+
+// VerifyPassword checks password against the room roomID, or the settings
+// provisioned for it when it is not open. bcrypt is slow on purpose, so this
+// runs before Admit and outside the room's loop; Admit refuses the pass if
+// the password changed meanwhile.
+func VerifyPassword(roomID, password string) (Pass, error) {
+	var hash []byte
+	roomsMu.Lock()
+	room, open := rooms[roomID]
+	if s := provisioned[roomID]; !open && !s.Expired(time.Now()) {
+		hash = s.PasswordHash
+	}
+	roomsMu.Unlock()
+	if open {
+		room.Do(func(map[string]*Client) { hash = room.Settings.PasswordHash })
+	}
+	if len(hash) == 0 {
+		return Pass{}, nil
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return Pass{}, ErrWrongPassword
+	}
+	return Pass{checked: hash}, nil
+}
+
+func (p Pass) admits(s Settings) bool {
+	return bytes.Equal(p.checked, s.PasswordHash)
+}
+
+// settings provisioned through the admin API by room ID, taken by every room
+// opened with that ID until they expire or are removed; guarded by roomsMu
+var provisioned = make(map[string]Settings)
+
+// Provision sets the settings of roomID, for the room open now if any and for
+// the ones opened later.
+func Provision(roomID string, s Settings) {
+	roomsMu.Lock()
+	provisioned[roomID] = s
+	room, open := rooms[roomID]
+	roomsMu.Unlock()
+	if open {
+		room.SetSettings(s)
+	}
+}
+
+// Provisioned returns the settings provisioned for roomID.
+func Provisioned(roomID string) (Settings, bool) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	s, ok := provisioned[roomID]
+	if ok && s.Expired(time.Now()) {
+		delete(provisioned, roomID)
+		return Settings{}, false
+	}
+	return s, ok
+}
+
+// Unprovision forgets the settings provisioned for roomID; an open room keeps
+// its current settings.
+func Unprovision(roomID string) bool {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	_, ok := provisioned[roomID]
+	delete(provisioned, roomID)
+	return ok
+}
+
+// SetSettings replaces the room's settings and restarts its expiry timer.
+func (r *Room) SetSettings(s Settings) bool {
+	return r.Do(func(map[string]*Client) {
+		r.Settings = s
+		r.armExpiry()
+	})
+}
+
+// armExpiry closes the room when its settings expire. It runs on the room's
+// loop, or before the room is shared.
+func (r *Room) armExpiry() {
+	if r.expiry != nil {
+		r.expiry.Stop()
+		r.expiry = nil
+	}
+	if r.Settings.ExpiresAt.IsZero() {
+		return
+	}
+	r.expiry = time.AfterFunc(time.Until(r.Settings.ExpiresAt), func() {
+		r.Close("the room has expired")
+	})
+}
+
+// admit checks a reservation against the settings, on the room's loop. The
+// creator of the room is the one setting them.
+func (r *Room) admit(c reserveCommand, rejoin bool) error {
+	if c.creating {
+		return nil
+	}
+	if r.Settings.Expired(time.Now()) {
+		return ErrRoomExpired
+	}
+	if !c.pass.admits(r.Settings) {
+		return ErrWrongPassword
+	}
+	if r.Settings.Locked && !rejoin {
+		return ErrRoomLocked
+	}
+	return nil
+}
+
+// participantLimit is the lower of the server's limit and the room's.
+func (s Settings) participantLimit(server int) int {
+	if s.MaxParticipants > 0 && (server == 0 || s.MaxParticipants < server) {
+		return s.MaxParticipants
+	}
+	return server
+}
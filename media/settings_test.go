@@ -0,0 +1,84 @@
+package media
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseSettings(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	base := Settings{PasswordHash: []byte("hash"), MaxParticipants: 10, MaxPublishers: 2, Locked: true, ExpiresAt: future, Hosts: []string{"alice"}}
+
+	tests := []struct {
+		name   string
+		fields map[string]interface{}
+		want   Settings
+		// substring of the error, "" when the fields are valid
+		err string
+	}{
+		{"no fields keep the base", map[string]interface{}{}, base, ""},
+		{"limits", map[string]interface{}{"maxParticipants": 30.0, "maxPublishers": 0.0},
+			Settings{PasswordHash: base.PasswordHash, MaxParticipants: 30, Locked: true, ExpiresAt: future, Hosts: base.Hosts}, ""},
+		{"unlock", map[string]interface{}{"locked": false},
+			Settings{PasswordHash: base.PasswordHash, MaxParticipants: 10, MaxPublishers: 2, ExpiresAt: future, Hosts: base.Hosts}, ""},
+		{"empty password removes it", map[string]interface{}{"password": ""},
+			Settings{MaxParticipants: 10, MaxPublishers: 2, Locked: true, ExpiresAt: future, Hosts: base.Hosts}, ""},
+		{"empty expiry means never", map[string]interface{}{"expiresAt": ""},
+			Settings{PasswordHash: base.PasswordHash, MaxParticipants: 10, MaxPublishers: 2, Locked: true, Hosts: base.Hosts}, ""},
+		{"expiry", map[string]interface{}{"expiresAt": future.Add(time.Hour).Format(time.RFC3339)},
+			Settings{PasswordHash: base.PasswordHash, MaxParticipants: 10, MaxPublishers: 2, Locked: true, ExpiresAt: future.Add(time.Hour), Hosts: base.Hosts}, ""},
+		{"hosts replace the list", map[string]interface{}{"hosts": []interface{}{"bob", "carol"}},
+			Settings{PasswordHash: base.PasswordHash, MaxParticipants: 10, MaxPublishers: 2, Locked: true, ExpiresAt: future, Hosts: []string{"bob", "carol"}}, ""},
+		{"empty hosts", map[string]interface{}{"hosts": []interface{}{}},
+			Settings{PasswordHash: base.PasswordHash, MaxParticipants: 10, MaxPublishers: 2, Locked: true, ExpiresAt: future}, ""},
+
+		{"negative limit", map[string]interface{}{"maxParticipants": -1.0}, base, "maxParticipants must be a non-negative whole number (0 = unlimited)"},
+		{"fractional limit", map[string]interface{}{"maxPublishers": 2.5}, base, "maxPublishers must be a non-negative whole number"},
+		{"limit as a string", map[string]interface{}{"maxParticipants": "10"}, base, "maxParticipants must be"},
+		{"huge limit", map[string]interface{}{"maxParticipants": 1e12}, base, "maxParticipants must be"},
+		{"password not a string", map[string]interface{}{"password": 1234.0}, base, "password must be a string"},
+		{"password too long", map[string]interface{}{"password": strings.Repeat("x", maxPasswordLength+1)}, base, "password must be a string"},
+		{"locked not a boolean", map[string]interface{}{"locked": "yes"}, base, "locked must be true or false"},
+		{"expiry not RFC 3339", map[string]interface{}{"expiresAt": "tomorrow"}, base, "expiresAt must be an RFC 3339 time"},
+		{"expiry in the past", map[string]interface{}{"expiresAt": time.Now().Add(-time.Hour).Format(time.RFC3339)}, base, "expiresAt must be in the future"},
+		{"hosts not a list", map[string]interface{}{"hosts": "bob"}, base, "hosts must be a list of user IDs"},
+		{"empty host", map[string]interface{}{"hosts": []interface{}{"bob", ""}}, base, "hosts must be a list of user IDs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSettings(tt.fields, base)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseSettings() error = %v, want %q", err, tt.err)
+				}
+				if !reflect.DeepEqual(got, base) {
+					t.Fatalf("ParseSettings() = %+v on error, want the base", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSettings() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseSettings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSettingsPassword(t *testing.T) {
+	s, err := ParseSettings(map[string]interface{}{"password": "secret"}, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword(s.PasswordHash, []byte("secret")) != nil {
+		t.Fatal("the password hash does not match the password")
+	}
+	if !s.Info().Password {
+		t.Fatal("Info does not show the password")
+	}
+}
@@ -0,0 +1,125 @@
+// Package share keeps track of who is sharing their screen in a room, under
+// the room's policy for concurrent shares.
+package share
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// a new share takes over the one in progress
+	ModeExclusive = "exclusive"
+	// up to MaxShares presenters share at once
+	ModeConcurrent = "concurrent"
+)
+
+var ErrTooManyShares = errors.New("the room has reached its screen share limit")
+
+type Policy struct {
+	Mode string
+	// with ModeConcurrent, 0 means unlimited
+	MaxShares int
+}
+
+func DefaultPolicy() Policy {
+	return Policy{Mode: ModeConcurrent}
+}
+
+// LoadPolicy reads the share policy from configuration keys, get returns ""
+// for unset keys.
+func LoadPolicy(get func(key string) string) (Policy, error) {
+	p := DefaultPolicy()
+	if v := get("SCREEN_SHARE_MODE"); v != "" {
+		p.Mode = v
+	}
+	if v := get("MAX_SCREEN_SHARES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return p, fmt.Errorf("MAX_SCREEN_SHARES: %w", err)
+		}
+		p.MaxShares = n
+	}
+	return p, p.Validate()
+}
+
+func (p Policy) Validate() error {
+	if p.Mode != ModeExclusive && p.Mode != ModeConcurrent {
+		return fmt.Errorf("share: mode must be %s or %s, got %q", ModeExclusive, ModeConcurrent, p.Mode)
+	}
+	if p.MaxShares < 0 {
+		return errors.New("share: max shares cannot be negative")
+	}
+	return nil
+}
+
+// Share is a screen share in progress.
+type Share struct {
+	UserID string `json:"userId"`
+	// the screen and screen-audio tracks the presenter said it shares
+	TrackIDs  []string  `json:"trackIds"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// Registry holds the shares of one room. It belongs to the room's loop.
+type Registry struct {
+	Policy Policy
+	byUser map[string]*Share
+}
+
+func NewRegistry(p Policy) *Registry {
+	return &Registry{Policy: p, byUser: make(map[string]*Share)}
+}
+
+// Start records a share of userID. Starting again while sharing only updates
+// the track IDs. Under the exclusive policy the shares of the others end and
+// their presenters are returned as taken over.
+func (r *Registry) Start(userID string, trackIDs []string, at time.Time) (takenOver []string, err error) {
+	if sh, ok := r.byUser[userID]; ok {
+		sh.TrackIDs = trackIDs
+		return nil, nil
+	}
+	switch r.Policy.Mode {
+	case ModeExclusive:
+		for other := range r.byUser {
+			takenOver = append(takenOver, other)
+			delete(r.byUser, other)
+		}
+		sort.Strings(takenOver)
+	case ModeConcurrent:
+		if r.Policy.MaxShares > 0 && len(r.byUser) >= r.Policy.MaxShares {
+			return nil, ErrTooManyShares
+		}
+	}
+	r.byUser[userID] = &Share{UserID: userID, TrackIDs: trackIDs, StartedAt: at}
+	return takenOver, nil
+}
+
+// Stop ends the share of userID and tells whether there was one.
+func (r *Registry) Stop(userID string) bool {
+	_, ok := r.byUser[userID]
+	delete(r.byUser, userID)
+	return ok
+}
+
+func (r *Registry) Sharing(userID string) bool {
+	_, ok := r.byUser[userID]
+	return ok
+}
+
+// Active returns copies of the shares in progress, oldest first.
+func (r *Registry) Active() []Share {
+	shares := make([]Share, 0, len(r.byUser))
+	for _, sh := range r.byUser {
+		shares = append(shares, Share{
+			UserID:    sh.UserID,
+			TrackIDs:  append([]string(nil), sh.TrackIDs...),
+			StartedAt: sh.StartedAt,
+		})
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].StartedAt.Before(shares[j].StartedAt) })
+	return shares
+}
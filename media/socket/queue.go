@@ -0,0 +1,133 @@
+package socket
+
+import (
+	"mediaserver/media/message"
+	"sync"
+	"time"
+)
+
+// Priority decides what happens to a message queued for a client that reads
+// slower than its room talks.
+type Priority int
+
+const (
+	// Normal messages are dropped while the queue is full.
+	Normal Priority = iota
+	// Critical messages, the signaling a peer connection cannot recover
+	// from losing, are queued even over the limit.
+	Critical
+	// Latest messages replace the queued message with the same key: only the
+	// newest report of a kind matters.
+	Latest
+)
+
+// Result tells what Push did with a message.
+type Result int
+
+const (
+	Queued Result = iota
+	// an older message with the same key was replaced
+	Coalesced
+	// the queue is full
+	Dropped
+	// even critical messages no longer fit, the client is not reading at all
+	Overflow
+)
+
+// critical messages may take this many times the queue size
+const criticalFactor = 4
+
+// Queue is a bounded FIFO of messages, safe for concurrent use. It never
+// blocks: a full queue drops messages according to their priority.
+type Queue struct {
+	mu    sync.Mutex
+	items []entry
+	limit int
+	// entries other than critical ones, bounded by limit
+	bounded   int
+	fullSince time.Time
+	ready     chan struct{}
+}
+
+type entry struct {
+	msg      message.Message
+	priority Priority
+	key      string
+}
+
+func NewQueue(size int) *Queue {
+	return &Queue{limit: size, ready: make(chan struct{}, 1)}
+}
+
+// Push queues msg; key identifies the messages a Latest one replaces.
+func (q *Queue) Push(msg message.Message, priority Priority, key string) Result {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch priority {
+	case Critical:
+		if len(q.items) >= q.limit*criticalFactor {
+			return Overflow
+		}
+	case Latest:
+		for i := range q.items {
+			if q.items[i].priority == Latest && q.items[i].key == key {
+				q.items[i].msg = msg
+				return Coalesced
+			}
+		}
+		fallthrough
+	default:
+		if q.bounded >= q.limit {
+			if q.fullSince.IsZero() {
+				q.fullSince = time.Now()
+			}
+			return Dropped
+		}
+		q.bounded++
+	}
+	q.items = append(q.items, entry{msg: msg, priority: priority, key: key})
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return Queued
+}
+
+// Pop takes the oldest message, ok is false when the queue is empty.
+func (q *Queue) Pop() (msg message.Message, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return msg, false
+	}
+	next := q.items[0]
+	q.items[0] = entry{}
+	q.items = q.items[1:]
+	if next.priority != Critical {
+		q.bounded--
+		q.fullSince = time.Time{}
+	}
+	return next.msg, true
+}
+
+// Ready receives after a Push, when Pop has something to return.
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// StalledFor is how long the queue has been full without the client taking a
+// message from it.
+func (q *Queue) StalledFor(now time.Time) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.fullSince.IsZero() {
+		return 0
+	}
+	return now.Sub(q.fullSince)
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
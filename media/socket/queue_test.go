@@ -0,0 +1,182 @@
+package socket
+
+import (
+	"mediaserver/media/message"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type push struct {
+	event    string
+	priority Priority
+	key      string
+	want     Result
+}
+
+func TestQueuePush(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		pushes []push
+		// events in the order Pop returns them
+		order []string
+	}{
+		{
+			name: "fifo below the limit",
+			size: 3,
+			pushes: []push{
+				{"a", Normal, "", Queued},
+				{"b", Critical, "", Queued},
+				{"c", Latest, "stats", Queued},
+			},
+			order: []string{"a", "b", "c"},
+		},
+		{
+			name: "normal dropped when full",
+			size: 2,
+			pushes: []push{
+				{"a", Normal, "", Queued},
+				{"b", Normal, "", Queued},
+				{"c", Normal, "", Dropped},
+			},
+			order: []string{"a", "b"},
+		},
+		{
+			name: "critical queued over the limit",
+			size: 1,
+			pushes: []push{
+				{"a", Normal, "", Queued},
+				{"offer", Critical, "", Queued},
+				{"candidate", Critical, "", Queued},
+				{"b", Normal, "", Dropped},
+			},
+			order: []string{"a", "offer", "candidate"},
+		},
+		{
+			name: "critical overflows at four times the size",
+			size: 1,
+			pushes: []push{
+				{"c1", Critical, "", Queued},
+				{"c2", Critical, "", Queued},
+				{"c3", Critical, "", Queued},
+				{"c4", Critical, "", Queued},
+				{"c5", Critical, "", Overflow},
+			},
+			order: []string{"c1", "c2", "c3", "c4"},
+		},
+		{
+			name: "critical does not take the room of normal messages",
+			size: 1,
+			pushes: []push{
+				{"offer", Critical, "", Queued},
+				{"a", Normal, "", Queued},
+			},
+			order: []string{"offer", "a"},
+		},
+		{
+			name: "latest replaces in place",
+			size: 3,
+			pushes: []push{
+				{"stats-1", Latest, "stats", Queued},
+				{"a", Normal, "", Queued},
+				{"stats-2", Latest, "stats", Coalesced},
+			},
+			order: []string{"stats-2", "a"},
+		},
+		{
+			name: "latest keys are separate",
+			size: 3,
+			pushes: []push{
+				{"alice-1", Latest, "alice", Queued},
+				{"bob-1", Latest, "bob", Queued},
+				{"alice-2", Latest, "alice", Coalesced},
+			},
+			order: []string{"alice-2", "bob-1"},
+		},
+		{
+			name: "latest coalesces when full",
+			size: 1,
+			pushes: []push{
+				{"stats-1", Latest, "stats", Queued},
+				{"stats-2", Latest, "stats", Coalesced},
+				{"other", Latest, "other", Dropped},
+			},
+			order: []string{"stats-2"},
+		},
+		{
+			name: "latest does not replace other priorities",
+			size: 3,
+			pushes: []push{
+				{"normal", Normal, "stats", Queued},
+				{"stats", Latest, "stats", Queued},
+			},
+			order: []string{"normal", "stats"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQueue(tt.size)
+			for _, p := range tt.pushes {
+				if got := q.Push(message.Message{Event: p.event}, p.priority, p.key); got != p.want {
+					t.Fatalf("Push(%s) = %v, want %v", p.event, got, p.want)
+				}
+			}
+			var order []string
+			for {
+				msg, ok := q.Pop()
+				if !ok {
+					break
+				}
+				order = append(order, msg.Event)
+			}
+			if !reflect.DeepEqual(order, tt.order) {
+				t.Fatalf("popped %v, want %v", order, tt.order)
+			}
+		})
+	}
+}
+
+func TestQueuePopFreesRoom(t *testing.T) {
+	q := NewQueue(1)
+	q.Push(message.Message{Event: "a"}, Normal, "")
+	if got := q.Push(message.Message{Event: "b"}, Normal, ""); got != Dropped {
+		t.Fatalf("Push on a full queue = %v, want Dropped", got)
+	}
+	q.Pop()
+	if got := q.Push(message.Message{Event: "c"}, Normal, ""); got != Queued {
+		t.Fatalf("Push after Pop = %v, want Queued", got)
+	}
+}
+
+func TestQueueStalledFor(t *testing.T) {
+	q := NewQueue(1)
+	if d := q.StalledFor(time.Now()); d != 0 {
+		t.Fatalf("StalledFor on an empty queue = %v", d)
+	}
+	q.Push(message.Message{Event: "a"}, Normal, "")
+	q.Push(message.Message{Event: "b"}, Normal, "")
+	if d := q.StalledFor(time.Now().Add(time.Minute)); d < time.Minute {
+		t.Fatalf("StalledFor a minute after the queue filled = %v", d)
+	}
+	q.Pop()
+	if d := q.StalledFor(time.Now().Add(time.Minute)); d != 0 {
+		t.Fatalf("StalledFor after Pop = %v, want 0", d)
+	}
+}
+
+func TestQueueReady(t *testing.T) {
+	q := NewQueue(2)
+	select {
+	case <-q.Ready():
+		t.Fatal("Ready before any Push")
+	default:
+	}
+	q.Push(message.Message{Event: "a"}, Normal, "")
+	q.Push(message.Message{Event: "b"}, Normal, "")
+	select {
+	case <-q.Ready():
+	default:
+		t.Fatal("not Ready after Push")
+	}
+}
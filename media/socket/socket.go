@@ -0,0 +1,100 @@
+// Package socket holds the settings of the clients' WebSocket connections and
+// the queue of messages waiting to be written to them.
+package socket
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	// messages a client can have waiting, signaling messages go over it
+	// rather than being dropped
+	QueueSize int
+	// how long the queue may stay full before the client is disconnected
+	StallTimeout time.Duration
+	// deadline of each WebSocket write
+	WriteTimeout time.Duration
+	// the server pings every PingInterval and gives up on a connection that
+	// sent nothing, not even a pong, for PongTimeout
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// largest message read from a client, in bytes
+	MaxMessageSize int64
+	// how long a client stays after its WebSocket dropped while its media
+	// still flows, or after its peer connection failed while its WebSocket
+	// is still up
+	DisconnectGrace time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		QueueSize:       256,
+		StallTimeout:    5 * time.Second,
+		WriteTimeout:    10 * time.Second,
+		PingInterval:    25 * time.Second,
+		PongTimeout:     60 * time.Second,
+		MaxMessageSize:  256 << 10,
+		DisconnectGrace: 10 * time.Second,
+	}
+}
+
+// LoadConfig reads the WebSocket settings from configuration keys, get
+// returns "" for unset keys.
+func LoadConfig(get func(key string) string) (Config, error) {
+	c := DefaultConfig()
+	if v := get("WS_SEND_QUEUE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return c, fmt.Errorf("WS_SEND_QUEUE_SIZE: %w", err)
+		}
+		c.QueueSize = n
+	}
+	if v := get("WS_MAX_MESSAGE_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return c, fmt.Errorf("WS_MAX_MESSAGE_SIZE: %w", err)
+		}
+		c.MaxMessageSize = n
+	}
+	durations := []struct {
+		key    string
+		target *time.Duration
+	}{
+		{"WS_STALL_TIMEOUT", &c.StallTimeout},
+		{"WS_WRITE_TIMEOUT", &c.WriteTimeout},
+		{"WS_PING_INTERVAL", &c.PingInterval},
+		{"WS_PONG_TIMEOUT", &c.PongTimeout},
+		{"WS_DISCONNECT_GRACE", &c.DisconnectGrace},
+	}
+	for _, d := range durations {
+		if v := get(d.key); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return c, fmt.Errorf("%s: %w", d.key, err)
+			}
+			*d.target = parsed
+		}
+	}
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("socket: send queue size must be positive")
+	}
+	if c.StallTimeout <= 0 || c.WriteTimeout <= 0 {
+		return fmt.Errorf("socket: stall and write timeouts must be positive")
+	}
+	if c.PingInterval <= 0 || c.PongTimeout <= c.PingInterval {
+		return fmt.Errorf("socket: the pong timeout must be longer than the ping interval")
+	}
+	if c.MaxMessageSize < 4<<10 {
+		return fmt.Errorf("socket: max message size must be at least 4096 bytes, offers do not fit below")
+	}
+	if c.DisconnectGrace < 0 {
+		return fmt.Errorf("socket: disconnect grace cannot be negative")
+	}
+	return nil
+}
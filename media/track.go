@@ -0,0 +1,269 @@
+package media
+
+import (
+	"mediaserver/media/keyframe"
+	"regexp"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Track sources a publisher can announce; any other name matching
+// customSource is accepted as a custom source.
+const (
+	SourceCamera      = "camera"
+	SourceMicrophone  = "microphone"
+	SourceScreen      = "screen"
+	SourceScreenAudio = "screen-audio"
+)
+
+var customSource = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+func ValidSource(source string) bool {
+	return customSource.MatchString(source)
+}
+
+// Announcement is what a publisher tells about one of its tracks, before or
+// after the track arrives.
+type Announcement struct {
+	Source string
+	Label  string
+	Muted  bool
+}
+
+// Track is a track published in a room. Its fields are owned by the room.
+type Track struct {
+	ID       string   `json:"trackId"`
+	StreamID string   `json:"streamId"`
+	Owner    string   `json:"userId"`
+	Source   string   `json:"source"`
+	Label    string   `json:"label,omitempty"`
+	Kind     string   `json:"kind"`
+	Mid      string   `json:"mid"`
+	Codec    string   `json:"codec"`
+	Layers   []string `json:"layers,omitempty"`
+	Muted    bool     `json:"muted"`
+
+	Local     *webrtc.TrackLocalStaticRTP `json:"-"`
+	Keyframes *keyframe.Manager           `json:"-"`
+	// fed to the room's mixer, mixed-audio listeners hear it there
+	Mixed bool `json:"-"`
+	// the connection that publishes it, a reconnecting user publishes anew
+	publisher *Client
+	// set while its share is taken over: it is not forwarded, but its
+	// publisher may share it again. A pointer, for the snapshots of Info.
+	parked *atomic.Bool
+}
+
+// Parked tells the forwarder to drop the track's packets; it is safe to call
+// off the room's loop.
+func (t *Track) Parked() bool {
+	return t.parked != nil && t.parked.Load()
+}
+
+// DefaultSource is the source of a track its publisher did not announce.
+func DefaultSource(kind webrtc.RTPCodecType) string {
+	if kind == webrtc.RTPCodecTypeVideo {
+		return SourceCamera
+	}
+	return SourceMicrophone
+}
+
+// Type is the track type of the older new-stream event, "audio", "video" or
+// "screen", also used as the kind label of the forwarding metrics.
+func (t *Track) Type() string {
+	switch t.Source {
+	case SourceMicrophone:
+		return "audio"
+	case SourceCamera:
+		return "video"
+	case SourceScreen, SourceScreenAudio:
+		return t.Source
+	}
+	return t.Kind
+}
+
+// Describe is the payload of the events announcing or updating the track.
+func (t *Track) Describe() map[string]interface{} {
+	d := map[string]interface{}{
+		"userId":   t.Owner,
+		"trackId":  t.ID,
+		"streamId": t.StreamID,
+		"type":     t.Type(),
+		"source":   t.Source,
+		"kind":     t.Kind,
+		"mid":      t.Mid,
+		"codec":    t.Codec,
+		"muted":    t.Muted,
+	}
+	if t.Label != "" {
+		d["label"] = t.Label
+	}
+	if len(t.Layers) > 0 {
+		d["layers"] = t.Layers
+	}
+	return d
+}
+
+// Apply takes the source, label and muted flag of an announcement.
+func (t *Track) Apply(a Announcement) {
+	if a.Source != "" {
+		t.Source = a.Source
+	}
+	t.Label = a.Label
+	t.Muted = a.Muted
+}
+
+// Tracks is the registry of the tracks published in a room. It belongs to the
+// room's loop, like the clients: use it inside Room.Do.
+type Tracks struct {
+	byKey map[trackKey]*Track
+	// screen tracks whose share was taken over, by the same keys
+	parked map[trackKey]*Track
+}
+
+// track IDs come from the browsers, they are only unique per publisher
+type trackKey struct {
+	owner string
+	id    string
+}
+
+func newTracks() *Tracks {
+	return &Tracks{byKey: make(map[trackKey]*Track), parked: make(map[trackKey]*Track)}
+}
+
+// Add registers a track published by c; a track of the same owner and ID is
+// replaced.
+func (ts *Tracks) Add(c *Client, t *Track) {
+	t.Owner, t.publisher = c.UserID, c
+	if t.parked == nil {
+		t.parked = new(atomic.Bool)
+	}
+	ts.byKey[trackKey{t.Owner, t.ID}] = t
+}
+
+func (ts *Tracks) Get(owner, trackID string) *Track {
+	return ts.byKey[trackKey{owner, trackID}]
+}
+
+// Remove unregisters t and tells whether it was still registered; a parked
+// track is forgotten but was already withdrawn.
+func (ts *Tracks) Remove(t *Track) bool {
+	key := trackKey{t.Owner, t.ID}
+	if ts.parked[key] == t {
+		delete(ts.parked, key)
+	}
+	if ts.byKey[key] != t {
+		return false
+	}
+	delete(ts.byKey, key)
+	return true
+}
+
+// removePublisher unregisters the tracks of one connection. Its parked
+// tracks, which nobody receives, are forgotten without being returned.
+func (ts *Tracks) removePublisher(c *Client) []*Track {
+	var removed []*Track
+	for key, t := range ts.parked {
+		if t.publisher == c {
+			delete(ts.parked, key)
+		}
+	}
+	for key, t := range ts.byKey {
+		if t.publisher == c {
+			delete(ts.byKey, key)
+			removed = append(removed, t)
+		}
+	}
+	return removed
+}
+
+// Park unregisters t until its publisher shares it again, see Unpark.
+func (ts *Tracks) Park(t *Track) bool {
+	key := trackKey{t.Owner, t.ID}
+	if ts.byKey[key] != t {
+		return false
+	}
+	delete(ts.byKey, key)
+	ts.parked[key] = t
+	t.parked.Store(true)
+	return true
+}
+
+// Unpark registers again the parked tracks of owner among ids.
+func (ts *Tracks) Unpark(owner string, ids []string) []*Track {
+	var resumed []*Track
+	for _, id := range ids {
+		key := trackKey{owner, id}
+		t, ok := ts.parked[key]
+		if !ok {
+			continue
+		}
+		delete(ts.parked, key)
+		ts.byKey[key] = t
+		t.parked.Store(false)
+		resumed = append(resumed, t)
+	}
+	return resumed
+}
+
+// Of returns the tracks of owner, sorted by ID.
+func (ts *Tracks) Of(owner string) []*Track {
+	var tracks []*Track
+	for _, t := range ts.byKey {
+		if t.Owner == owner {
+			tracks = append(tracks, t)
+		}
+	}
+	sortTracks(tracks)
+	return tracks
+}
+
+// All returns every track, sorted by owner and ID.
+func (ts *Tracks) All() []*Track {
+	tracks := make([]*Track, 0, len(ts.byKey))
+	for _, t := range ts.byKey {
+		tracks = append(tracks, t)
+	}
+	sortTracks(tracks)
+	return tracks
+}
+
+// Publishing tells whether owner has tracks registered.
+func (ts *Tracks) Publishing(owner string) bool {
+	for key := range ts.byKey {
+		if key.owner == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// Publishers counts the users with tracks registered.
+func (ts *Tracks) Publishers() int {
+	owners := map[string]bool{}
+	for key := range ts.byKey {
+		owners[key.owner] = true
+	}
+	return len(owners)
+}
+
+// ByLocal finds the track forwarded through local.
+func (ts *Tracks) ByLocal(local webrtc.TrackLocal) *Track {
+	for _, t := range ts.byKey {
+		if webrtc.TrackLocal(t.Local) == local {
+			return t
+		}
+	}
+	return nil
+}
+
+func sortTracks(tracks []*Track) {
+	sort.Slice(tracks, func(i, j int) bool {
+		if tracks[i].Owner != tracks[j].Owner {
+			return tracks[i].Owner < tracks[j].Owner
+		}
+		return tracks[i].ID < tracks[j].ID
+	})
+}
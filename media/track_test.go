@@ -0,0 +1,48 @@
+package media
+
+import "testing"
+
+func TestTracksParkAndUnpark(t *testing.T) {
+	c := &Client{UserID: "dave"}
+	ts := newTracks()
+	screen := &Track{ID: "screen", Source: SourceScreen}
+	camera := &Track{ID: "camera", Source: SourceCamera}
+	ts.Add(c, screen)
+	ts.Add(c, camera)
+
+	if !ts.Park(screen) || !screen.Parked() {
+		t.Fatal("Park of a registered track failed")
+	}
+	if ts.Park(screen) {
+		t.Error("Park of a parked track succeeded")
+	}
+	if ts.Get("dave", "screen") != nil || len(ts.Of("dave")) != 1 {
+		t.Error("a parked track is still registered")
+	}
+	if resumed := ts.Unpark("dave", []string{"camera", "other"}); len(resumed) != 0 {
+		t.Errorf("Unpark resumed %d tracks that were not parked", len(resumed))
+	}
+	if resumed := ts.Unpark("dave", []string{"screen"}); len(resumed) != 1 || resumed[0] != screen || screen.Parked() {
+		t.Fatalf("Unpark = %v, want the screen track forwarded again", resumed)
+	}
+	if ts.Get("dave", "screen") != screen {
+		t.Error("an unparked track is not registered")
+	}
+
+	ts.Park(screen)
+	if ts.Remove(screen) {
+		t.Error("Remove of a parked track reported it registered")
+	}
+	if resumed := ts.Unpark("dave", []string{"screen"}); len(resumed) != 0 {
+		t.Error("a removed track was unparked")
+	}
+
+	ts.Add(c, screen)
+	ts.Park(screen)
+	if removed := ts.removePublisher(c); len(removed) != 1 || removed[0] != camera {
+		t.Errorf("removePublisher = %v, want only the registered camera", removed)
+	}
+	if resumed := ts.Unpark("dave", []string{"screen"}); len(resumed) != 0 {
+		t.Error("a parked track outlived its publisher")
+	}
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mediaserver"
+
+var (
+	RTPPacketsForwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_packets_forwarded_total",
+		Help:      "RTP packets read from publishers and written to local tracks.",
+	}, []string{"kind"})
+	RTPBytesForwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_bytes_forwarded_total",
+		Help:      "RTP bytes read from publishers and written to local tracks.",
+	}, []string{"kind"})
+	ForwardWriteErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_forward_write_errors_total",
+		Help:      "Errors writing forwarded RTP to local tracks.",
+	}, []string{"kind"})
+	KeyframeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "keyframe_requests_total",
+		Help:      "Keyframe requests (PLI or FIR) for published video by reason and result: sent, failed, or merged into another by the rate limit.",
+	}, []string{"reason", "result"})
+	RenegotiationsAttempted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "renegotiations_attempted_total",
+		Help:      "Server initiated renegotiations.",
+	})
+	RenegotiationsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "renegotiations_failed_total",
+		Help:      "Server initiated renegotiations that failed before the offer was sent.",
+	})
+	webSocketMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_messages_total",
+		Help:      "WebSocket messages by direction and event type.",
+	}, []string{"direction", "event"})
+	SendDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "send_drops_total",
+		Help:      "Messages not written to a client: closed connection, full queue, or replaced by a newer report.",
+	}, []string{"reason"})
+	RateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_rate_limited_total",
+		Help:      "Client messages dropped because the client went over its message rate.",
+	})
+	SlowConsumers = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slow_consumer_disconnects_total",
+		Help:      "Clients disconnected because their send queue stayed full.",
+	})
+	DeadPeers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dead_peer_disconnects_total",
+		Help:      "Clients removed because their WebSocket (websocket) or their peer connection (media) died.",
+	}, []string{"cause"})
+	TimeToFirstFrame = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_first_frame_seconds",
+		Help:      "Time from a participant's WebSocket join to the first media packet sent to it.",
+		Buckets:   []float64{0.25, 0.5, 1, 1.5, 2, 3, 5, 8, 13, 20},
+	}, []string{"kind"})
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook deliveries by event type and result (delivered, failed or dropped on a full queue).",
+	}, []string{"event", "result"})
+)
+
+// events we label by name, anything else a client sends is counted as "other"
+// so a misbehaving client cannot blow up the label set
+var knownEvents = map[string]bool{
+	"offer": true, "answer": true, "ice-candidate": true, "switch-camera-micro": true,
+	"start-share": true, "stop-share": true, "user-join": true,
+	"user-leave": true, "new-stream": true, "get-all-user-states": true, "joined": true,
+	"error": true, "audio-mode": true, "system-message": true, "connection-quality": true,
+	"get-attendance": true, "attendance": true, "announce-track": true, "describe-tracks": true,
+	"tracks": true, "track-updated": true, "track-removed": true, "share-taken-over": true,
+	"lobby-waiting": true, "lobby-join-request": true, "lobby-left": true, "lobby-mode": true,
+	"admit": true, "deny": true, "set-lobby": true, "lock-room": true, "unlock-room": true,
+	"room-settings": true, "create-breakouts": true, "move-participant": true, "close-breakouts": true,
+	"broadcast-breakouts": true, "breakouts": true, "breakouts-closed": true, "moved": true,
+}
+
+func WebSocketMessage(direction string, event string) {
+	if !knownEvents[event] {
+		event = "other"
+	}
+	webSocketMessages.WithLabelValues(direction, event).Inc()
+}
+
+// Snapshot is the current state of the SFU, taken on every scrape.
+type Snapshot struct {
+	Rooms            int
+	Participants     int
+	PeerConnections  map[string]int
+	PublishedTracks  map[string]int
+	SubscribedTracks map[string]int
+}
+
+var (
+	roomsDesc            = prometheus.NewDesc(namespace+"_rooms", "Open rooms.", nil, nil)
+	participantsDesc     = prometheus.NewDesc(namespace+"_participants", "Connected participants.", nil, nil)
+	peerConnectionsDesc  = prometheus.NewDesc(namespace+"_peer_connections", "Peer connections by state.", []string{"state"}, nil)
+	publishedTracksDesc  = prometheus.NewDesc(namespace+"_published_tracks", "Tracks published to the SFU by kind.", []string{"kind"}, nil)
+	subscribedTracksDesc = prometheus.NewDesc(namespace+"_subscribed_tracks", "Tracks forwarded to subscribers by kind.", []string{"kind"}, nil)
+)
+
+type stateCollector struct {
+	snapshot func() Snapshot
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roomsDesc
+	ch <- participantsDesc
+	ch <- peerConnectionsDesc
+	ch <- publishedTracksDesc
+	ch <- subscribedTracksDesc
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.snapshot()
+	ch <- prometheus.MustNewConstMetric(roomsDesc, prometheus.GaugeValue, float64(s.Rooms))
+	ch <- prometheus.MustNewConstMetric(participantsDesc, prometheus.GaugeValue, float64(s.Participants))
+	for state, n := range s.PeerConnections {
+		ch <- prometheus.MustNewConstMetric(peerConnectionsDesc, prometheus.GaugeValue, float64(n), state)
+	}
+	for kind, n := range s.PublishedTracks {
+		ch <- prometheus.MustNewConstMetric(publishedTracksDesc, prometheus.GaugeValue, float64(n), kind)
+	}
+	for kind, n := range s.SubscribedTracks {
+		ch <- prometheus.MustNewConstMetric(subscribedTracksDesc, prometheus.GaugeValue, float64(n), kind)
+	}
+}
+
+// RegisterState exposes the gauges computed by snapshot at scrape time.
+func RegisterState(snapshot func() Snapshot) {
+	prometheus.MustRegister(stateCollector{snapshot: snapshot})
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
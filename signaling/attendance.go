@@ -0,0 +1,59 @@
+package signaling
+
+import (
+	"errors"
+	"mediaserver/history"
+	"mediaserver/media"
+	"mediaserver/media/message"
+	"strings"
+)
+
+// handleGetAttendance answers a host with the attendance of the current room
+// session, as rows and, when the payload asks for "format": "csv", as the CSV
+// report teachers submit.
+func handleGetAttendance(client *media.Client, room *media.Room, payload map[string]interface{}) {
+	if !client.IsHost() {
+		sendError(client, "not-allowed", errors.New("only hosts can get the attendance"))
+		return
+	}
+	asCSV := payload["format"] == "csv"
+	started := history.Query(func(s history.Store) {
+		rows, err := s.Attendance(history.Filter{SessionID: room.SessionID})
+		if err != nil {
+			clientLogger(client).Warn("attendance query failed", "error", err)
+			sendError(client, "attendance-unavailable", err)
+			return
+		}
+		// talk time is stored when a participant leaves, the ones still here
+		// report theirs live
+		present := map[string]*media.Client{}
+		for _, other := range room.Clients() {
+			present[other.AttendanceID] = other
+		}
+		for i := range rows {
+			if other := present[rows[i].ID]; other != nil {
+				rows[i].TalkSeconds = other.Talk.Total().Seconds()
+			}
+		}
+
+		reply := map[string]interface{}{
+			"sessionId":  room.SessionID,
+			"attendance": rows,
+		}
+		if asCSV {
+			var report strings.Builder
+			if err := history.WriteAttendanceCSV(&report, rows); err == nil {
+				reply["csv"] = report.String()
+			}
+		}
+		client.SafeSend(message.Message{
+			Event:   "attendance",
+			UserID:  client.UserID,
+			RoomID:  room.ID,
+			Payload: reply,
+		})
+	})
+	if !started {
+		sendError(client, "attendance-unavailable", errors.New("attendance history is disabled or busy"))
+	}
+}
@@ -0,0 +1,457 @@
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"mediaserver/history"
+	"mediaserver/media"
+	"mediaserver/media/message"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// a class is rarely split in more groups
+const maxBreakouts = 50
+
+var (
+	errNotParticipant = errors.New("the user is not in this room or its breakout rooms")
+	errUnknownRoom    = errors.New("the room is neither this room nor one of its breakout rooms")
+)
+
+// handleCreateBreakouts lets a host split the room into breakout rooms:
+// "rooms" is their names or how many, "duration" the seconds before everyone
+// is brought back, 0 for until a host closes them, and "assignments" moves
+// users right away, by user ID to the room number starting at 1.
+func handleCreateBreakouts(client *media.Client, room *media.Room, payload map[string]interface{}) {
+	if !requireHost(client, "create breakout rooms") {
+		return
+	}
+	main := mainRoom(room)
+	names, duration, err := parseBreakouts(payload)
+	if err != nil {
+		sendError(client, "invalid-breakouts", err)
+		return
+	}
+	var open bool
+	main.Do(func(map[string]*media.Client) { open = main.Breakouts != nil })
+	if open {
+		sendError(client, "breakouts-open", media.ErrBreakoutsOpen)
+		return
+	}
+	breakouts, err := media.OpenBreakouts(main, names, currentConfig().Rooms.MaxRooms, func(r *media.Room) {
+		r.CodecPolicy = main.CodecPolicy
+		r.Shares.Policy = currentConfig().Share
+		// nobody joins a breakout room directly, hosts move them in
+		r.Settings.Locked = true
+	})
+	if errors.Is(err, media.ErrTooManyRooms) {
+		sendError(client, "too-many-rooms", err)
+		return
+	} else if err != nil {
+		sendError(client, "breakouts-failed", err)
+		return
+	}
+	var info []media.BreakoutInfo
+	var endsAt time.Time
+	open = false
+	stored := main.Do(func(map[string]*media.Client) {
+		if open = main.Breakouts != nil; open {
+			return
+		}
+		main.Breakouts = breakouts
+		breakouts.SetTimer(duration, func() { closeBreakouts(main, breakouts, "time is up") })
+		info, endsAt = breakouts.Info(), breakouts.EndsAt
+	})
+	if !stored || open {
+		// another host was faster, or the room closed meanwhile
+		for _, b := range breakouts.Rooms {
+			b.Room.Close("breakout rooms not needed")
+		}
+		sendError(client, "breakouts-open", media.ErrBreakoutsOpen)
+		return
+	}
+	clientLogger(client).Info("breakout rooms created", "rooms", len(info), "duration", duration)
+	msg := breakoutsMessage(main, info, endsAt)
+	msg.UserID = client.UserID
+	client.SafeSend(msg)
+	main.Broadcast(&msg)
+
+	assignments, _ := payload["assignments"].(map[string]interface{})
+	for userID, v := range assignments {
+		n, ok := v.(float64)
+		if !ok || n < 1 || n > float64(len(breakouts.Rooms)) || n != math.Trunc(n) {
+			sendError(client, "invalid-breakouts", fmt.Errorf("the assignment of %s must be a room number from 1 to %d", userID, len(breakouts.Rooms)))
+			continue
+		}
+		moveParticipant(client, main, userID, breakouts.Rooms[int(n)-1].Room)
+	}
+}
+
+// sendBreakouts gives a client joining a room split into breakout rooms the
+// rooms it may be moved to.
+func sendBreakouts(client *media.Client, room *media.Room) {
+	var info []media.BreakoutInfo
+	var endsAt time.Time
+	room.Do(func(map[string]*media.Client) {
+		if room.Breakouts != nil {
+			info, endsAt = room.Breakouts.Info(), room.Breakouts.EndsAt
+		}
+	})
+	if info != nil {
+		client.SafeSend(breakoutsMessage(room, info, endsAt))
+	}
+}
+
+func breakoutsMessage(main *media.Room, info []media.BreakoutInfo, endsAt time.Time) message.Message {
+	msg := message.Message{
+		Event:  "breakouts",
+		RoomID: main.ID,
+		Payload: map[string]interface{}{
+			"rooms": info,
+		},
+	}
+	if !endsAt.IsZero() {
+		msg.Payload["endsAt"] = endsAt
+	}
+	return msg
+}
+
+// handleMoveParticipant lets a host move "userId" to "roomId", the main room
+// or one of its breakout rooms.
+func handleMoveParticipant(client *media.Client, room *media.Room, payload map[string]interface{}) {
+	if !requireHost(client, "move participants") {
+		return
+	}
+	main := mainRoom(room)
+	userID, _ := payload["userId"].(string)
+	roomID, _ := payload["roomId"].(string)
+	to := main
+	if roomID != main.ID {
+		var found bool
+		main.Do(func(map[string]*media.Client) {
+			if main.Breakouts != nil {
+				to, found = main.Breakouts.Find(roomID)
+			}
+		})
+		if !found {
+			sendError(client, "unknown-room", errUnknownRoom)
+			return
+		}
+	}
+	moveParticipant(client, main, userID, to)
+}
+
+// handleCloseBreakouts lets a host bring everyone back to the main room.
+func handleCloseBreakouts(client *media.Client, room *media.Room) {
+	if !requireHost(client, "close breakout rooms") {
+		return
+	}
+	main := mainRoom(room)
+	var breakouts *media.Breakouts
+	main.Do(func(map[string]*media.Client) { breakouts = main.Breakouts })
+	if breakouts == nil {
+		sendError(client, "no-breakouts", errors.New("the room has no breakout rooms"))
+		return
+	}
+	clientLogger(client).Info("closing breakout rooms")
+	closeBreakouts(main, breakouts, "closed by a host")
+}
+
+// handleBroadcastBreakouts lets a host send "text" to everyone in the main
+// room and its breakout rooms.
+func handleBroadcastBreakouts(client *media.Client, room *media.Room, payload map[string]interface{}) {
+	if !requireHost(client, "message every breakout room") {
+		return
+	}
+	text, _ := payload["text"].(string)
+	if text == "" {
+		sendError(client, "invalid-message", errors.New("text must not be empty"))
+		return
+	}
+	msg := message.Message{
+		Event:  "system-message",
+		UserID: client.UserID,
+		Payload: map[string]interface{}{
+			"text":  text,
+			"level": "info",
+			"from":  client.UserID,
+		},
+	}
+	for _, r := range family(mainRoom(room)) {
+		inRoom := msg
+		inRoom.RoomID = r.ID
+		r.Broadcast(&inRoom)
+	}
+	msg.RoomID = room.ID
+	client.SafeSend(msg)
+}
+
+// closeBreakouts moves everyone in the breakout rooms back to main and closes
+// them, once, whether a host or the timer asks first.
+func closeBreakouts(main *media.Room, breakouts *media.Breakouts, reason string) {
+	var closing bool
+	main.Do(func(map[string]*media.Client) { closing = main.Breakouts == breakouts && breakouts.Close() })
+	if !closing {
+		return
+	}
+	for _, b := range breakouts.Rooms {
+		for _, c := range b.Room.Clients() {
+			if err := moveClient(c, main); err != nil {
+				clientLogger(c).Warn("move back to the main room failed", "error", err)
+			}
+		}
+		b.Room.Close(reason)
+	}
+	// the main room stays open while it has breakout rooms
+	main.Do(func(map[string]*media.Client) { main.Breakouts = nil })
+	main.Log.Info("breakout rooms closed", "reason", reason)
+	main.Broadcast(&message.Message{
+		Event:  "breakouts-closed",
+		RoomID: main.ID,
+		Payload: map[string]interface{}{
+			"reason": reason,
+		},
+	})
+	main.CloseIfEmpty()
+}
+
+// closeIfEmpty closes room once its last client left. A room with breakout
+// rooms, or one of them, only closes with the others once all are empty.
+func closeIfEmpty(room *media.Room) {
+	if room.CloseIfEmpty() {
+		return
+	}
+	main := mainRoom(room)
+	var breakouts *media.Breakouts
+	main.Do(func(map[string]*media.Client) { breakouts = main.Breakouts })
+	if breakouts == nil {
+		return
+	}
+	for _, r := range family(main) {
+		if len(r.Clients()) > 0 {
+			return
+		}
+	}
+	closeBreakouts(main, breakouts, "empty")
+}
+
+// moveParticipant moves userID, wherever it is in main and its breakout rooms,
+// to the room to, on behalf of the host client.
+func moveParticipant(host *media.Client, main *media.Room, userID string, to *media.Room) {
+	var participant *media.Client
+	for _, r := range family(main) {
+		if c, ok := r.Client(userID); ok {
+			participant = c
+			break
+		}
+	}
+	if participant == nil {
+		sendError(host, "not-found", errNotParticipant)
+		return
+	}
+	if err := moveClient(participant, to); err != nil {
+		sendError(host, "move-failed", err)
+		return
+	}
+	clientLogger(host).Info("participant moved", "participant", userID, "to", to.ID)
+}
+
+// moveClient moves the client to the room to over its current WebSocket and
+// peer connection. Its tracks and share leave the old room, its subscriptions
+// there are dropped, and in the new room its tracks reach the others and it
+// gets theirs, in a single renegotiation.
+func moveClient(client *media.Client, to *media.Room) error {
+	client.Moving.Lock()
+	defer client.Moving.Unlock()
+	select {
+	case <-client.Done:
+		return media.ErrRoomClosed
+	default:
+	}
+	from := client.Room()
+	if from == to {
+		return nil
+	}
+	log := clientLogger(client)
+
+	var pc *webrtc.PeerConnection
+	var current bool
+	from.Do(func(clients map[string]*media.Client) {
+		current = clients[client.UserID] == client
+		pc = client.PeerConn
+	})
+	if !current {
+		return errNotParticipant
+	}
+
+	// the tracks go on being forwarded, only their viewers change
+	var tracks []*media.Track
+	var sharing bool
+	withdraw(from, client.UserID, func() []*media.Track {
+		tracks = from.Tracks.Of(client.UserID)
+		for _, t := range tracks {
+			from.Tracks.Remove(t)
+		}
+		sharing = from.Shares.Stop(client.UserID)
+		return tracks
+	})
+	if current, _ := from.Leave(client); !current {
+		return errNotParticipant
+	}
+	from.Mixer.RemoveSink(client.UserID)
+	from.Mixer.RemoveSource(client.UserID)
+	now := time.Now()
+	if sharing {
+		history.ShareStopped(from.SessionID, client.UserID, now)
+		from.Broadcast(&message.Message{
+			Event:   "stop-share",
+			UserID:  client.UserID,
+			RoomID:  from.ID,
+			Payload: map[string]interface{}{},
+		})
+	}
+	from.Broadcast(&message.Message{
+		Event:  "user-leave",
+		UserID: client.UserID,
+		RoomID: from.ID,
+		Payload: map[string]interface{}{
+			"movedTo": to.ID,
+		},
+	})
+	if pc != nil {
+		for _, sender := range pc.GetSenders() {
+			if sender.Track() != nil {
+				_ = pc.RemoveTrack(sender)
+			}
+		}
+	}
+
+	replaced, participants, ok := to.Transfer(client)
+	if !ok {
+		client.Kick("the room was closed")
+		return media.ErrRoomClosed
+	}
+	if replaced != nil && replaced != client {
+		clientLogger(replaced).Info("connection replaced by a moved one")
+		replaced.Kick("replaced by a newer connection")
+	}
+	log.Info("moved", "from", from.ID, "to", to.ID, "participants", participants)
+	parentID := ""
+	if to.Parent != nil {
+		parentID = to.Parent.ID
+	}
+	client.SafeSend(message.Message{
+		Event:  "moved",
+		UserID: client.UserID,
+		RoomID: to.ID,
+		Payload: map[string]interface{}{
+			"roomId":   to.ID,
+			"parentId": parentID,
+		},
+	})
+
+	var described []map[string]interface{}
+	var camState, micState, subscribed bool
+	var clientsToRenegotiate []subscriber
+	to.Do(func(clients map[string]*media.Client) {
+		client.MixedTrack = nil
+		camState, micState = client.IsCamOn, client.IsMicOn
+		for _, t := range tracks {
+			to.Tracks.Add(client, t)
+			described = append(described, t.Describe())
+			clientsToRenegotiate = append(clientsToRenegotiate, subscribeOthers(clients, t)...)
+		}
+		if pc != nil {
+			subscribed = subscribeToRoom(client, to, pc)
+		}
+	})
+	to.Broadcast(&message.Message{
+		Event:  "user-join",
+		UserID: client.UserID,
+		RoomID: to.ID,
+		Payload: map[string]interface{}{
+			"camState":  camState,
+			"micState":  micState,
+			"movedFrom": from.ID,
+		},
+	})
+	for _, d := range described {
+		to.Broadcast(&message.Message{
+			Event:   "new-stream",
+			UserID:  client.UserID,
+			RoomID:  to.ID,
+			Payload: d,
+		})
+	}
+	sendUserStates(client, to)
+
+	// each viewer renegotiates once even if it got several tracks
+	seen := map[*media.Client]bool{}
+	for _, other := range clientsToRenegotiate {
+		if !seen[other.client] {
+			seen[other.client] = true
+			go renegotiate(other.client, other.pc)
+		}
+	}
+	// the subscriptions to the old room are gone whether or not the new one
+	// has tracks
+	if pc != nil {
+		log.Debug("renegotiating after the move", "subscribed", subscribed)
+		go renegotiate(client, pc)
+	}
+	return nil
+}
+
+// mainRoom is the room a breakout room was split from, or room itself.
+func mainRoom(room *media.Room) *media.Room {
+	if room.Parent != nil {
+		return room.Parent
+	}
+	return room
+}
+
+// family is main and its breakout rooms.
+func family(main *media.Room) []*media.Room {
+	rooms := []*media.Room{main}
+	main.Do(func(map[string]*media.Client) {
+		if main.Breakouts != nil {
+			for _, b := range main.Breakouts.Rooms {
+				rooms = append(rooms, b.Room)
+			}
+		}
+	})
+	return rooms
+}
+
+// parseBreakouts reads the names of the breakout rooms, given as a list or a
+// count, and their duration.
+func parseBreakouts(payload map[string]interface{}) ([]string, time.Duration, error) {
+	var names []string
+	switch rooms := payload["rooms"].(type) {
+	case float64:
+		if rooms != math.Trunc(rooms) || rooms < 1 || rooms > maxBreakouts {
+			return nil, 0, fmt.Errorf("rooms must be from 1 to %d", maxBreakouts)
+		}
+		for i := 1; i <= int(rooms); i++ {
+			names = append(names, fmt.Sprintf("Room %d", i))
+		}
+	case []interface{}:
+		names = stringList(rooms)
+		if len(names) == 0 || len(names) != len(rooms) || len(names) > maxBreakouts {
+			return nil, 0, fmt.Errorf("rooms must be from 1 to %d names", maxBreakouts)
+		}
+	default:
+		return nil, 0, errors.New("rooms must be a count or a list of names")
+	}
+	var duration time.Duration
+	if v, ok := payload["duration"]; ok {
+		seconds, isNumber := v.(float64)
+		if !isNumber || seconds < 0 || seconds > (24*time.Hour).Seconds() {
+			return nil, 0, errors.New("duration must be from 0 to 86400 seconds")
+		}
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+	return names, duration, nil
+}
@@ -1,109 +1,162 @@
 package signaling
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"mediaserver/history"
 	"mediaserver/media"
+	"mediaserver/media/activity"
+	"mediaserver/media/keyframe"
 	"mediaserver/media/message"
+	"mediaserver/media/quality"
+	"mediaserver/metrics"
+	"mediaserver/tracing"
+	"mediaserver/webhook"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pion/interceptor"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 func handleClientJoin(client *media.Client, room *media.Room) {
-	log.Println("Handle join")
-	room.Mu.Lock()
-	defer func() {
-		room.Mu.Unlock()
-		if r := recover(); r != nil {
-		}
-		log.Println("Unlock")
-	}()
-	if room.Clients[client.UserID] != nil {
-		delete(room.Clients, client.UserID)
+	span := startSpan(client, "signaling.handleClientJoin")
+	defer span.End()
+	client.ICEServers = currentConfig().ICE.ServersFor(client.UserID)
+	client.SafeSend(message.Message{
+		Event:  "joined",
+		UserID: client.UserID,
+		RoomID: room.ID,
+		Payload: map[string]interface{}{
+			"iceServers": client.ICEServers,
+			// whether the server trusts the client's host role
+			"host": client.IsHost(),
+		},
+	})
+	replaced, participants, ok := room.Join(client)
+	if !ok {
+		client.Kick("the room was closed")
+		return
 	}
-	room.Clients[client.UserID] = client
-	room.MsgChan <- &message.Message{
+	if replaced != nil {
+		clientLogger(replaced).Info("connection replaced by a newer one")
+		replaced.Kick("replaced by a newer connection")
+	}
+	clientLogger(client).Info("joined room", "participants", participants)
+	history.Joined(history.Attendance{
+		ID:        client.AttendanceID,
+		SessionID: room.SessionID,
+		RoomID:    room.ID,
+		UserID:    client.UserID,
+		Role:      client.Role,
+		JoinedAt:  client.JoinedAt,
+	})
+	webhook.Emit(webhook.ParticipantJoined, room.ID, client.UserID, map[string]interface{}{
+		"role":     client.Role,
+		"camState": client.IsCamOn,
+		"micState": client.IsMicOn,
+	})
+	room.Broadcast(&message.Message{
 		Event:  "user-join",
 		UserID: client.UserID,
 		Payload: map[string]interface{}{
 			"camState": client.IsCamOn,
 			"micState": client.IsMicOn,
 		},
+	})
+	if client.IsHost() {
+		sendLobby(client, room)
 	}
-	go handleSignaling(client, room)
+	sendBreakouts(client, room)
+	go handleSignaling(client)
 }
 
-func handleSignaling(client *media.Client, room *media.Room) {
-	log.Println("Handle signaling")
+// handleSignaling serves the client's messages in the room it is in, which
+// changes when a host moves it to or from a breakout room.
+func handleSignaling(client *media.Client) {
+	log := clientLogger(client)
+	// set once by this goroutine, and in the room for the others
+	var pc *webrtc.PeerConnection
 	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Recovered from send panic:", r)
-		}
-		room.Mu.Lock()
-		handleDisconnect(client, room)
-		room.Mu.Unlock()
+		awaitReconnect(client, client.Room(), pc)
+		// a move finishes first, or sees the client closed and gives up
+		client.Moving.Lock()
+		room := client.Room()
+		handleDisconnect(client, room, pc)
+		client.Moving.Unlock()
+		closeIfEmpty(room)
 	}()
+	var limit limiter
+	var limited bool
 	for msg := range client.Read {
-		log.Println(client.UserID, " read : ", msg.Event)
+		rate := currentConfig().RateLimit
+		if !limit.allow(time.Now(), rate.MessageRate, rate.MessageBurst) {
+			metrics.RateLimited.Inc()
+			// told once per run of dropped messages
+			if !limited {
+				log.Warn("message rate exceeded", "event", msg.Event)
+				sendError(client, "rate-limited", errRateLimited)
+			}
+			limited = true
+			continue
+		}
+		limited = false
+		log.Debug("message received", "event", msg.Event)
+		room := client.Room()
 		switch msg.Event {
 		case "offer":
 			offer, ok := msg.Payload["offer"].(map[string]interface{})
 			if !ok {
-				log.Println("Error to convert offer")
+				log.Warn("offer without sdp", "event", msg.Event)
 				return
 			}
 			sdpStr, _ := offer["sdp"].(string)
-			if client.PeerConn == nil {
-				err := CreatePeerConnection(client, room, &msg.Payload)
+			if err := room.CodecPolicy.CheckOffer(sdpStr); err != nil {
+				log.Info("offer rejected", "error", err)
+				sendError(client, "unsupported-codec", err)
+				continue
+			}
+			if streams, ok := msg.Payload["streams"].([]interface{}); ok {
+				announceStreams(client, room, streams)
+			}
+			if pc == nil {
+				span := startSpan(client, "webrtc.CreatePeerConnection")
+				var err error
+				pc, err = CreatePeerConnection(client, room, sdpStr)
+				endSpan(span, err)
 				if err != nil {
-					log.Println("CreatePeerConnection error:", err)
+					log.Error("peer connection setup failed", "error", err)
 					continue
 				}
 			} else {
-				data := msg.Payload
-				if data != nil {
-					streams, ok := data["streams"].([]interface{})
-					if ok {
-						*client.Streams = streams
-					}
-				}
-
 				offer := webrtc.SessionDescription{
 					Type: webrtc.SDPTypeOffer,
 					SDP:  sdpStr,
 				}
 
-				err := client.PeerConn.SetRemoteDescription(offer)
+				client.Negotiation.Lock()
+				err := answerOffer(pc, offer)
+				client.Negotiation.Unlock()
 				if err != nil {
-					log.Println("SetRemoteDescription error:", err)
-					continue
-				}
-
-				answer, err := client.PeerConn.CreateAnswer(nil)
-				if err != nil {
-					log.Println("CreateAnswer error:", err)
-					continue
-				}
-
-				err = client.PeerConn.SetLocalDescription(answer)
-				if err != nil {
-					log.Println("SetLocalDescription error:", err)
+					log.Warn("answer offer failed", "error", err)
 					continue
 				}
 
 				client.SafeSend(message.Message{
 					Event: "answer",
 					Payload: map[string]interface{}{
-						"sdp": client.PeerConn.LocalDescription(),
+						"sdp": pc.LocalDescription(),
 					},
 				})
 			}
 
 		case "ice-candidate":
-			if client.PeerConn == nil {
+			if pc == nil {
 				continue
 			}
 
@@ -111,22 +164,24 @@ func handleSignaling(client *media.Client, room *media.Room) {
 			if !ok {
 				return
 			}
+			candidateStr, _ := candMap["candidate"].(string)
 			spdMid, _ := candMap["sdpMid"].(string)
-			sdpMLineIndex := uint16(candMap["sdpMLineIndex"].(float64))
+			lineIndex, _ := candMap["sdpMLineIndex"].(float64)
+			sdpMLineIndex := uint16(lineIndex)
 
 			candidate := webrtc.ICECandidateInit{
-				Candidate:     candMap["candidate"].(string),
+				Candidate:     candidateStr,
 				SDPMid:        &spdMid,
 				SDPMLineIndex: &sdpMLineIndex,
 			}
-			err := client.PeerConn.AddICECandidate(candidate)
+			err := pc.AddICECandidate(candidate)
 			if err != nil {
-				log.Println("AddICECandidate error:", err)
+				log.Warn("add ICE candidate failed", "error", err)
 			}
 		case "answer":
 			answerData, ok := msg.Payload["sdp"].(string)
 			if !ok {
-				log.Println("Invalid answer payload")
+				log.Warn("answer without sdp", "event", msg.Event)
 				return
 			}
 
@@ -135,109 +190,166 @@ func handleSignaling(client *media.Client, room *media.Room) {
 				SDP:  answerData,
 			}
 
-			if client.PeerConn == nil {
-				log.Println("PeerConn is nil when handling answer")
+			if pc == nil {
+				log.Warn("answer before any offer", "event", msg.Event)
 				return
 			}
 
-			err := client.PeerConn.SetRemoteDescription(answer)
+			client.Negotiation.Lock()
+			err := pc.SetRemoteDescription(answer)
+			client.Negotiation.Unlock()
+			client.NegotiationSpan.End(attribute.Bool("answer.applied", err == nil))
 			if err != nil {
-				log.Println("SetRemoteDescription (answer) error:", err)
+				log.Warn("set remote answer failed", "error", err)
 				return
 			}
+			// tracks added by the offer only reach the client from now on
+			go requestKeyframes(room, pc, "subscriber")
 
 		case "switch-camera-micro":
-			room.Mu.Lock()
-			client := room.Clients[msg.UserID]
-			room.Mu.Unlock()
-			client.IsCamOn = msg.Payload["camState"].(bool)
-			client.IsMicOn = msg.Payload["micState"].(bool)
-			room.MsgChan <- &message.Message{
+			camState, camOK := msg.Payload["camState"].(bool)
+			micState, micOK := msg.Payload["micState"].(bool)
+			if !camOK || !micOK {
+				log.Warn("media state without camState and micState")
+				continue
+			}
+			room.Do(func(map[string]*media.Client) {
+				client.IsCamOn = camState
+				client.IsMicOn = micState
+				setMediaMuted(room, client)
+			})
+			room.Broadcast(&message.Message{
 				Event:  "switch-camera-micro",
-				UserID: msg.UserID,
+				UserID: client.UserID,
 				Payload: map[string]interface{}{
-					"camState": msg.Payload["camState"].(bool),
-					"micState": msg.Payload["micState"].(bool),
+					"camState": camState,
+					"micState": micState,
 				},
-			}
+			})
 
-		case "request-pli":
-			room.Mu.Lock()
-			userSender := room.Clients[msg.UserID]
-			room.Mu.Unlock()
-			// handleReGetClients(client, room)
-			sendPLIWhenReady(userSender.PeerConn)
 		case "start-share":
-			room.MsgChan <- &message.Message{
-				Event:   "start-share",
-				UserID:  msg.UserID,
-				Payload: map[string]interface{}{},
-			}
+			handleStartShare(client, room, msg.Payload)
 		case "stop-share":
-			room.MsgChan <- &message.Message{
-				Event:   "stop-share",
-				UserID:  msg.UserID,
-				Payload: map[string]interface{}{},
-			}
+			handleStopShare(client, room)
+		case "get-attendance":
+			handleGetAttendance(client, room, msg.Payload)
+		case "announce-track":
+			handleAnnounceTrack(client, room, msg.Payload)
+		case "describe-tracks":
+			handleDescribeTracks(client, room)
+		case "admit", "deny":
+			handleLobbyDecision(client, room, msg.Payload, msg.Event == "admit")
+		case "set-lobby":
+			handleSetLobby(client, room, msg.Payload)
+		case "lock-room", "unlock-room":
+			handleLockRoom(client, room, msg.Event == "lock-room")
+		case "create-breakouts":
+			handleCreateBreakouts(client, room, msg.Payload)
+		case "move-participant":
+			handleMoveParticipant(client, room, msg.Payload)
+		case "close-breakouts":
+			handleCloseBreakouts(client, room)
+		case "broadcast-breakouts":
+			handleBroadcastBreakouts(client, room, msg.Payload)
 		}
 	}
 }
 
-func handleDisconnect(client *media.Client, room *media.Room) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Recovered from send panic:", r)
-		}
-	}()
-	log.Println("Disconnect")
-	if client.PeerConn != nil {
-		for _, sender := range client.PeerConn.GetSenders() {
-			_ = client.PeerConn.RemoveTrack(sender)
+var errRateLimited = errors.New("too many messages, the ones over the limit are dropped")
+
+func sendError(client *media.Client, code string, err error) {
+	client.SafeSend(message.Message{
+		Event: "error",
+		Payload: map[string]interface{}{
+			"code":    code,
+			"message": err.Error(),
+		},
+	})
+}
+
+// requireHost tells whether the client is a verified host; anyone else is
+// told it may not do what.
+func requireHost(client *media.Client, what string) bool {
+	if client.IsHost() {
+		return true
+	}
+	clientLogger(client).Warn("host action refused", "action", what, "role", client.Role)
+	sendError(client, "not-allowed", fmt.Errorf("only hosts can %s", what))
+	return false
+}
+
+func handleDisconnect(client *media.Client, room *media.Room, pc *webrtc.PeerConnection) {
+	clientLogger(client).Info("left room")
+	client.Close()
+	client.JoinSpan.End(attribute.Bool("first_frame", false))
+	client.NegotiationSpan.End()
+	// false when the user already reconnected, the newer connection keeps
+	// its place, mixer sink and share
+	current, removed := room.Leave(client)
+	// the others stop receiving what it published
+	withdraw(room, client.UserID, func() []*media.Track { return removed })
+	if current {
+		room.Mixer.RemoveSink(client.UserID)
+		room.Mixer.RemoveSource(client.UserID)
+	}
+	if pc != nil {
+		for _, sender := range pc.GetSenders() {
+			_ = pc.RemoveTrack(sender)
 		}
-		client.PeerConn.Close()
+		pc.Close()
 	}
-	room.MsgChan <- &message.Message{
-		Event:   "user-leave",
-		UserID:  client.UserID,
-		RoomID:  room.ID,
-		Payload: map[string]interface{}{},
+	now := time.Now()
+	if current {
+		room.Broadcast(&message.Message{
+			Event:   "user-leave",
+			UserID:  client.UserID,
+			RoomID:  room.ID,
+			Payload: map[string]interface{}{},
+		})
+		history.ShareStopped(room.SessionID, client.UserID, now)
 	}
-	client.Conn.Close()
-	delete(room.Clients, client.UserID)
+	history.Left(client.AttendanceID, now, client.Talk.Total())
+	webhook.Emit(webhook.ParticipantLeft, room.ID, client.UserID, map[string]interface{}{
+		"role":     client.Role,
+		"duration": time.Since(client.JoinedAt).Seconds(),
+	})
 }
 
-func CreatePeerConnection(client *media.Client, room *media.Room, payload *map[string]interface{}) error {
-	// log.Println("Create new connection")
-	offer, ok := (*payload)["offer"].(map[string]interface{})
-	if !ok {
-		log.Println("Error to convert offer")
-		return nil
+// CreatePeerConnection answers the client's first offer with a new peer
+// connection, which it returns once the room knows it.
+func CreatePeerConnection(client *media.Client, room *media.Room, offerSDP string) (*webrtc.PeerConnection, error) {
+	log := clientLogger(client)
+	interceptors := currentConfig().Interceptors
+	mediaEngine, err := room.CodecPolicy.WithFeedback(interceptors.Feedback()...).NewMediaEngine()
+	if err != nil {
+		return nil, err
 	}
-	offerSDP, _ := offer["sdp"].(string)
-
-	streams, ok := (*payload)["streams"].([]interface{})
-	if ok {
-		client.Streams = &streams
+	statsConfig := currentConfig().Stats
+	var collector *quality.Collector
+	extra := []interceptor.Factory{tracing.FirstPacket(func(kind string) { firstFrame(client, kind) })}
+	if statsConfig.Enabled() {
+		collector = quality.NewCollector()
+		statsInterceptors, err := collector.Interceptors()
+		if err != nil {
+			return nil, err
+		}
+		extra = append(extra, statsInterceptors...)
+	}
+	registry, err := interceptors.Registry(mediaEngine, extra...)
+	if err != nil {
+		return nil, err
 	}
 
-	mediaEngine := webrtc.MediaEngine{}
-	mediaEngine.RegisterDefaultCodecs()
-
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine))
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(settingEngine),
+	)
 	pc, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			}, {
-				URLs:       []string{"turn:openrelay.metered.ca:80"},
-				Username:   "openrelayproject",
-				Credential: "openrelayproject",
-			},
-		},
+		ICEServers: client.ICEServers,
 	})
 	if err != nil {
-		log.Println("Error to create peerConnection")
-		return err
+		return nil, err
 	}
 
 	err = pc.SetRemoteDescription(webrtc.SessionDescription{
@@ -245,7 +357,8 @@ func CreatePeerConnection(client *media.Client, room *media.Room, payload *map[s
 		SDP:  offerSDP,
 	})
 	if err != nil {
-		return err
+		pc.Close()
+		return nil, err
 	}
 
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
@@ -260,15 +373,30 @@ func CreatePeerConnection(client *media.Client, room *media.Room, payload *map[s
 	})
 	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
-		return err
+		pc.Close()
+		return nil, err
 	}
 
 	err = pc.SetLocalDescription(answer)
 	if err != nil {
-		return err
+		pc.Close()
+		return nil, err
+	}
+	iceSpan := startSpan(client, "ice.connect")
+	var iceDone sync.Once
+	joined := room.Do(func(map[string]*media.Client) {
+		client.PeerConn = pc
+		client.Quality = collector
+	})
+	if !joined {
+		pc.Close()
+		return nil, media.ErrRoomClosed
+	}
+	if collector != nil {
+		go collector.Run(pc, statsConfig.Interval, client.Done, func(report quality.Report) {
+			sendQuality(client, client.Room(), report)
+		})
 	}
-	client.PeerConn = pc
-	client.RoomID = room.ID
 	client.SafeSend(message.Message{
 		Event: "answer",
 		Payload: map[string]interface{}{
@@ -277,364 +405,475 @@ func CreatePeerConnection(client *media.Client, room *media.Room, payload *map[s
 	})
 
 	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		fmt.Printf("SFU: Received %s track from %s\n", remoteTrack.Kind().String(), client.UserID)
-		var typeTrack string
-		for _, stream := range *client.Streams {
-			streamMap, ok := stream.(map[string]interface{})
-			if !ok {
-				continue
-			}
-			if streamMap["trackId"].(string) == remoteTrack.ID() {
-				typeVal, ok := streamMap["type"].(string)
-				if ok {
-					typeTrack = typeVal
+		log.Info("track received", "kind", remoteTrack.Kind().String(), "trackId", remoteTrack.ID(), "rid", remoteTrack.RID(), "codec", remoteTrack.Codec().MimeType)
+		track := newTrack(pc, remoteTrack, receiver)
+		// a move to or from a breakout room finishes before the track is
+		// registered in the room the client is in
+		client.Moving.Lock()
+		defer client.Moving.Unlock()
+		room := client.Room()
+
+		// a simulcast publisher sends a track per layer under the same ID,
+		// the first layer is the one forwarded and the others are only listed
+		var layer bool
+		if rid := remoteTrack.RID(); rid != "" {
+			room.Do(func(map[string]*media.Client) {
+				if published := room.Tracks.Get(client.UserID, track.ID); published != nil {
+					published.Layers = append(published.Layers, rid)
+					layer = true
 				}
-				break
-			}
+			})
 		}
-		// Tạo local track tương ứng cùng kind (audio/video)
+		if layer {
+			go drainTrack(remoteTrack)
+			return
+		}
+
+		// local track of the same kind that every subscriber gets
 		localTrack, err := webrtc.NewTrackLocalStaticRTP(
 			remoteTrack.Codec().RTPCodecCapability,
 			remoteTrack.ID(),
 			remoteTrack.StreamID())
 		if err != nil {
-			log.Println("SFU: failed to create local track", err)
+			log.Error("create local track failed", "trackId", remoteTrack.ID(), "error", err)
 			return
 		}
-
-		// Lưu track local trong client để giữ tham chiếu lâu dài (quan trọng!)
-		if typeTrack == "audio" {
-			client.AudioTrack = localTrack
-		} else if typeTrack == "video" {
-			client.VideoTrack = localTrack
-		} else if typeTrack == "screen" {
-			client.ScreenTrack = localTrack
+		track.Local = localTrack
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+			track.Keyframes = keyframe.NewManager(currentConfig().Keyframes, pc, remoteTrack)
 		}
-		// Đọc RTP từ remoteTrack, gửi đến localTrack (forward )
+		keyframes := track.Keyframes
+
+		// the room keeps the track so later joiners can subscribe to it, and
+		// every subscriber already here gets it now
+		var described, trackInfo map[string]interface{}
+		var camState, micState bool
+		var clientsToRenegotiate []subscriber
+		var refused bool
+		room.Do(func(clients map[string]*media.Client) {
+			limit := room.Settings.MaxPublishers
+			if limit > 0 && !room.Tracks.Publishing(client.UserID) && room.Tracks.Publishers() >= limit {
+				refused = true
+				return
+			}
+			announce(client, track)
+			// the mixer takes one voice per user, a second microphone is
+			// forwarded to everyone
+			track.Mixed = track.Source == media.SourceMicrophone && track.Codec == webrtc.MimeTypeOpus
+			for _, other := range room.Tracks.Of(client.UserID) {
+				if other.Mixed {
+					track.Mixed = false
+				}
+			}
+			room.Tracks.Add(client, track)
+			described = track.Describe()
+			trackInfo = map[string]interface{}{
+				"trackId": track.ID,
+				"kind":    track.Kind,
+				"type":    track.Type(),
+				"source":  track.Source,
+				"codec":   track.Codec,
+			}
+			camState, micState = client.IsCamOn, client.IsMicOn
+			clientsToRenegotiate = subscribeOthers(clients, track)
+		})
+
+		if refused {
+			log.Info("track refused", "trackId", remoteTrack.ID(), "error", media.ErrTooManyPublishers)
+			if keyframes != nil {
+				keyframes.Close()
+			}
+			sendError(client, "too-many-publishers", media.ErrTooManyPublishers)
+			go drainTrack(remoteTrack)
+			return
+		}
+
+		// forward the RTP read from the publisher to the local track
+		mixAudio := track.Mixed
+		// screen audio is not the user talking
+		talking := trackInfo["source"] == media.SourceMicrophone
+		levelExt := activity.LevelExtension(receiver)
+		metricKind, _ := trackInfo["type"].(string)
+		forwardedPackets := metrics.RTPPacketsForwarded.WithLabelValues(metricKind)
+		forwardedBytes := metrics.RTPBytesForwarded.WithLabelValues(metricKind)
+		webhook.Emit(webhook.TrackPublished, room.ID, client.UserID, trackInfo)
 		go func() {
+			defer webhook.Emit(webhook.TrackUnpublished, room.ID, client.UserID, trackInfo)
+			defer func() {
+				// not while the track is carried to another room
+				client.Moving.Lock()
+				defer client.Moving.Unlock()
+				unpublish(client, client.Room(), track)
+			}()
 			rtpBuf := make([]byte, 4096)
+			rtpPacket := &rtp.Packet{}
 			for {
 				n, _, readErr := remoteTrack.Read(rtpBuf)
 				if readErr != nil {
-					log.Println("remoteTrack.Read error:", readErr)
-					break
-				}
-				// log.Println("SFU: read RTP packet with length", n)
-
-				_, writeErr := localTrack.Write(rtpBuf[:n])
-				if writeErr != nil {
-					log.Println("localTrack.Write error:", writeErr)
+					log.Info("track ended", "trackId", remoteTrack.ID(), "error", readErr)
 					break
 				}
-
-				// log.Printf("SFU: forwarded %d bytes to localTrack (written: %d)\n", n, written)
-			}
-		}()
-
-		// **FIX: Broadcast track to all existing clients and trigger renegotiation**
-		var clientsToRenegotiate []*media.Client
-		func() {
-			room.Mu.Lock()
-			defer room.Mu.Unlock()
-			for _, other := range room.Clients {
-				if other.UserID == client.UserID || other.PeerConn == nil {
+				// read on so the receiver does not fill up
+				if track.Parked() {
 					continue
 				}
-
-				var addedTrack *webrtc.TrackLocalStaticRTP
-				if typeTrack == "audio" {
-					addedTrack = client.AudioTrack
-				} else if typeTrack == "video" {
-					addedTrack = client.VideoTrack
-				} else if typeTrack == "screen" {
-					addedTrack = client.ScreenTrack
-				}
-
-				if addedTrack != nil {
-					_, err := other.PeerConn.AddTrack(addedTrack)
-					if err != nil {
-						log.Printf("SFU: failed to add %s track to %s: %v\n", remoteTrack.Kind().String(), other.UserID, err)
-						continue
+				if talking {
+					if err := rtpPacket.Unmarshal(rtpBuf[:n]); err == nil {
+						client.Talk.Observe(&rtpPacket.Header, levelExt, time.Now())
+						if mixer := client.Room().Mixer; mixAudio && mixer.HasSinks() {
+							mixer.Push(client.UserID, rtpPacket.Payload)
+						}
 					}
-					// Collect clients that need renegotiation
-					clientsToRenegotiate = append(clientsToRenegotiate, other)
+				} else if keyframes != nil {
+					if err := rtpPacket.Unmarshal(rtpBuf[:n]); err == nil {
+						keyframes.Observe(rtpPacket, time.Now())
+					}
+				}
+				_, writeErr := localTrack.Write(rtpBuf[:n])
+				if writeErr != nil {
+					log.Warn("forward failed", "trackId", remoteTrack.ID(), "error", writeErr)
+					metrics.ForwardWriteErrors.WithLabelValues(metricKind).Inc()
+					break
 				}
+				forwardedPackets.Inc()
+				forwardedBytes.Add(float64(n))
 			}
 		}()
 
-		// **FIX: Renegotiate with all existing clients to make them see the new track**
-		for _, otherClient := range clientsToRenegotiate {
-			go renegotiate(otherClient)
+		// renegotiate with the existing clients so they see the new track
+		for _, other := range clientsToRenegotiate {
+			go renegotiate(other.client, other.pc)
 		}
 
-		room.MsgChan <- &message.Message{
-			Event:  "new-stream",
-			UserID: client.UserID,
-			RoomID: room.ID,
-			Payload: map[string]interface{}{
-				"type":     typeTrack,
-				"trackId":  localTrack.ID(),
-				"streamId": localTrack.StreamID(),
-			},
-		}
-		room.MsgChan <- &message.Message{
+		room.Broadcast(&message.Message{
+			Event:   "new-stream",
+			UserID:  client.UserID,
+			RoomID:  room.ID,
+			Payload: described,
+		})
+		room.Broadcast(&message.Message{
 			Event:  "switch-camera-micro",
 			UserID: client.UserID,
 			RoomID: room.ID,
 			Payload: map[string]interface{}{
-				"camState": client.IsCamOn,
-				"micState": client.IsMicOn,
+				"camState": camState,
+				"micState": micState,
 			},
-		}
-
-		// **FIX: Send PLI only when connection is ready**
-		// go func() {
-		// 	time.Sleep(500 * time.Millisecond) // Wait for renegotiation to complete
-		// 	sendPLIWhenReady(client.PeerConn)
-		// }()
+		})
 	})
 
+	watch := &peerWatch{client: client, pc: pc}
+	// the room's tracks are added once, the senders outlive ICE restarts
+	var subscribed atomic.Bool
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Info("peer connection state changed", "peerState", state.String())
+		watch.update()
 		if state == webrtc.PeerConnectionStateConnected {
-			log.Printf("Client %s peer connection connected", client.UserID)
-			handleGetTrackFromClients(client, room)
-			var userStates []map[string]interface{}
-
-			for _, other := range room.Clients {
-				if client.UserID != other.UserID {
-					userStates = append(userStates, map[string]interface{}{
-						"userId":   other.UserID,
-						"camState": other.IsCamOn,
-						"micState": other.IsMicOn,
-					})
-				}
+			room := client.Room()
+			if subscribed.CompareAndSwap(false, true) {
+				handleGetTrackFromClients(client, room, pc)
+				sendUserStates(client, room)
 			}
-			if len(userStates) > 0 {
-				client.Send <- message.Message{
-					Event: "get-all-user-states",
-					Payload: map[string]interface{}{
-						"users": userStates,
-					},
+			go requestKeyframes(room, pc, "subscriber")
+			// after an ICE restart the publisher's encoder has to start over
+			// for the viewers that lost packets meanwhile
+			var own []*keyframe.Manager
+			room.Do(func(map[string]*media.Client) {
+				for _, t := range room.Tracks.Of(client.UserID) {
+					if t.Keyframes != nil {
+						own = append(own, t.Keyframes)
+					}
 				}
+			})
+			for _, m := range own {
+				m.Request("publisher-reconnect", false)
 			}
-			// **FIX: Send PLI after a small delay to ensure everything is ready**
-			go func() {
-				time.Sleep(1 * time.Second)
-				func() {
-					room.Mu.Lock()
-					defer room.Mu.Unlock()
-					for _, other := range room.Clients {
-						if other.PeerConn != nil {
-							sendPLIWhenReady(other.PeerConn)
-						}
-					}
-				}()
-			}()
 		}
 	})
 
 	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		log.Printf("Client %s ICE connection state: %s", client.UserID, state.String())
-		if state == webrtc.ICEConnectionStateConnected {
-			log.Printf("ICE connected for client %s, scheduling PLI", client.UserID)
-			// **FIX: Send PLI after ICE is connected and stable**
-			go func() {
-				time.Sleep(1 * time.Second)
-				room.Mu.Lock()
-				defer room.Mu.Unlock()
-				for _, other := range room.Clients {
-					if other.PeerConn != nil {
-						sendPLIWhenReady(other.PeerConn)
-					}
+		log.Debug("ICE connection state changed", "iceState", state.String())
+		switch state {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			iceDone.Do(func() {
+				iceSpan.SetAttributes(attribute.String("ice.state", state.String()))
+				if pair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+					iceSpan.SetAttributes(
+						attribute.String("ice.local_candidate", pair.Local.Typ.String()),
+						attribute.String("ice.remote_candidate", pair.Remote.Typ.String()),
+					)
 				}
-			}()
+				if state != webrtc.ICEConnectionStateConnected {
+					iceSpan.SetStatus(codes.Error, state.String())
+				}
+				iceSpan.End()
+			})
 		}
 	})
 
-	// **FIX: Reduced frequency and added connection state check**
-	go func() {
-		ticker := time.NewTicker(3 * time.Second) // Reduced frequency
-		defer ticker.Stop()
-
-		for range ticker.C {
-			func() {
-				room.Mu.Lock()
-				defer room.Mu.Unlock()
-				if client.PeerConn != nil && client.PeerConn.ConnectionState() == webrtc.PeerConnectionStateConnected {
-					sendPLIWhenReady(client.PeerConn)
-				}
+	return pc, nil
+}
 
-				for _, other := range room.Clients {
-					if other.PeerConn != nil && other.PeerConn.ConnectionState() == webrtc.PeerConnectionStateConnected {
-						sendPLIWhenReady(other.PeerConn)
-					}
-				}
-			}()
+// sendUserStates tells the client the camera and microphone states of the
+// others in room.
+func sendUserStates(client *media.Client, room *media.Room) {
+	var userStates []map[string]interface{}
+	room.Do(func(clients map[string]*media.Client) {
+		for _, other := range clients {
+			if client.UserID != other.UserID {
+				userStates = append(userStates, map[string]interface{}{
+					"userId":   other.UserID,
+					"camState": other.IsCamOn,
+					"micState": other.IsMicOn,
+				})
+			}
 		}
-	}()
+	})
+	if len(userStates) > 0 {
+		client.SafeSend(message.Message{
+			Event: "get-all-user-states",
+			Payload: map[string]interface{}{
+				"users": userStates,
+			},
+		})
+	}
+}
 
-	return nil
+// subscriber is a client to renegotiate with, and its peer connection read on
+// the room's loop.
+type subscriber struct {
+	client *media.Client
+	pc     *webrtc.PeerConnection
 }
 
-func handleGetTrackFromClients(client *media.Client, room *media.Room) {
-	log.Printf("Getting existing tracks for client %s", client.UserID)
+// sendQuality gives a client its own connection-quality report and forwards it
+// to the hosts of the room.
+func sendQuality(client *media.Client, room *media.Room, report quality.Report) {
+	msg := message.Message{
+		Event:  "connection-quality",
+		UserID: client.UserID,
+		RoomID: room.ID,
+		Payload: map[string]interface{}{
+			"score":   report.Score,
+			"quality": report.Quality,
+			"stats":   report,
+		},
+	}
+	client.SafeSend(msg)
+	for _, other := range room.Clients() {
+		if other.UserID != client.UserID && other.IsHost() {
+			other.SafeSend(msg)
+		}
+	}
+}
+
+func handleGetTrackFromClients(client *media.Client, room *media.Room, pc *webrtc.PeerConnection) {
+	span := startSpan(client, "signaling.handleGetTrackFromClients")
+	defer span.End()
 	var hasTracksToAdd bool
+	room.Do(func(map[string]*media.Client) {
+		hasTracksToAdd = subscribeToRoom(client, room, pc)
+	})
+
+	span.SetAttributes(attribute.Bool("renegotiate", hasTracksToAdd))
+	// Only renegotiate if we actually added tracks
+	if hasTracksToAdd {
+		renegotiate(client, pc)
+	}
+}
 
-	for _, other := range room.Clients {
-		if other.UserID == client.UserID || other.PeerConn == nil {
+// subscribeToRoom adds the tracks published in room to the client's pc and
+// tells whether any was added. It runs on the room's loop.
+func subscribeToRoom(client *media.Client, room *media.Room, pc *webrtc.PeerConnection) bool {
+	var added bool
+	// a client keeps its mixer track until it leaves the room
+	if client.IsMixedAudio() && client.MixedTrack == nil && addMixedAudioTrack(client, room) {
+		added = true
+	}
+	for _, published := range room.Tracks.All() {
+		if published.Owner == client.UserID {
+			continue
+		}
+		if published.Mixed && client.IsMixedAudio() {
 			continue
 		}
+		client.SafeSend(message.Message{
+			Event:   "new-stream",
+			UserID:  published.Owner,
+			RoomID:  room.ID,
+			Payload: published.Describe(),
+		})
+		if err := addSender(pc, published.Local, published.Keyframes); err != nil {
+			clientLogger(client).Warn("subscribe failed", "publisher", published.Owner, "trackId", published.ID, "error", err)
+			continue
+		}
+		added = true
+	}
+	return added
+}
 
-		if other.AudioTrack != nil {
-			client.SafeSend(message.Message{
-				Event:  "new-stream",
-				UserID: other.UserID,
-				RoomID: room.ID,
-				Payload: map[string]interface{}{
-					"type":     "audio",
-					"trackId":  other.AudioTrack.ID(),
-					"streamId": other.AudioTrack.StreamID(),
-				},
-			})
-			_, err := client.PeerConn.AddTrack(other.AudioTrack)
-			if err != nil {
-				log.Println("Failed to add existing audio track:", err)
-			} else {
-				hasTracksToAdd = true
-			}
+// subscribeOthers adds a track to the pc of every other client and returns the
+// ones to renegotiate with. It runs on the room's loop.
+func subscribeOthers(clients map[string]*media.Client, t *media.Track) []subscriber {
+	var subscribers []subscriber
+	for _, other := range clients {
+		if other.UserID == t.Owner || other.PeerConn == nil {
+			continue
 		}
-		if other.VideoTrack != nil {
-			client.SafeSend(message.Message{
-				Event:  "new-stream",
-				UserID: other.UserID,
-				RoomID: room.ID,
-				Payload: map[string]interface{}{
-					"type":     "video",
-					"trackId":  other.VideoTrack.ID(),
-					"streamId": other.VideoTrack.StreamID(),
-				},
-			})
-			_, err := client.PeerConn.AddTrack(other.VideoTrack)
-			if err != nil {
-				log.Println("Failed to add existing video track:", err)
-			} else {
-				hasTracksToAdd = true
-			}
+		// mixed-audio listeners get this voice through their mixer track
+		if t.Mixed && other.IsMixedAudio() {
+			continue
 		}
-		if other.ScreenTrack != nil {
-			client.SafeSend(message.Message{
-				Event:  "new-stream",
-				UserID: other.UserID,
-				RoomID: room.ID,
-				Payload: map[string]interface{}{
-					"type":     "screen",
-					"trackId":  other.ScreenTrack.ID(),
-					"streamId": other.ScreenTrack.StreamID(),
-				},
-			})
-			_, err := client.PeerConn.AddTrack(other.ScreenTrack)
-			if err != nil {
-				log.Println("Failed to add existing screen track:", err)
-			} else {
-				hasTracksToAdd = true
-			}
+		if err := addSender(other.PeerConn, t.Local, t.Keyframes); err != nil {
+			clientLogger(other).Warn("subscribe failed", "publisher", t.Owner, "trackId", t.ID, "error", err)
+			continue
 		}
+		subscribers = append(subscribers, subscriber{other, other.PeerConn})
 	}
-
-	// Only renegotiate if we actually added tracks
-	if hasTracksToAdd {
-		renegotiate(client)
-	}
-
-	// **FIX: Send PLI after everything is set up**
-	go func() {
-		time.Sleep(1 * time.Second)
-		func() {
-			room.Mu.Lock()
-			defer room.Mu.Unlock()
-			for _, other := range room.Clients {
-				if other.PeerConn != nil {
-					sendPLIWhenReady(other.PeerConn)
-				}
-			}
-		}()
-	}()
+	return subscribers
 }
 
-// **FIX: New function to send PLI only when connection is ready**
-func sendPLIWhenReady(pc *webrtc.PeerConnection) {
-	if pc == nil {
-		return
+// addMixedAudioTrack gives a mixed-audio client its single mixer track. If the
+// mixer cannot run, the client falls back to receiving every audio track. It
+// runs on the room's loop.
+func addMixedAudioTrack(client *media.Client, room *media.Room) bool {
+	track, err := room.Mixer.AddSink(client.UserID)
+	if err == nil {
+		if err = addSender(client.PeerConn, track, nil); err != nil {
+			room.Mixer.RemoveSink(client.UserID)
+		}
 	}
-
-	// Check if peer connection is in a good state
-	if pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
-		log.Printf("Skipping PLI - connection state: %s", pc.ConnectionState().String())
-		return
+	if err != nil {
+		clientLogger(client).Warn("mixed audio unavailable, falling back to sfu", "error", err)
+		client.AudioMode = media.AudioModeSFU
+		client.SafeSend(message.Message{
+			Event:  "audio-mode",
+			RoomID: room.ID,
+			Payload: map[string]interface{}{
+				"mode":   media.AudioModeSFU,
+				"reason": err.Error(),
+			},
+		})
+		return false
 	}
 
-	if pc.ICEConnectionState() != webrtc.ICEConnectionStateConnected &&
-		pc.ICEConnectionState() != webrtc.ICEConnectionStateCompleted {
-		log.Printf("Skipping PLI - ICE state: %s", pc.ICEConnectionState().String())
-		return
-	}
+	client.MixedTrack = track
+	client.SafeSend(message.Message{
+		Event:  "audio-mode",
+		RoomID: room.ID,
+		Payload: map[string]interface{}{
+			"mode":     media.AudioModeMixed,
+			"trackId":  track.ID(),
+			"streamId": track.StreamID(),
+		},
+	})
+	return true
+}
 
-	sendPLI(pc)
+// requestKeyframes asks the publishers of the video pc receives for a
+// keyframe, so the client can start decoding without waiting for the next one.
+func requestKeyframes(room *media.Room, pc *webrtc.PeerConnection, reason string) {
+	received := map[webrtc.TrackLocal]bool{}
+	for _, sender := range pc.GetSenders() {
+		if track := sender.Track(); track != nil {
+			received[track] = true
+		}
+	}
+	var managers []*keyframe.Manager
+	room.Do(func(map[string]*media.Client) {
+		for _, t := range room.Tracks.All() {
+			if t.Keyframes != nil && received[t.Local] {
+				managers = append(managers, t.Keyframes)
+			}
+		}
+	})
+	for _, m := range managers {
+		m.Request(reason, false)
+	}
 }
 
-// send lại frame ban đầu của stream cho user khác thay vì phải chờ frame mới.
-func sendPLI(pc *webrtc.PeerConnection) {
-	receivers := pc.GetReceivers()
-	if len(receivers) == 0 {
-		return
+// addSender forwards track to a viewer's pc. Every sender the server creates
+// goes through here: without its RTCP read, the NACK responder and the sender
+// reports of the interceptor pipeline never run for it.
+func addSender(pc *webrtc.PeerConnection, track webrtc.TrackLocal, keyframes *keyframe.Manager) error {
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return err
 	}
+	go readSubscriberRTCP(sender, keyframes)
+	return nil
+}
 
-	var wg sync.WaitGroup
-	for _, receiver := range receivers {
-		track := receiver.Track()
-		if track == nil {
+// readSubscriberRTCP reads the RTCP a viewer sends about one forwarded track
+// until the track is removed from its peer connection. Reading is what lets
+// the NACK responder and report interceptors see it; keyframe requests are
+// passed on to the publisher of the track, through keyframes when the track
+// is video.
+func readSubscriberRTCP(sender *webrtc.RTPSender, keyframes *keyframe.Manager) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if keyframes == nil {
 			continue
 		}
-
-		wg.Add(1)
-		go func(t webrtc.TrackRemote) {
-			defer wg.Done()
-			err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(t.SSRC())}})
-			if err != nil {
-				log.Printf("sendPLI error for track %s: %v", t.ID(), err)
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication:
+				keyframes.Request("viewer-pli", false)
+			case *rtcp.FullIntraRequest:
+				keyframes.Request("viewer-fir", true)
 			}
-		}(*track)
+		}
 	}
-	wg.Wait()
 }
 
-// tái đàm phán
-func renegotiate(client *media.Client) {
-	if client.PeerConn == nil {
-		log.Printf("Cannot renegotiate - no peer connection for client %s", client.UserID)
+// renegotiate sends a new offer to the client after tracks were added to or
+// removed from its peer connection.
+func renegotiate(client *media.Client, pc *webrtc.PeerConnection) {
+	if pc == nil {
+		clientLogger(client).Warn("renegotiation without peer connection")
 		return
 	}
-	for {
-		if client.PeerConn.SignalingState() == webrtc.SignalingStateStable {
-			break
+	span := startSpan(client, "webrtc.renegotiate")
+	// wait for the answer to a previous offer, the state is checked again
+	// under the lock since another renegotiation may win the race
+	client.Negotiation.Lock()
+	for pc.SignalingState() != webrtc.SignalingStateStable {
+		client.Negotiation.Unlock()
+		select {
+		case <-client.Done:
+			span.SetAttributes(attribute.Bool("skipped", true))
+			span.End()
+			return
+		case <-time.After(20 * time.Millisecond):
 		}
+		client.Negotiation.Lock()
 	}
+	defer client.Negotiation.Unlock()
 
-	if client.PeerConn.ConnectionState() != webrtc.PeerConnectionStateConnected {
-		log.Printf("Skipping renegotiation - connection not ready for client %s", client.UserID)
+	if pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		clientLogger(client).Debug("renegotiation skipped", "peerState", pc.ConnectionState().String())
+		span.SetAttributes(attribute.Bool("skipped", true))
+		span.End()
 		return
 	}
 
-	log.Printf("Starting renegotiation for client %s", client.UserID)
+	metrics.RenegotiationsAttempted.Inc()
 
-	offer, err := client.PeerConn.CreateOffer(nil)
+	offer, err := pc.CreateOffer(nil)
 	if err != nil {
-		log.Printf("CreateOffer failed for client %s: %v", client.UserID, err)
+		clientLogger(client).Warn("renegotiation offer failed", "error", err)
+		metrics.RenegotiationsFailed.Inc()
+		endSpan(span, err)
 		return
 	}
-	err = client.PeerConn.SetLocalDescription(offer)
+	err = pc.SetLocalDescription(offer)
 	if err != nil {
-		log.Printf("SetLocalDescription failed for client %s: %v", client.UserID, err)
+		clientLogger(client).Warn("renegotiation set local description failed", "error", err)
+		metrics.RenegotiationsFailed.Inc()
+		endSpan(span, err)
 		return
 	}
 
@@ -646,8 +885,23 @@ func renegotiate(client *media.Client) {
 		},
 	})
 
-	log.Printf("Renegotiation offer sent to client %s", client.UserID)
+	// ends when the client answers
+	client.NegotiationSpan.Set(span)
+	clientLogger(client).Debug("renegotiation offer sent")
 }
+
+// answerOffer applies an offer from the client and sets the local answer.
+func answerOffer(pc *webrtc.PeerConnection, offer webrtc.SessionDescription) error {
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	return pc.SetLocalDescription(answer)
+}
+
 func generateTrackID(userID, trackType string) string {
 	return fmt.Sprintf("%s_%s", userID, trackType)
 }
@@ -0,0 +1,33 @@
+package signaling
+
+import "time"
+
+// limiter is a token bucket for the messages one client sends. The rate and
+// burst are given on every call, so a reloaded configuration applies to the
+// clients already connected. It is used by a single goroutine.
+type limiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token at now and tells whether the message may be handled;
+// a rate of 0 lets everything through.
+func (l *limiter) allow(now time.Time, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,98 @@
+package signaling
+
+import (
+	"mediaserver/media"
+	"mediaserver/metrics"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// how often awaitReconnect looks for a newer connection of the user
+const reconnectPoll = 250 * time.Millisecond
+
+// awaitReconnect runs once the client's WebSocket is gone. When it dropped on
+// its own while media still flows, the client stays for the grace period so a
+// browser that reconnects replaces it without the others seeing it leave. It
+// returns when the client was replaced, its peer connection stopped or the
+// grace period ran out.
+func awaitReconnect(client *media.Client, room *media.Room, pc *webrtc.PeerConnection) {
+	if !client.Lost() {
+		return
+	}
+	grace := client.Socket.DisconnectGrace
+	if pc == nil || grace == 0 || pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		metrics.DeadPeers.WithLabelValues("websocket").Inc()
+		return
+	}
+	log := clientLogger(client)
+	log.Info("websocket lost, waiting for a reconnect", "grace", grace)
+	expired := time.NewTimer(grace)
+	defer expired.Stop()
+	poll := time.NewTicker(reconnectPoll)
+	defer poll.Stop()
+	for {
+		select {
+		case <-expired.C:
+			log.Info("no reconnect within the grace period")
+			metrics.DeadPeers.WithLabelValues("websocket").Inc()
+			return
+		case <-poll.C:
+			if current, _ := room.Client(client.UserID); current != client {
+				return
+			}
+			if pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+				metrics.DeadPeers.WithLabelValues("websocket").Inc()
+				return
+			}
+		}
+	}
+}
+
+// peerWatch closes a client whose peer connection stays disconnected or
+// failed for the grace period while its WebSocket is still up: without media
+// the participant is only a ghost in the room.
+type peerWatch struct {
+	client *media.Client
+	pc     *webrtc.PeerConnection
+	mu     sync.Mutex
+	timer  *time.Timer
+}
+
+// update follows a connection state change. pion calls the handlers on their
+// own goroutines, so the current state is read again rather than trusted
+// from the event.
+func (w *peerWatch) update() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch w.pc.ConnectionState() {
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.client.Socket.DisconnectGrace, w.expire)
+		}
+	default:
+		if w.timer != nil {
+			w.timer.Stop()
+			w.timer = nil
+		}
+	}
+}
+
+func (w *peerWatch) expire() {
+	w.mu.Lock()
+	pending := w.timer != nil
+	w.mu.Unlock()
+	select {
+	case <-w.client.Done:
+		return
+	default:
+	}
+	if !pending {
+		return
+	}
+	clientLogger(w.client).Info("peer connection lost, closing the client",
+		"peerState", w.pc.ConnectionState().String(), "grace", w.client.Socket.DisconnectGrace)
+	metrics.DeadPeers.WithLabelValues("media").Inc()
+	w.client.CloseWith(media.CloseCodeMediaLost, "media connection lost")
+}
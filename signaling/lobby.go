@@ -0,0 +1,206 @@
+package signaling
+
+import (
+	"errors"
+	"mediaserver/media"
+	"mediaserver/media/message"
+	"time"
+)
+
+var errInLobby = errors.New("waiting in the lobby, messages are handled once a host lets you in")
+
+// holdInLobby keeps a client the room's lobby holds, without media, until a
+// host decides. It returns false when the client does not get in, denied,
+// gone meanwhile or turned away after the lobby timeout without a host in the
+// room. Users already in the room reconnect without waiting.
+func holdInLobby(client *media.Client, room *media.Room) bool {
+	var decision <-chan bool
+	var hosts []*media.Client
+	room.Do(func(clients map[string]*media.Client) {
+		if _, rejoin := clients[client.UserID]; rejoin || !room.Lobby.Holds(client) {
+			return
+		}
+		decision = room.Lobby.Hold(client)
+		hosts = hostsOf(clients)
+	})
+	if decision == nil {
+		return true
+	}
+	log := clientLogger(client)
+	log.Info("waiting in lobby", "hosts", len(hosts))
+	client.SafeSend(message.Message{
+		Event:   "lobby-waiting",
+		UserID:  client.UserID,
+		RoomID:  room.ID,
+		Payload: map[string]interface{}{},
+	})
+	request := lobbyRequest(room, media.Waiting{UserID: client.UserID, Role: client.Role})
+	for _, host := range hosts {
+		host.SafeSend(request)
+	}
+	var expired <-chan time.Time
+	timeout := currentConfig().Rooms.LobbyTimeout
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case <-expired:
+			// nobody can let the user in; with a host here, it waits on
+			var hostPresent, removed bool
+			room.Do(func(clients map[string]*media.Client) {
+				if hostPresent = len(hostsOf(clients)) > 0; !hostPresent {
+					removed = room.Lobby.Remove(client)
+				}
+			})
+			if hostPresent {
+				expired = time.After(timeout)
+				continue
+			}
+			if !removed {
+				// decided right before, the decision is waiting
+				continue
+			}
+			log.Info("lobby timed out without a host", "timeout", timeout)
+			client.CloseWith(media.CloseCodeDenied, "no host came to let you in")
+			room.Withdraw(client)
+			notifyLobbyLeft(room, []string{client.UserID}, "timeout")
+			return false
+		case admitted := <-decision:
+			if admitted {
+				log.Info("admitted from lobby")
+				return true
+			}
+			log.Info("denied from lobby")
+			client.CloseWith(media.CloseCodeDenied, "a host did not let you in")
+			room.Withdraw(client)
+			return false
+		case msg, ok := <-client.Read:
+			// signaling starts once admitted, the client sends again then
+			if ok {
+				log.Debug("message dropped in lobby", "event", msg.Event)
+				sendError(client, "in-lobby", errInLobby)
+				continue
+			}
+			log.Info("left the lobby")
+			room.Withdraw(client)
+			notifyLobbyLeft(room, []string{client.UserID}, "left")
+			return false
+		}
+	}
+}
+
+// sendLobby gives a host joining the room the users already waiting.
+func sendLobby(client *media.Client, room *media.Room) {
+	var waiting []media.Waiting
+	room.Do(func(map[string]*media.Client) { waiting = room.Lobby.Waiting() })
+	for _, w := range waiting {
+		client.SafeSend(lobbyRequest(room, w))
+	}
+}
+
+// handleLobbyDecision lets a host admit or deny one waiting user, "userId", or
+// everyone with "all": true.
+func handleLobbyDecision(client *media.Client, room *media.Room, payload map[string]interface{}, admit bool) {
+	if !requireHost(client, "admit or deny users") {
+		return
+	}
+	all, _ := payload["all"].(bool)
+	userID, _ := payload["userId"].(string)
+	var decided []string
+	room.Do(func(map[string]*media.Client) {
+		if all {
+			decided = room.Lobby.DecideAll(admit)
+		} else if room.Lobby.Decide(userID, admit) {
+			decided = []string{userID}
+		}
+	})
+	if len(decided) == 0 && !all {
+		sendError(client, "not-waiting", errors.New("the user is not waiting in the lobby"))
+		return
+	}
+	reason := "denied"
+	if admit {
+		reason = "admitted"
+	}
+	clientLogger(client).Info("lobby decision", "decision", reason, "users", decided)
+	notifyLobbyLeft(room, decided, reason)
+}
+
+// handleSetLobby lets a host turn the lobby on or off; turning it off admits
+// everyone waiting.
+func handleSetLobby(client *media.Client, room *media.Room, payload map[string]interface{}) {
+	if !requireHost(client, "change the lobby") {
+		return
+	}
+	enabled, ok := payload["enabled"].(bool)
+	if !ok {
+		sendError(client, "invalid-lobby", errors.New("enabled must be true or false"))
+		return
+	}
+	var admitted []string
+	room.Do(func(map[string]*media.Client) {
+		room.Lobby.Enabled = enabled
+		if !enabled {
+			admitted = room.Lobby.DecideAll(true)
+		}
+	})
+	clientLogger(client).Info("lobby changed", "enabled", enabled)
+	notifyLobbyLeft(room, admitted, "admitted")
+	msg := message.Message{
+		Event:  "lobby-mode",
+		UserID: client.UserID,
+		RoomID: room.ID,
+		Payload: map[string]interface{}{
+			"enabled": enabled,
+		},
+	}
+	client.SafeSend(msg)
+	room.Broadcast(&msg)
+}
+
+func lobbyRequest(room *media.Room, w media.Waiting) message.Message {
+	return message.Message{
+		Event:  "lobby-join-request",
+		UserID: w.UserID,
+		RoomID: room.ID,
+		Payload: map[string]interface{}{
+			"role": w.Role,
+		},
+	}
+}
+
+// notifyLobbyLeft tells the hosts that users are no longer waiting, and why:
+// "admitted", "denied", "left" or "timeout".
+func notifyLobbyLeft(room *media.Room, userIDs []string, reason string) {
+	if len(userIDs) == 0 {
+		return
+	}
+	var hosts []*media.Client
+	room.Do(func(clients map[string]*media.Client) { hosts = hostsOf(clients) })
+	for _, userID := range userIDs {
+		msg := message.Message{
+			Event:  "lobby-left",
+			UserID: userID,
+			RoomID: room.ID,
+			Payload: map[string]interface{}{
+				"reason": reason,
+			},
+		}
+		for _, host := range hosts {
+			host.SafeSend(msg)
+		}
+	}
+}
+
+func hostsOf(clients map[string]*media.Client) []*media.Client {
+	var hosts []*media.Client
+	for _, c := range clients {
+		if c.IsHost() {
+			hosts = append(hosts, c)
+		}
+	}
+	return hosts
+}
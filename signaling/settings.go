@@ -0,0 +1,30 @@
+package signaling
+
+import (
+	"mediaserver/media"
+	"mediaserver/media/message"
+)
+
+// handleLockRoom lets a host lock the room, so that only its participants can
+// reconnect, or unlock it. Everyone gets the new settings.
+func handleLockRoom(client *media.Client, room *media.Room, locked bool) {
+	if !requireHost(client, "lock or unlock the room") {
+		return
+	}
+	var info media.SettingsInfo
+	room.Do(func(map[string]*media.Client) {
+		room.Settings.Locked = locked
+		info = room.Settings.Info()
+	})
+	clientLogger(client).Info("room lock changed", "locked", locked)
+	msg := message.Message{
+		Event:  "room-settings",
+		UserID: client.UserID,
+		RoomID: room.ID,
+		Payload: map[string]interface{}{
+			"settings": info,
+		},
+	}
+	client.SafeSend(msg)
+	room.Broadcast(&msg)
+}
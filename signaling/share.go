@@ -0,0 +1,158 @@
+package signaling
+
+import (
+	"errors"
+	"mediaserver/history"
+	"mediaserver/media"
+	"mediaserver/media/message"
+	"mediaserver/media/share"
+	"time"
+)
+
+// handleStartShare makes the client a presenter. The optional "trackIds" are
+// its screen tracks, video and system audio, which are announced as such. Under
+// the exclusive policy the presenters it replaces lose their share and their
+// screen tracks, which are forwarded again if they share them anew.
+func handleStartShare(client *media.Client, room *media.Room, payload map[string]interface{}) {
+	trackIDs := stringList(payload["trackIds"])
+	now := time.Now()
+	var takenOver []string
+	var restarted bool
+	var updated, resumed []map[string]interface{}
+	var clientsToRenegotiate []subscriber
+	var err error
+	room.Do(func(clients map[string]*media.Client) {
+		restarted = room.Shares.Sharing(client.UserID)
+		if takenOver, err = room.Shares.Start(client.UserID, trackIDs, now); err != nil {
+			return
+		}
+		for _, id := range trackIDs {
+			a := client.Announced[id]
+			a.Source = media.SourceScreen
+			client.Announced[id] = a
+			if t := room.Tracks.Get(client.UserID, id); t != nil && t.Source != media.SourceScreen && t.Source != media.SourceScreenAudio {
+				announce(client, t)
+				updated = append(updated, t.Describe())
+			}
+		}
+		var tracks []*media.Track
+		tracks, clientsToRenegotiate = resumeScreen(client, room, clients, trackIDs)
+		for _, t := range tracks {
+			announce(client, t)
+			resumed = append(resumed, t.Describe())
+		}
+	})
+	if errors.Is(err, share.ErrTooManyShares) {
+		sendError(client, "too-many-shares", err)
+		return
+	} else if err != nil {
+		sendError(client, "share-failed", err)
+		return
+	}
+
+	for _, previous := range takenOver {
+		clientLogger(client).Info("screen share taken over", "previousUserId", previous)
+		history.ShareStopped(room.SessionID, previous, now)
+		withdrawScreen(room, previous)
+		msg := message.Message{
+			Event:  "share-taken-over",
+			UserID: client.UserID,
+			RoomID: room.ID,
+			Payload: map[string]interface{}{
+				"previousUserId": previous,
+			},
+		}
+		client.SafeSend(msg)
+		room.Broadcast(&msg)
+	}
+	for _, other := range clientsToRenegotiate {
+		go renegotiate(other.client, other.pc)
+	}
+	for _, described := range resumed {
+		room.Broadcast(&message.Message{
+			Event:   "new-stream",
+			UserID:  client.UserID,
+			RoomID:  room.ID,
+			Payload: described,
+		})
+	}
+	for _, described := range updated {
+		room.Broadcast(&message.Message{
+			Event:   "track-updated",
+			UserID:  client.UserID,
+			RoomID:  room.ID,
+			Payload: described,
+		})
+	}
+	if !restarted {
+		history.ShareStarted(history.Share{SessionID: room.SessionID, RoomID: room.ID, UserID: client.UserID, StartedAt: now})
+	}
+	room.Broadcast(&message.Message{
+		Event:  "start-share",
+		UserID: client.UserID,
+		RoomID: room.ID,
+		Payload: map[string]interface{}{
+			"trackIds": trackIDs,
+		},
+	})
+}
+
+// handleStopShare ends the client's share; a share already taken over is not
+// announced twice.
+func handleStopShare(client *media.Client, room *media.Room) {
+	var stopped bool
+	room.Do(func(map[string]*media.Client) { stopped = room.Shares.Stop(client.UserID) })
+	if !stopped {
+		return
+	}
+	history.ShareStopped(room.SessionID, client.UserID, time.Now())
+	room.Broadcast(&message.Message{
+		Event:   "stop-share",
+		UserID:  client.UserID,
+		RoomID:  room.ID,
+		Payload: map[string]interface{}{},
+	})
+}
+
+// withdrawScreen takes the screen tracks of a presenter whose share was taken
+// over away from the viewers, whether or not its client stops sending them.
+// They are parked: no longer forwarded, until the presenter shares them again.
+func withdrawScreen(room *media.Room, userID string) {
+	withdraw(room, userID, func() []*media.Track {
+		var removed []*media.Track
+		for _, t := range room.Tracks.Of(userID) {
+			if (t.Source == media.SourceScreen || t.Source == media.SourceScreenAudio) && room.Tracks.Park(t) {
+				if t.Keyframes != nil {
+					t.Keyframes.Close()
+				}
+				removed = append(removed, t)
+			}
+		}
+		return removed
+	})
+}
+
+// resumeScreen forwards again the parked tracks the presenter shares anew,
+// on the room's loop. It returns the viewers to renegotiate with.
+func resumeScreen(client *media.Client, room *media.Room, clients map[string]*media.Client, trackIDs []string) (resumed []*media.Track, subscribers []subscriber) {
+	resumed = room.Tracks.Unpark(client.UserID, trackIDs)
+	for _, t := range resumed {
+		if t.Keyframes != nil {
+			t.Keyframes.Reopen()
+		}
+		subscribers = append(subscribers, subscribeOthers(clients, t)...)
+	}
+	return resumed, subscribers
+}
+
+// stringList reads a JSON array of strings, skipping other values.
+func stringList(v interface{}) []string {
+	items, _ := v.([]interface{})
+	list := []string{}
+	for _, item := range items {
+		if s, ok := item.(string); ok && s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -1,36 +1,184 @@
 package signaling
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"mediaserver/media"
 	"mediaserver/media/message"
+	"mediaserver/tracing"
+	"mediaserver/utils/config"
+	"mediaserver/utils/logging"
 	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var logger = logging.For("signaling")
+
+var (
+	configStore   *config.Store
+	settingEngine webrtc.SettingEngine
 )
 
+// Configure must be called once before the server accepts connections.
+func Configure(store *config.Store, s webrtc.SettingEngine) {
+	configStore = store
+	settingEngine = s
+}
+
+// currentConfig returns the live configuration; values can change between
+// two calls after a reload.
+func currentConfig() *config.Config {
+	if configStore == nil {
+		return config.Default()
+	}
+	return configStore.Current()
+}
+
+// clientLogger scopes the signaling logger to one client.
+func clientLogger(client *media.Client) *slog.Logger {
+	return logger.With("roomId", client.RoomID, "userId", client.UserID)
+}
+
+func rejectConnection(conn *websocket.Conn, joinSpan trace.Span, code string, reason string) {
+	joinSpan.SetStatus(codes.Error, code)
+	joinSpan.End()
+	logger.Info("connection rejected", "remoteAddr", conn.RemoteAddr().String(), "code", code, "reason", reason)
+	conn.WriteJSON(map[string]interface{}{
+		"event": "error",
+		"payload": map[string]interface{}{
+			"code":    code,
+			"message": reason,
+		},
+	})
+	conn.Close()
+}
+
+var errCodecOverrides = errors.New("only a host creating the room can override its codecs, the server's codec policy applies")
+
 func HandlerConnection(w http.ResponseWriter, r *http.Request) {
-	log.Println("Connect")
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Error to connect this connection!")
+		logger.Warn("websocket upgrade failed", "remoteAddr", r.RemoteAddr, "error", err)
 		return
 	}
+	settings := currentConfig()
+	// ReadPump takes over the limits once the client is created
+	conn.SetReadLimit(settings.WebSocket.MaxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(settings.WebSocket.PongTimeout))
 	var msg message.Message
 	if err := conn.ReadJSON(&msg); err != nil {
-		log.Println("Init read error:", err)
+		logger.Info("join message not received", "remoteAddr", r.RemoteAddr, "error", err)
 		conn.Close()
 		return
 	}
 
-	client := media.CreateClientConnection(msg.UserID, msg.RoomID, msg.Payload["role"].(string), msg.Payload["isCamOn"].(bool), msg.Payload["isMicOn"].(bool), conn)
-	media.RoomsMutex.Lock()
-	room, exists := media.Rooms[msg.RoomID]
-	if !exists {
-		room = media.CreateRoom(msg.RoomID, nil)
-		media.Rooms[msg.RoomID] = room
+	role, _ := msg.Payload["role"].(string)
+	hostToken, _ := msg.Payload["hostToken"].(string)
+	secret := settings.Rooms.HostTokenSecret
+	// a host creating the room sets it up: with a secret, one holding a host
+	// token; without, whoever claims the role first, who becomes its host
+	creatorHost := media.IsHostRole(role) && (secret == "" || media.ValidHostToken(secret, msg.RoomID, msg.UserID, hostToken))
+	// only a host creating the room can ask for a lobby
+	lobby, _ := msg.Payload["lobby"].(bool)
+	isCamOn, _ := msg.Payload["isCamOn"].(bool)
+	isMicOn, _ := msg.Payload["isMicOn"].(bool)
+	_, joinSpan := tracing.Tracer().Start(context.Background(), "participant.join",
+		tracing.Participant(msg.RoomID, msg.UserID), trace.WithAttributes(attribute.String("user.role", role)))
+
+	password, _ := msg.Payload["password"].(string)
+	pass, err := media.VerifyPassword(msg.RoomID, password)
+	if err != nil {
+		rejectConnection(conn, joinSpan, "wrong-password", err.Error())
+		return
+	}
+	// like the codec overrides, a host's settings only apply to the join
+	// that creates the room, and not over provisioned ones
+	var hostSettings *media.Settings
+	if fields, ok := msg.Payload["settings"].(map[string]interface{}); ok && creatorHost {
+		s, err := media.ParseSettings(fields, media.Settings{})
+		if err != nil {
+			rejectConnection(conn, joinSpan, "invalid-room-settings", err.Error())
+			return
+		}
+		hostSettings = &s
+	}
+
+	// per-room codec overrides only apply to the join that creates the room,
+	// and only when a host makes it
+	policy := settings.Codec
+	var policyErr error
+	overrides, hasOverrides := msg.Payload["codecs"].(map[string]interface{})
+	if hasOverrides {
+		if policy, policyErr = settings.Codec.WithOverrides(overrides); policyErr != nil {
+			policy = settings.Codec
+		}
+	}
+	var overridden bool
+	limits := media.Limits{MaxRooms: settings.Rooms.MaxRooms, MaxParticipants: settings.Rooms.MaxParticipants}
+	room, created, err := media.Admit(msg.RoomID, msg.UserID, pass, limits, func(r *media.Room) {
+		r.Shares.Policy = settings.Share
+		// a provisioned room has no creator, its hosts are listed
+		host := creatorHost && (secret != "" || !r.Provisioned) || media.IsHostRole(role) && r.Settings.Lists(msg.UserID)
+		r.CodecPolicy = settings.Codec
+		if host && hasOverrides {
+			r.CodecPolicy, overridden = policy, true
+		}
+		r.Lobby.Enabled = lobby && host
+		if hostSettings != nil && !r.Provisioned {
+			r.Settings = *hostSettings
+		}
+		if creatorHost && secret == "" && !r.Provisioned {
+			r.Creator = msg.UserID
+		}
+	})
+	switch {
+	case errors.Is(err, media.ErrTooManyRooms):
+		rejectConnection(conn, joinSpan, "too-many-rooms", err.Error())
+		return
+	case errors.Is(err, media.ErrRoomFull):
+		rejectConnection(conn, joinSpan, "room-full", err.Error())
+		return
+	case errors.Is(err, media.ErrRoomLocked):
+		rejectConnection(conn, joinSpan, "room-locked", err.Error())
+		return
+	case errors.Is(err, media.ErrWrongPassword):
+		rejectConnection(conn, joinSpan, "wrong-password", err.Error())
+		return
+	case errors.Is(err, media.ErrRoomExpired):
+		rejectConnection(conn, joinSpan, "room-expired", err.Error())
+		return
+	case err != nil:
+		rejectConnection(conn, joinSpan, "room-closed", err.Error())
+		return
+	}
+
+	client := media.CreateClientConnection(msg.UserID, msg.RoomID, role, isCamOn, isMicOn, conn, settings.WebSocket)
+	client.Host = media.VerifyHost(room, msg.UserID, role, secret, hostToken)
+	client.JoinSpan.Set(joinSpan)
+	if audioMode, ok := msg.Payload["audioMode"].(string); ok && audioMode == media.AudioModeMixed {
+		client.AudioMode = media.AudioModeMixed
+	}
+	switch {
+	case created && hasOverrides && !overridden:
+		logger.Warn("codec overrides from a non-host ignored", "roomId", room.ID, "userId", msg.UserID)
+		sendError(client, "not-allowed", errCodecOverrides)
+	case created && policyErr != nil:
+		logger.Warn("invalid room codec policy, using the global policy", "roomId", room.ID, "error", policyErr)
+		sendError(client, "invalid-codec-policy", policyErr)
 	}
-	go media.ReadPump(client, room)
+	go media.ReadPump(client)
 	go media.WritePump(client)
-	go room.Run()
-	media.RoomsMutex.Unlock()
+	if !holdInLobby(client, room) {
+		client.JoinSpan.End(attribute.Bool("lobby.admitted", false))
+		room.CloseIfEmpty()
+		return
+	}
 	handleClientJoin(client, room)
 }
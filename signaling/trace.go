@@ -0,0 +1,44 @@
+package signaling
+
+import (
+	"context"
+	"mediaserver/media"
+	"mediaserver/metrics"
+	"mediaserver/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startSpan starts a span of the client's join trace while the join is in
+// progress, and a new trace with the same attributes afterwards.
+func startSpan(client *media.Client, name string) trace.Span {
+	ctx := context.Background()
+	if join := client.JoinSpan.Span(); join != nil {
+		ctx = trace.ContextWithSpan(ctx, join)
+	}
+	_, span := tracing.Tracer().Start(ctx, name, tracing.Participant(client.RoomID, client.UserID))
+	return span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// firstFrame ends the join trace when the first media packet is sent to the
+// client.
+func firstFrame(client *media.Client, kind string) {
+	elapsed := time.Since(client.JoinedAt)
+	metrics.TimeToFirstFrame.WithLabelValues(kind).Observe(elapsed.Seconds())
+	client.JoinSpan.End(
+		attribute.String("media.kind", kind),
+		attribute.Int64("time_to_first_frame_ms", elapsed.Milliseconds()),
+	)
+	clientLogger(client).Info("first media sent", "kind", kind, "elapsed", elapsed)
+}
@@ -0,0 +1,228 @@
+package signaling
+
+import (
+	"errors"
+	"mediaserver/media"
+	"mediaserver/media/message"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const maxTrackLabel = 64
+
+// legacySources maps the stream types of the offer's "streams" list, which
+// predates announce-track, to sources.
+var legacySources = map[string]string{
+	"audio":  media.SourceMicrophone,
+	"video":  media.SourceCamera,
+	"screen": media.SourceScreen,
+}
+
+// parseAnnouncement reads the trackId, source, label and muted flag an
+// announce-track event gives for one track.
+func parseAnnouncement(payload map[string]interface{}) (string, media.Announcement, error) {
+	trackID, _ := payload["trackId"].(string)
+	if trackID == "" {
+		return "", media.Announcement{}, errors.New("trackId is required")
+	}
+	source, _ := payload["source"].(string)
+	if !media.ValidSource(source) {
+		return "", media.Announcement{}, errors.New("source must be camera, microphone, screen, screen-audio or a lowercase custom name")
+	}
+	label, _ := payload["label"].(string)
+	if len(label) > maxTrackLabel {
+		return "", media.Announcement{}, errors.New("label is too long")
+	}
+	muted, _ := payload["muted"].(bool)
+	return trackID, media.Announcement{Source: source, Label: label, Muted: muted}, nil
+}
+
+// announceStreams records the "streams" an offer lists, [{trackId, type}],
+// as announcements of the tracks it is about to publish.
+func announceStreams(client *media.Client, room *media.Room, streams []interface{}) {
+	room.Do(func(map[string]*media.Client) {
+		for _, stream := range streams {
+			streamMap, ok := stream.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			trackID, _ := streamMap["trackId"].(string)
+			streamType, _ := streamMap["type"].(string)
+			source, known := legacySources[streamType]
+			if trackID == "" || !known {
+				continue
+			}
+			// a later announce-track for the same track is more precise
+			if _, announced := client.Announced[trackID]; !announced {
+				client.Announced[trackID] = media.Announcement{Source: source}
+			}
+		}
+	})
+}
+
+// handleAnnounceTrack records what a track of the client is, before it arrives
+// or, for a published track, as an update everyone is told about.
+func handleAnnounceTrack(client *media.Client, room *media.Room, payload map[string]interface{}) {
+	trackID, announcement, err := parseAnnouncement(payload)
+	if err != nil {
+		sendError(client, "invalid-track", err)
+		return
+	}
+	var updated map[string]interface{}
+	room.Do(func(map[string]*media.Client) {
+		client.Announced[trackID] = announcement
+		if t := room.Tracks.Get(client.UserID, trackID); t != nil {
+			t.Apply(announcement)
+			updated = t.Describe()
+		}
+	})
+	if updated == nil {
+		return
+	}
+	room.Broadcast(&message.Message{
+		Event:   "track-updated",
+		UserID:  client.UserID,
+		RoomID:  room.ID,
+		Payload: updated,
+	})
+}
+
+// handleDescribeTracks answers with every track published in the room.
+func handleDescribeTracks(client *media.Client, room *media.Room) {
+	var tracks []map[string]interface{}
+	room.Do(func(map[string]*media.Client) {
+		for _, t := range room.Tracks.All() {
+			tracks = append(tracks, t.Describe())
+		}
+	})
+	if tracks == nil {
+		tracks = []map[string]interface{}{}
+	}
+	client.SafeSend(message.Message{
+		Event:  "tracks",
+		UserID: client.UserID,
+		RoomID: room.ID,
+		Payload: map[string]interface{}{
+			"tracks": tracks,
+		},
+	})
+}
+
+// newTrack describes a track arriving from the client; the room's loop then
+// applies what the client announced about it.
+func newTrack(pc *webrtc.PeerConnection, remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) *media.Track {
+	t := &media.Track{
+		ID:       remoteTrack.ID(),
+		StreamID: remoteTrack.StreamID(),
+		Source:   media.DefaultSource(remoteTrack.Kind()),
+		Kind:     remoteTrack.Kind().String(),
+		Codec:    remoteTrack.Codec().MimeType,
+	}
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			t.Mid = transceiver.Mid()
+			break
+		}
+	}
+	if rid := remoteTrack.RID(); rid != "" {
+		t.Layers = []string{rid}
+	}
+	return t
+}
+
+// announce applies the client's announcement for t, on the room's loop. An
+// audio track announced as the screen is the screen's audio.
+func announce(client *media.Client, t *media.Track) {
+	if a, ok := client.Announced[t.ID]; ok {
+		t.Apply(a)
+	} else if t.Source == media.SourceCamera {
+		t.Muted = !client.IsCamOn
+	} else {
+		t.Muted = !client.IsMicOn
+	}
+	if t.Source == media.SourceScreen && t.Kind == webrtc.RTPCodecTypeAudio.String() {
+		t.Source = media.SourceScreenAudio
+	}
+}
+
+// setMediaMuted keeps the muted flag of the client's camera and microphone
+// tracks in line with a switch-camera-micro, on the room's loop.
+func setMediaMuted(room *media.Room, client *media.Client) {
+	for _, t := range room.Tracks.Of(client.UserID) {
+		switch t.Source {
+		case media.SourceCamera:
+			t.Muted = !client.IsCamOn
+		case media.SourceMicrophone:
+			t.Muted = !client.IsMicOn
+		}
+	}
+}
+
+// unpublish takes a track whose publisher stopped sending it out of the room.
+// A track removed with its publisher's departure is only closed.
+func unpublish(client *media.Client, room *media.Room, t *media.Track) {
+	if t.Keyframes != nil {
+		defer t.Keyframes.Close()
+	}
+	withdraw(room, client.UserID, func() []*media.Track {
+		if room.Tracks.Remove(t) {
+			return []*media.Track{t}
+		}
+		return nil
+	})
+}
+
+// withdraw unregisters the tracks of owner that remove returns, run on the
+// room's loop: subscribers drop them and everyone is told.
+func withdraw(room *media.Room, owner string, remove func() []*media.Track) {
+	var removed []*media.Track
+	var clientsToRenegotiate []subscriber
+	room.Do(func(clients map[string]*media.Client) {
+		if removed = remove(); len(removed) == 0 {
+			return
+		}
+		locals := map[webrtc.TrackLocal]bool{}
+		for _, t := range removed {
+			locals[t.Local] = true
+		}
+		for _, other := range clients {
+			if other.PeerConn == nil || other.UserID == owner {
+				continue
+			}
+			dropped := false
+			for _, sender := range other.PeerConn.GetSenders() {
+				if track := sender.Track(); track != nil && locals[track] {
+					dropped = other.PeerConn.RemoveTrack(sender) == nil || dropped
+				}
+			}
+			if dropped {
+				clientsToRenegotiate = append(clientsToRenegotiate, subscriber{other, other.PeerConn})
+			}
+		}
+	})
+	for _, other := range clientsToRenegotiate {
+		go renegotiate(other.client, other.pc)
+	}
+	for _, t := range removed {
+		room.Broadcast(&message.Message{
+			Event:  "track-removed",
+			UserID: owner,
+			RoomID: room.ID,
+			Payload: map[string]interface{}{
+				"trackId": t.ID,
+				"source":  t.Source,
+			},
+		})
+	}
+}
+
+// drainTrack reads a track that is not forwarded until it ends, so its
+// packets don't pile up in the receiver.
+func drainTrack(remoteTrack *webrtc.TrackRemote) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := remoteTrack.Read(buf); err != nil {
+			return
+		}
+	}
+}
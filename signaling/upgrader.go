@@ -1,7 +1,6 @@
 package signaling
 
 import (
-	"mediaserver/utils/dotenv"
 	"net/http"
 
 	"github.com/gorilla/websocket"
@@ -11,7 +10,6 @@ var upgrader = websocket.Upgrader{
 	ReadBufferSize:  65536,
 	WriteBufferSize: 65536,
 	CheckOrigin: func(r *http.Request) bool {
-		origin := r.Header.Get("Origin")
-		return origin == dotenv.GetDotEnv("FE_URL")+":"+dotenv.GetDotEnv("FE_PORT")
+		return currentConfig().CORS.Policy.Allowed(r.Header.Get("Origin"))
 	},
 }
@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// FirstPacket returns an interceptor calling fn once, when the first RTP
+// packet is sent on the peer connection, with the kind of its track. For a
+// subscriber that is the moment media starts flowing to the browser.
+func FirstPacket(fn func(kind string)) interceptor.Factory {
+	return firstPacketFactory{fn: fn}
+}
+
+type firstPacketFactory struct {
+	fn func(kind string)
+}
+
+func (f firstPacketFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &firstPacket{fn: f.fn}, nil
+}
+
+type firstPacket struct {
+	interceptor.NoOp
+	once sync.Once
+	fn   func(kind string)
+}
+
+func (i *firstPacket) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	kind := "audio"
+	if strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		kind = "video"
+	}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, a)
+		if err == nil {
+			i.once.Do(func() { i.fn(kind) })
+		}
+		return n, err
+	})
+}
@@ -0,0 +1,152 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+type Config struct {
+	// none, stdout or otlp
+	Exporter string
+	// OTLP/HTTP collector, the /v1/traces path is added when missing
+	OTLPEndpoint string
+	// fraction of joins traced, between 0 and 1
+	SampleRatio float64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Exporter:     ExporterNone,
+		OTLPEndpoint: "http://localhost:4318",
+		SampleRatio:  1,
+	}
+}
+
+// LoadConfig reads the tracing settings from configuration keys, get returns
+// "" for unset keys.
+func LoadConfig(get func(key string) string) (Config, error) {
+	c := DefaultConfig()
+	if v := get("TRACING_EXPORTER"); v != "" {
+		c.Exporter = strings.ToLower(v)
+	}
+	if v := get("TRACING_OTLP_ENDPOINT"); v != "" {
+		c.OTLPEndpoint = v
+	}
+	if v := get("TRACING_SAMPLE_RATIO"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return c, fmt.Errorf("TRACING_SAMPLE_RATIO: %w", err)
+		}
+		c.SampleRatio = ratio
+	}
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	switch c.Exporter {
+	case ExporterNone, ExporterStdout, ExporterOTLP:
+	default:
+		return fmt.Errorf("tracing: unknown exporter %q, use none, stdout or otlp", c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("tracing: sample ratio %v is not between 0 and 1", c.SampleRatio)
+	}
+	return nil
+}
+
+// NewExporter returns the span exporter selected by c, nil for "none". Any
+// sdktrace.SpanExporter can be given to Start instead.
+func NewExporter(ctx context.Context, c Config) (sdktrace.SpanExporter, error) {
+	switch c.Exporter {
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		return otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(c.OTLPEndpoint))
+	}
+	return nil, nil
+}
+
+// Start installs the global tracer provider exporting to exporter. Without an
+// exporter the spans stay no-ops. The returned function flushes the pending
+// spans.
+func Start(c Config, exporter sdktrace.SpanExporter) func(context.Context) error {
+	if exporter == nil {
+		return func(context.Context) error { return nil }
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "mediaserver"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer("mediaserver")
+}
+
+// Participant returns the attributes set on every span of a participant.
+func Participant(roomID, userID string) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("room.id", roomID),
+		attribute.String("user.id", userID),
+	)
+}
+
+// Pending holds a span that ends on a later event, like a participant's join
+// that ends with the first media packet or a renegotiation waiting for the
+// browser's answer.
+type Pending struct {
+	mu   sync.Mutex
+	span trace.Span
+}
+
+// Set makes span the pending one, ending the previous span if any.
+func (p *Pending) Set(span trace.Span) {
+	p.mu.Lock()
+	previous := p.span
+	p.span = span
+	p.mu.Unlock()
+	if previous != nil {
+		previous.SetAttributes(attribute.Bool("superseded", true))
+		previous.End()
+	}
+}
+
+// Span returns the pending span, nil once it ended.
+func (p *Pending) Span() trace.Span {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.span
+}
+
+// End ends the pending span, if any, after applying the attributes.
+func (p *Pending) End(attrs ...attribute.KeyValue) {
+	p.mu.Lock()
+	span := p.span
+	p.span = nil
+	p.mu.Unlock()
+	if span != nil {
+		span.SetAttributes(attrs...)
+		span.End()
+	}
+}
@@ -0,0 +1,372 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediaserver/history"
+	"mediaserver/media/codec"
+	"mediaserver/media/ice"
+	"mediaserver/media/keyframe"
+	"mediaserver/media/pipeline"
+	"mediaserver/media/quality"
+	"mediaserver/media/share"
+	"mediaserver/media/socket"
+	"mediaserver/tracing"
+	"mediaserver/utils/logging"
+	"mediaserver/utils/origin"
+	"mediaserver/webhook"
+
+	"github.com/joho/godotenv"
+)
+
+const DefaultFile = "cmd/config/.env"
+
+type ServerConfig struct {
+	Port    int
+	TLS     bool
+	TLSCert string
+	TLSKey  string
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string
+	DevMode        bool
+	// compiled from AllowedOrigins and DevMode, used by both the CORS
+	// middleware and the WebSocket upgrader
+	Policy *origin.Policy
+}
+
+type RoomsConfig struct {
+	// 0 means unlimited
+	MaxRooms        int
+	MaxParticipants int
+	// signs the host tokens; when empty, the user creating a room as a host
+	// is its only host
+	HostTokenSecret string
+	// how long a user waits in the lobby while no host is in the room, 0
+	// waits forever
+	LobbyTimeout time.Duration
+}
+
+// RateLimitConfig bounds the messages each client sends.
+type RateLimitConfig struct {
+	// per second on average and in a burst, a rate of 0 means unlimited
+	MessageRate  float64
+	MessageBurst int
+}
+
+type MetricsConfig struct {
+	Enabled bool
+	Path    string
+}
+
+type AdminConfig struct {
+	// bearer token of the admin API, the API is disabled when empty
+	Token string
+}
+
+type Config struct {
+	Server       ServerConfig
+	Admin        AdminConfig
+	Metrics      MetricsConfig
+	CORS         CORSConfig
+	Rooms        RoomsConfig
+	RateLimit    RateLimitConfig
+	Share        share.Policy
+	Log          logging.Config
+	Codec        codec.Policy
+	Interceptors pipeline.Config
+	ICE          ice.Config
+	Keyframes    keyframe.Config
+	Stats        quality.Config
+	WebSocket    socket.Config
+	Tracing      tracing.Config
+	Webhook      webhook.Config
+	History      history.Config
+}
+
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:    8081,
+			TLS:     true,
+			TLSCert: "cert.pem",
+			TLSKey:  "key.pem",
+		},
+		Rooms: RoomsConfig{
+			LobbyTimeout: 5 * time.Minute,
+		},
+		RateLimit: RateLimitConfig{
+			MessageRate:  20,
+			MessageBurst: 100,
+		},
+		Log: logging.DefaultConfig(),
+		Metrics: MetricsConfig{
+			Enabled: true,
+			Path:    "/metrics",
+		},
+		Share:        share.DefaultPolicy(),
+		Codec:        codec.DefaultPolicy(),
+		Interceptors: pipeline.DefaultConfig(),
+		ICE:          ice.DefaultConfig(),
+		Keyframes:    keyframe.DefaultConfig(),
+		Stats:        quality.DefaultConfig(),
+		WebSocket:    socket.DefaultConfig(),
+		Tracing:      tracing.DefaultConfig(),
+		Webhook:      webhook.DefaultConfig(),
+		History:      history.DefaultConfig(),
+	}
+}
+
+// Load builds the configuration from, in increasing priority, the defaults,
+// the config file, the environment and the command line flags. The file uses
+// the .env format; a missing file is only an error when it was asked for
+// explicitly with -config or CONFIG_FILE.
+func Load(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("mediaserver", flag.ContinueOnError)
+	file := flags.String("config", "", "path of the configuration file (default "+DefaultFile+")")
+	port := flags.Int("port", 0, "HTTP(S) listen port")
+	tlsCert := flags.String("tls-cert", "", "TLS certificate file")
+	tlsKey := flags.String("tls-key", "", "TLS private key file")
+	logLevel := flags.String("log-level", "", "log level: debug, info, warn, error")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path, explicit := *file, *file != ""
+	if !explicit {
+		path, explicit = os.Getenv("CONFIG_FILE"), os.Getenv("CONFIG_FILE") != ""
+	}
+	if !explicit {
+		path = DefaultFile
+	}
+	fileValues, err := godotenv.Read(path)
+	if err != nil {
+		if explicit || !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("config: reading %s: %w", path, err)
+		}
+		fileValues = map[string]string{}
+	}
+
+	get := func(key string) string {
+		if v, ok := os.LookupEnv(key); ok {
+			return strings.TrimSpace(v)
+		}
+		return strings.TrimSpace(fileValues[key])
+	}
+	c, err := fromLookup(get)
+	if err != nil {
+		return nil, err
+	}
+
+	if *port != 0 {
+		c.Server.Port = *port
+	}
+	if *tlsCert != "" {
+		c.Server.TLSCert = *tlsCert
+	}
+	if *tlsKey != "" {
+		c.Server.TLSKey = *tlsKey
+	}
+	if *logLevel != "" {
+		c.Log.Level = strings.ToLower(*logLevel)
+	}
+	return c, c.Validate()
+}
+
+func fromLookup(get func(string) string) (*Config, error) {
+	c := Default()
+	var err error
+
+	if c.Server.Port, err = getInt(get, "APP_PORT", c.Server.Port); err != nil {
+		return nil, err
+	}
+	if v := get("TLS_ENABLED"); v != "" {
+		if c.Server.TLS, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("config: TLS_ENABLED: %w", err)
+		}
+	}
+	if v := get("TLS_CERT_FILE"); v != "" {
+		c.Server.TLSCert = v
+	}
+	if v := get("TLS_KEY_FILE"); v != "" {
+		c.Server.TLSKey = v
+	}
+
+	c.CORS.AllowedOrigins = splitList(get("CORS_ALLOWED_ORIGINS"))
+	// FE_URL/FE_PORT is the older single origin setting
+	if len(c.CORS.AllowedOrigins) == 0 && get("FE_URL") != "" {
+		frontend := get("FE_URL")
+		if get("FE_PORT") != "" {
+			frontend += ":" + get("FE_PORT")
+		}
+		c.CORS.AllowedOrigins = []string{frontend}
+	}
+	if v := get("CORS_DEV_MODE"); v != "" {
+		if c.CORS.DevMode, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("config: CORS_DEV_MODE: %w", err)
+		}
+	}
+	if c.CORS.Policy, err = origin.NewPolicy(c.CORS.AllowedOrigins, c.CORS.DevMode); err != nil {
+		return nil, fmt.Errorf("config: CORS_ALLOWED_ORIGINS: %w", err)
+	}
+
+	if c.Rooms.MaxRooms, err = getInt(get, "MAX_ROOMS", c.Rooms.MaxRooms); err != nil {
+		return nil, err
+	}
+	if c.Rooms.MaxParticipants, err = getInt(get, "MAX_PARTICIPANTS_PER_ROOM", c.Rooms.MaxParticipants); err != nil {
+		return nil, err
+	}
+	c.Rooms.HostTokenSecret = get("HOST_TOKEN_SECRET")
+	if v := get("LOBBY_TIMEOUT"); v != "" {
+		if c.Rooms.LobbyTimeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("config: LOBBY_TIMEOUT: %w", err)
+		}
+	}
+
+	if v := get("WS_MESSAGE_RATE"); v != "" {
+		if c.RateLimit.MessageRate, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("config: WS_MESSAGE_RATE: %w", err)
+		}
+	}
+	if c.RateLimit.MessageBurst, err = getInt(get, "WS_MESSAGE_BURST", c.RateLimit.MessageBurst); err != nil {
+		return nil, err
+	}
+
+	c.Admin.Token = get("ADMIN_TOKEN")
+
+	if v := get("METRICS_ENABLED"); v != "" {
+		if c.Metrics.Enabled, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("config: METRICS_ENABLED: %w", err)
+		}
+	}
+	if v := get("METRICS_PATH"); v != "" {
+		c.Metrics.Path = v
+	}
+
+	if c.Share, err = share.LoadPolicy(get); err != nil {
+		return nil, err
+	}
+
+	if c.Log, err = logging.LoadConfig(get); err != nil {
+		return nil, err
+	}
+	if c.Codec, err = codec.LoadPolicy(get); err != nil {
+		return nil, err
+	}
+	if c.Interceptors, err = pipeline.LoadConfig(get); err != nil {
+		return nil, err
+	}
+	if c.ICE, err = ice.LoadConfig(get); err != nil {
+		return nil, err
+	}
+	if c.Keyframes, err = keyframe.LoadConfig(get); err != nil {
+		return nil, err
+	}
+	if c.Stats, err = quality.LoadConfig(get); err != nil {
+		return nil, err
+	}
+	if c.WebSocket, err = socket.LoadConfig(get); err != nil {
+		return nil, err
+	}
+	if c.Tracing, err = tracing.LoadConfig(get); err != nil {
+		return nil, err
+	}
+	if c.Webhook, err = webhook.LoadConfig(get); err != nil {
+		return nil, err
+	}
+	if c.History, err = history.LoadConfig(get); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) Validate() error {
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		return fmt.Errorf("config: invalid port %d", c.Server.Port)
+	}
+	if c.Server.TLS {
+		for _, path := range []string{c.Server.TLSCert, c.Server.TLSKey} {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("config: TLS file: %w", err)
+			}
+		}
+	}
+	if c.CORS.Policy == nil {
+		return errors.New("config: CORS_ALLOWED_ORIGINS (or FE_URL) must be set")
+	}
+	if c.Rooms.MaxRooms < 0 || c.Rooms.MaxParticipants < 0 {
+		return errors.New("config: room limits cannot be negative")
+	}
+	if c.Rooms.LobbyTimeout < 0 {
+		return errors.New("config: LOBBY_TIMEOUT cannot be negative")
+	}
+	if c.RateLimit.MessageRate < 0 {
+		return errors.New("config: WS_MESSAGE_RATE cannot be negative")
+	}
+	if c.RateLimit.MessageRate > 0 && c.RateLimit.MessageBurst < 1 {
+		return errors.New("config: WS_MESSAGE_BURST must be at least 1 with a message rate")
+	}
+	if c.Metrics.Enabled && !strings.HasPrefix(c.Metrics.Path, "/") {
+		return fmt.Errorf("config: METRICS_PATH %q must start with /", c.Metrics.Path)
+	}
+	if err := c.Share.Validate(); err != nil {
+		return err
+	}
+	if err := c.Log.Validate(); err != nil {
+		return err
+	}
+	if err := c.Codec.Validate(); err != nil {
+		return err
+	}
+	if err := c.Interceptors.Validate(); err != nil {
+		return err
+	}
+	if err := c.ICE.Validate(); err != nil {
+		return err
+	}
+	if err := c.Keyframes.Validate(); err != nil {
+		return err
+	}
+	if err := c.Stats.Validate(); err != nil {
+		return err
+	}
+	if err := c.WebSocket.Validate(); err != nil {
+		return err
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+	if err := c.Webhook.Validate(); err != nil {
+		return err
+	}
+	return c.History.Validate()
+}
+
+func getInt(get func(string) string, key string, fallback int) (int, error) {
+	v := get(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("config: %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
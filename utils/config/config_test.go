@@ -0,0 +1,153 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mediaserver/history"
+)
+
+// minimal is the smallest valid configuration: an origin and no TLS files.
+const minimal = "FE_URL=http://localhost:4200\nTLS_ENABLED=false\n"
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := Load([]string{"-config", writeFile(t, minimal)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"port", c.Server.Port, 8081},
+		{"tls", c.Server.TLS, false},
+		{"origins", strings.Join(c.CORS.AllowedOrigins, ","), "http://localhost:4200"},
+		{"lobby timeout", c.Rooms.LobbyTimeout, 5 * time.Minute},
+		{"message rate", c.RateLimit.MessageRate, 20.0},
+		{"message burst", c.RateLimit.MessageBurst, 100},
+		{"metrics", c.Metrics, MetricsConfig{Enabled: true, Path: "/metrics"}},
+		{"log level", c.Log.Level, "info"},
+		{"history", c.History.Driver, history.DriverNone},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadPriority(t *testing.T) {
+	file := minimal + "APP_PORT=9000\nLOG_LEVEL=warn\nFE_PORT=4300\n"
+	tests := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		wantPort int
+		wantLog  string
+	}{
+		{"file", nil, nil, 9000, "warn"},
+		{"environment over the file", map[string]string{"APP_PORT": "9100", "LOG_LEVEL": "error"}, nil, 9100, "error"},
+		{"flags over the environment", map[string]string{"APP_PORT": "9100"}, []string{"-port", "9200", "-log-level", "DEBUG"}, 9200, "debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, v := range tt.env {
+				t.Setenv(key, v)
+			}
+			c, err := Load(append([]string{"-config", writeFile(t, file)}, tt.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Server.Port != tt.wantPort {
+				t.Errorf("port = %d, want %d", c.Server.Port, tt.wantPort)
+			}
+			if c.Log.Level != tt.wantLog {
+				t.Errorf("log level = %q, want %q", c.Log.Level, tt.wantLog)
+			}
+			if origins := strings.Join(c.CORS.AllowedOrigins, ","); origins != "http://localhost:4200:4300" {
+				t.Errorf("origins = %q, want FE_URL with FE_PORT", origins)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnvironment(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, minimal+"APP_PORT=9300\n"))
+	c, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server.Port != 9300 {
+		t.Errorf("port = %d, want 9300 from CONFIG_FILE", c.Server.Port)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		// part of the error
+		want string
+	}{
+		{"tls not a boolean", minimal, map[string]string{"TLS_ENABLED": "maybe"}, nil, "TLS_ENABLED"},
+		{"port not a number", minimal + "APP_PORT=eighty\n", nil, nil, "APP_PORT"},
+		{"port zero", minimal + "APP_PORT=0\n", nil, nil, "invalid port 0"},
+		{"port too high", minimal, map[string]string{"APP_PORT": "70000"}, nil, "invalid port 70000"},
+		{"port flag too high", minimal, nil, []string{"-port", "65536"}, "invalid port 65536"},
+		{"no origin", "TLS_ENABLED=false\n", nil, nil, "CORS_ALLOWED_ORIGINS"},
+		{"tls files missing", "FE_URL=http://localhost:4200\nTLS_CERT_FILE=/nonexistent/cert.pem\n", nil, nil, "TLS file"},
+		{"negative room limit", minimal + "MAX_ROOMS=-1\n", nil, nil, "room limits"},
+		{"lobby timeout not a duration", minimal + "LOBBY_TIMEOUT=5\n", nil, nil, "LOBBY_TIMEOUT"},
+		{"burst below one", minimal + "WS_MESSAGE_BURST=0\n", nil, nil, "WS_MESSAGE_BURST"},
+		{"metrics path", minimal + "METRICS_PATH=metrics\n", nil, nil, "METRICS_PATH"},
+		{"unknown history driver", minimal + "HISTORY_DRIVER=postgres\n", nil, nil, "unknown driver"},
+		{"unknown flag", minimal, nil, []string{"-verbose"}, "-verbose"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, v := range tt.env {
+				t.Setenv(key, v)
+			}
+			_, err := Load(append([]string{"-config", writeFile(t, tt.file)}, tt.args...))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one about %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.env")
+	if _, err := Load([]string{"-config", missing}); err == nil {
+		t.Error("a missing -config file was accepted")
+	}
+
+	// the default file is optional
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("FE_URL", "http://localhost:4200")
+	t.Setenv("TLS_ENABLED", "false")
+	if _, err := Load(nil); err != nil {
+		t.Errorf("without the default file: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Store holds the live configuration. Reload re-reads the same sources as the
+// first Load and swaps in the sections that can change while rooms are
+// running; the others keep their startup value until the next restart.
+type Store struct {
+	args     []string
+	current  atomic.Pointer[Config]
+	mu       sync.Mutex
+	onReload []func(*Config)
+}
+
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+func NewStore(args []string) (*Store, error) {
+	c, err := Load(args)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{args: args}
+	s.current.Store(c)
+	return s, nil
+}
+
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// OnReload registers fn to run with the new configuration after every
+// successful reload.
+func (s *Store) OnReload(fn func(*Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onReload = append(s.onReload, fn)
+}
+
+func (s *Store) Reload() (*ReloadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loaded, err := Load(s.args)
+	if err != nil {
+		return nil, err
+	}
+	old := s.Current()
+	next := *old
+	result := &ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+
+	live := func(name string, changed bool, apply func()) {
+		if changed {
+			apply()
+			result.Applied = append(result.Applied, name)
+		}
+	}
+	live("cors", !reflect.DeepEqual(old.CORS, loaded.CORS), func() { next.CORS = loaded.CORS })
+	live("rooms", old.Rooms != loaded.Rooms, func() { next.Rooms = loaded.Rooms })
+	// the message rate limit applies to every client at once
+	live("rateLimit", old.RateLimit != loaded.RateLimit, func() { next.RateLimit = loaded.RateLimit })
+	live("share", old.Share != loaded.Share, func() { next.Share = loaded.Share })
+	levelsChanged := old.Log.Level != loaded.Log.Level || !reflect.DeepEqual(old.Log.Modules, loaded.Log.Modules)
+	live("log.level", levelsChanged, func() {
+		next.Log.Level = loaded.Log.Level
+		next.Log.Modules = loaded.Log.Modules
+	})
+	live("codec", !reflect.DeepEqual(old.Codec, loaded.Codec), func() { next.Codec = loaded.Codec })
+	live("interceptors", old.Interceptors != loaded.Interceptors, func() { next.Interceptors = loaded.Interceptors })
+	live("keyframes", old.Keyframes != loaded.Keyframes, func() { next.Keyframes = loaded.Keyframes })
+	live("stats", old.Stats != loaded.Stats, func() { next.Stats = loaded.Stats })
+	// new connections take the new queue size and timeouts
+	live("websocket", old.WebSocket != loaded.WebSocket, func() { next.WebSocket = loaded.WebSocket })
+	// the queue and its workers are sized once at startup
+	webhookChanged := !reflect.DeepEqual(old.Webhook.URLs, loaded.Webhook.URLs) ||
+		!reflect.DeepEqual(old.Webhook.Events, loaded.Webhook.Events) ||
+		old.Webhook.Secret != loaded.Webhook.Secret ||
+		old.Webhook.MaxAttempts != loaded.Webhook.MaxAttempts ||
+		old.Webhook.Timeout != loaded.Webhook.Timeout
+	live("webhook", webhookChanged, func() {
+		next.Webhook.URLs = loaded.Webhook.URLs
+		next.Webhook.Events = loaded.Webhook.Events
+		next.Webhook.Secret = loaded.Webhook.Secret
+		next.Webhook.MaxAttempts = loaded.Webhook.MaxAttempts
+		next.Webhook.Timeout = loaded.Webhook.Timeout
+	})
+	iceServersChanged := !reflect.DeepEqual(old.ICE.STUNURLs, loaded.ICE.STUNURLs) ||
+		!reflect.DeepEqual(old.ICE.TURNURLs, loaded.ICE.TURNURLs) ||
+		old.ICE.TURNUsername != loaded.ICE.TURNUsername ||
+		old.ICE.TURNCredential != loaded.ICE.TURNCredential ||
+		old.ICE.CredentialTTL != loaded.ICE.CredentialTTL
+	live("ice.servers", iceServersChanged, func() {
+		next.ICE.STUNURLs = loaded.ICE.STUNURLs
+		next.ICE.TURNURLs = loaded.ICE.TURNURLs
+		next.ICE.TURNUsername = loaded.ICE.TURNUsername
+		next.ICE.TURNCredential = loaded.ICE.TURNCredential
+		next.ICE.CredentialTTL = loaded.ICE.CredentialTTL
+	})
+	// the embedded TURN server checks credentials with the secret it started with
+	secretChanged := old.ICE.TURNSecret != loaded.ICE.TURNSecret
+	if !old.ICE.TURNServer.Enabled {
+		live("ice.turnSecret", secretChanged, func() { next.ICE.TURNSecret = loaded.ICE.TURNSecret })
+	}
+
+	restart := func(name string, changed bool) {
+		if changed {
+			result.RestartRequired = append(result.RestartRequired, name)
+		}
+	}
+	restart("server", old.Server != loaded.Server)
+	restart("log.file", old.Log.File != loaded.Log.File)
+	restart("log.format", old.Log.Format != loaded.Log.Format)
+	restart("admin", old.Admin != loaded.Admin)
+	restart("metrics", old.Metrics != loaded.Metrics)
+	restart("tracing", old.Tracing != loaded.Tracing)
+	restart("history", old.History != loaded.History)
+	restart("webhook.queue", old.Webhook.QueueSize != loaded.Webhook.QueueSize || old.Webhook.Workers != loaded.Webhook.Workers)
+	restart("ice.turnSecret", old.ICE.TURNServer.Enabled && secretChanged)
+	restart("ice.turnServer", old.ICE.TURNServer != loaded.ICE.TURNServer)
+	restart("ice.network", !reflect.DeepEqual(old.ICE.Network, loaded.ICE.Network))
+
+	if len(result.Applied) > 0 {
+		s.current.Store(&next)
+		for _, fn := range s.onReload {
+			fn(&next)
+		}
+	}
+	return result, nil
+}
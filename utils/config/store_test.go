@@ -0,0 +1,122 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const turnServer = "TURN_ENABLED=true\nTURN_PUBLIC_IP=203.0.113.7\n"
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name string
+		// extra lines of the file at startup and at the reload
+		start, reloaded string
+		applied         string
+		restart         string
+	}{
+		{"unchanged", "LOG_LEVEL=warn\n", "LOG_LEVEL=warn\n", "", ""},
+		{"rooms", "", "MAX_ROOMS=5\nLOBBY_TIMEOUT=1m\n", "rooms", ""},
+		{"rate limit", "", "WS_MESSAGE_RATE=5\n", "rateLimit", ""},
+		{"origins", "", "CORS_ALLOWED_ORIGINS=https://app.example.edu\n", "cors", ""},
+		{"log level and modules", "", "LOG_LEVEL=debug\nLOG_MODULES=room=warn\n", "log.level", ""},
+		{"log format", "", "LOG_FORMAT=json\n", "", "log.format"},
+		{"port", "", "APP_PORT=9000\n", "", "server"},
+		{"metrics", "", "METRICS_PATH=/stats\n", "", "metrics"},
+		{"history", "", "HISTORY_DRIVER=sqlite\n", "", "history"},
+		{"webhook targets", "", "WEBHOOK_URLS=https://example.com/hook\n", "webhook", ""},
+		{"webhook workers", "", "WEBHOOK_WORKERS=8\n", "", "webhook.queue"},
+		{"stun servers", "", "ICE_STUN_URLS=stun:stun.example.com:3478\n", "ice.servers", ""},
+		{"turn secret without the server", "TURN_SECRET=a\n", "TURN_SECRET=b\n", "ice.turnSecret", ""},
+		{"turn secret of the running server", turnServer + "TURN_SECRET=a\n", turnServer + "TURN_SECRET=b\n", "", "ice.turnSecret"},
+		{"live and restart together", "", "LOG_LEVEL=debug\nAPP_PORT=9000\n", "log.level", "server"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, minimal+tt.start)
+			s, err := NewStore([]string{"-config", path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := s.Current()
+			var notified *Config
+			s.OnReload(func(c *Config) { notified = c })
+
+			if err := os.WriteFile(path, []byte(minimal+tt.reloaded), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			result, err := s.Reload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(result.Applied, ","); got != tt.applied {
+				t.Errorf("applied %q, want %q", got, tt.applied)
+			}
+			if got := strings.Join(result.RestartRequired, ","); got != tt.restart {
+				t.Errorf("restart required for %q, want %q", got, tt.restart)
+			}
+			// only live changes swap the configuration and notify
+			if swapped := s.Current() != old; swapped != (tt.applied != "") {
+				t.Errorf("configuration swapped = %v with %q applied", swapped, tt.applied)
+			}
+			if (notified != nil) != (tt.applied != "") || (notified != nil && notified != s.Current()) {
+				t.Errorf("OnReload got %p, want the current configuration %p when applied", notified, s.Current())
+			}
+		})
+	}
+}
+
+func TestReloadKeepsRestartSections(t *testing.T) {
+	path := writeFile(t, minimal)
+	s, err := NewStore([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(minimal+"APP_PORT=9000\nLOBBY_TIMEOUT=1m\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	c := s.Current()
+	if c.Rooms.LobbyTimeout != time.Minute {
+		t.Errorf("lobby timeout = %v, want the reloaded 1m", c.Rooms.LobbyTimeout)
+	}
+	if c.Server.Port != 8081 {
+		t.Errorf("port = %d, want 8081 until a restart", c.Server.Port)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		reloaded string
+	}{
+		{"not a number", minimal + "LOBBY_TIMEOUT=1m\nAPP_PORT=eighty\n"},
+		{"fails validation", minimal + "LOBBY_TIMEOUT=1m\nWS_MESSAGE_RATE=-1\n"},
+		{"no origin left", "TLS_ENABLED=false\nLOBBY_TIMEOUT=1m\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, minimal)
+			s, err := NewStore([]string{"-config", path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := s.Current()
+			s.OnReload(func(*Config) { t.Error("OnReload called for a rejected reload") })
+
+			if err := os.WriteFile(path, []byte(tt.reloaded), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if result, err := s.Reload(); err == nil {
+				t.Fatalf("reload accepted: %+v", result)
+			}
+			if s.Current() != old {
+				t.Error("a rejected reload replaced the configuration")
+			}
+		})
+	}
+}
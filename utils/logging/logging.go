@@ -0,0 +1,190 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Config selects the log format and the level of each module. A module is
+// the name given to For, usually the package name.
+type Config struct {
+	Level  string
+	Format string
+	File   string
+	// module name -> level, overriding Level for that module
+	Modules map[string]string
+}
+
+func DefaultConfig() Config {
+	return Config{Level: "info", Format: "text"}
+}
+
+// LoadConfig reads the logging settings from configuration keys, get returns
+// "" for unset keys. LOG_MODULES looks like "signaling=debug,mixer=warn".
+func LoadConfig(get func(key string) string) (Config, error) {
+	c := DefaultConfig()
+	if v := get("LOG_LEVEL"); v != "" {
+		c.Level = strings.ToLower(v)
+	}
+	if v := get("LOG_FORMAT"); v != "" {
+		c.Format = strings.ToLower(v)
+	}
+	c.File = get("LOG_FILE")
+	for _, item := range strings.Split(get("LOG_MODULES"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		module, level, ok := strings.Cut(item, "=")
+		if !ok {
+			return c, fmt.Errorf("LOG_MODULES: %q must look like module=level", item)
+		}
+		if c.Modules == nil {
+			c.Modules = map[string]string{}
+		}
+		c.Modules[strings.TrimSpace(module)] = strings.ToLower(strings.TrimSpace(level))
+	}
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	if _, err := parseLevel(c.Level); err != nil {
+		return err
+	}
+	for module, level := range c.Modules {
+		if _, err := parseLevel(level); err != nil {
+			return fmt.Errorf("%w for module %s", err, module)
+		}
+	}
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("logging: unknown format %q, use text or json", c.Format)
+	}
+	return nil
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	switch s {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("logging: unknown level %q", s)
+}
+
+type levels struct {
+	fallback slog.Level
+	modules  map[string]slog.Level
+}
+
+func (l *levels) of(module string) slog.Level {
+	if level, ok := l.modules[module]; ok {
+		return level
+	}
+	return l.fallback
+}
+
+var (
+	output  atomic.Pointer[slog.Handler]
+	current atomic.Pointer[levels]
+)
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	output.Store(&h)
+	current.Store(&levels{fallback: slog.LevelInfo})
+}
+
+// Setup sends every logger to w in the configured format. It also becomes the
+// handler of the standard log package, at info level, for the libraries that
+// still use it.
+func Setup(c Config, w io.Writer) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	if c.Format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	output.Store(&h)
+	if err := SetLevels(c); err != nil {
+		return err
+	}
+	slog.SetDefault(For("log"))
+	return nil
+}
+
+// SetLevels changes the levels of every logger, including the ones already
+// handed out by For.
+func SetLevels(c Config) error {
+	fallback, err := parseLevel(c.Level)
+	if err != nil {
+		return err
+	}
+	l := &levels{fallback: fallback, modules: map[string]slog.Level{}}
+	for module, name := range c.Modules {
+		if l.modules[module], err = parseLevel(name); err != nil {
+			return err
+		}
+	}
+	current.Store(l)
+	return nil
+}
+
+// For returns the logger of a module. Loggers can be created before Setup, for
+// example in package variables; they follow the handler and levels in effect
+// when they write.
+func For(module string) *slog.Logger {
+	return slog.New(&moduleHandler{module: module})
+}
+
+// moduleHandler filters on the module level and resolves the output handler on
+// every record, so Setup and SetLevels apply to existing loggers.
+type moduleHandler struct {
+	module string
+	attrs  []slog.Attr
+	// set once WithGroup was called; attributes after a group have to be
+	// nested, so the output handler is bound at that point
+	bound slog.Handler
+}
+
+func (h *moduleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= current.Load().of(h.module)
+}
+
+func (h *moduleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.bound != nil {
+		return h.bound.Handle(ctx, r)
+	}
+	return h.resolve().Handle(ctx, r)
+}
+
+func (h *moduleHandler) resolve() slog.Handler {
+	attrs := append([]slog.Attr{slog.String("module", h.module)}, h.attrs...)
+	return (*output.Load()).WithAttrs(attrs)
+}
+
+func (h *moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if h.bound != nil {
+		return &moduleHandler{module: h.module, bound: h.bound.WithAttrs(attrs)}
+	}
+	all := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	all = append(append(all, h.attrs...), attrs...)
+	return &moduleHandler{module: h.module, attrs: all}
+}
+
+func (h *moduleHandler) WithGroup(name string) slog.Handler {
+	if h.bound != nil {
+		return &moduleHandler{module: h.module, bound: h.bound.WithGroup(name)}
+	}
+	return &moduleHandler{module: h.module, bound: h.resolve().WithGroup(name)}
+}
@@ -0,0 +1,104 @@
+package origin
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Policy decides which browser origins may use the HTTP API and open the
+// media WebSocket. The CORS middleware and the upgrader share one Policy so
+// they always agree.
+//
+// Patterns are full origins such as "https://app.example.edu",
+// "https://*.example.edu" (any subdomain, not the apex) or
+// "capacitor://localhost". The scheme always has to match, and the port has to
+// match when the pattern has one, otherwise the origin must use the default
+// port. DevMode accepts every origin and is meant for local development only.
+type Policy struct {
+	DevMode bool
+	rules   []rule
+}
+
+type rule struct {
+	scheme string
+	host   string
+	port   string
+	// host is a suffix like ".example.edu"
+	wildcard bool
+}
+
+func NewPolicy(patterns []string, devMode bool) (*Policy, error) {
+	p := &Policy{DevMode: devMode}
+	for _, pattern := range patterns {
+		r, err := parseRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, r)
+	}
+	if len(p.rules) == 0 && !devMode {
+		return nil, fmt.Errorf("origin: no allowed origins configured")
+	}
+	return p, nil
+}
+
+func parseRule(pattern string) (rule, error) {
+	scheme, rest, ok := strings.Cut(strings.ToLower(strings.TrimSuffix(pattern, "/")), "://")
+	if !ok || scheme == "" || rest == "" {
+		return rule{}, fmt.Errorf("origin: %q must look like scheme://host[:port]", pattern)
+	}
+	if strings.ContainsAny(rest, "/?#") {
+		return rule{}, fmt.Errorf("origin: %q must not contain a path", pattern)
+	}
+
+	host, port := splitHostPort(rest)
+	r := rule{scheme: scheme, host: host, port: port}
+	if strings.HasPrefix(host, "*.") {
+		r.wildcard = true
+		r.host = host[1:]
+	}
+	if strings.Contains(r.host, "*") || r.host == "." {
+		return rule{}, fmt.Errorf("origin: %q may only use a leading \"*.\" wildcard", pattern)
+	}
+	return r, nil
+}
+
+func (p *Policy) Allowed(origin string) bool {
+	if p == nil {
+		return false
+	}
+	if p.DevMode {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return false
+	}
+	host, port := splitHostPort(u.Host)
+	for _, r := range p.rules {
+		if r.matches(u.Scheme, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rule) matches(scheme, host, port string) bool {
+	if scheme != r.scheme || port != r.port {
+		return false
+	}
+	if r.wildcard {
+		return strings.HasSuffix(host, r.host) && len(host) > len(r.host)
+	}
+	return host == r.host
+}
+
+// splitHostPort keeps IPv6 brackets and does not fail on a missing port.
+func splitHostPort(hostport string) (string, string) {
+	i := strings.LastIndex(hostport, ":")
+	if i < 0 || i < strings.LastIndex(hostport, "]") {
+		return hostport, ""
+	}
+	return hostport[:i], hostport[i+1:]
+}
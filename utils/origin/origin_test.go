@@ -0,0 +1,78 @@
+package origin
+
+import "testing"
+
+func TestPolicyAllowed(t *testing.T) {
+	policy, err := NewPolicy([]string{
+		"https://app.example.edu",
+		"https://*.school.edu",
+		"http://localhost:4200",
+		"capacitor://localhost",
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.edu", true},
+		{"https://APP.example.edu", true},
+		{"https://app.example.edu/", true},
+		{"http://app.example.edu", false},
+		{"https://app.example.edu:8443", false},
+		{"https://evil.example.edu", false},
+		{"https://app.example.edu.evil.com", false},
+		{"https://class.school.edu", true},
+		{"https://a.b.school.edu", true},
+		{"https://school.edu", false},
+		{"https://evilschool.edu", false},
+		{"http://localhost:4200", true},
+		{"http://localhost", false},
+		{"http://localhost:4201", false},
+		{"capacitor://localhost", true},
+		{"https://app.example.edu/path", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := policy.Allowed(tt.origin); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyDevMode(t *testing.T) {
+	policy, err := NewPolicy(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.Allowed("http://anything.test:1234") {
+		t.Error("dev mode refused an origin")
+	}
+	var none *Policy
+	if none.Allowed("https://app.example.edu") {
+		t.Error("a nil policy allowed an origin")
+	}
+}
+
+func TestNewPolicyInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+	}{
+		{"no origins", nil},
+		{"no scheme", []string{"app.example.edu"}},
+		{"path", []string{"https://app.example.edu/app"}},
+		{"query", []string{"https://app.example.edu?x=1"}},
+		{"inner wildcard", []string{"https://app.*.edu"}},
+		{"bare wildcard", []string{"https://*."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPolicy(tt.patterns, false); err == nil {
+				t.Errorf("NewPolicy(%q) accepted invalid patterns", tt.patterns)
+			}
+		})
+	}
+}
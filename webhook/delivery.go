@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mediaserver/metrics"
+	"net/http"
+	"time"
+)
+
+type delivery struct {
+	url   string
+	event string
+	body  []byte
+}
+
+// retries back off from one second, doubling up to a minute
+const (
+	firstBackoff = time.Second
+	maxBackoff   = time.Minute
+)
+
+func worker() {
+	for d := range queue {
+		d.send()
+	}
+}
+
+func (d delivery) send() {
+	backoff := firstBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		c := current.Load()
+		var retry bool
+		retry, err = d.post(c)
+		if err == nil {
+			metrics.WebhookDeliveries.WithLabelValues(d.event, "delivered").Inc()
+			return
+		}
+		if !retry || attempt >= c.MaxAttempts {
+			break
+		}
+		logger.Debug("webhook attempt failed, retrying", "event", d.event, "url", d.url, "attempt", attempt, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxBackoff)
+	}
+	metrics.WebhookDeliveries.WithLabelValues(d.event, "failed").Inc()
+	logger.Warn("webhook delivery failed", "event", d.event, "url", d.url, "error", err)
+}
+
+// post sends the event once. It reports whether a failure is worth retrying:
+// network errors, 429 and 5xx are, other statuses are not.
+func (d delivery) post(c *Config) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mediaserver-Event", d.event)
+	if c.Secret != "" {
+		req.Header.Set("X-Mediaserver-Signature", Sign(c.Secret, d.body))
+	}
+
+	client := http.Client{Timeout: c.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook: %s answered %s", d.url, resp.Status)
+}
+
+// Sign returns the X-Mediaserver-Signature value of body: "sha256=" followed
+// by the hex HMAC-SHA256 of the raw body. Receivers should compare it in
+// constant time.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,199 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mediaserver/metrics"
+	"mediaserver/utils/logging"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RoomCreated       = "room-created"
+	RoomClosed        = "room-closed"
+	ParticipantJoined = "participant-joined"
+	ParticipantLeft   = "participant-left"
+	TrackPublished    = "track-published"
+	TrackUnpublished  = "track-unpublished"
+)
+
+var knownEvents = map[string]bool{
+	RoomCreated: true, RoomClosed: true, ParticipantJoined: true,
+	ParticipantLeft: true, TrackPublished: true, TrackUnpublished: true,
+}
+
+var logger = logging.For("webhook")
+
+type Config struct {
+	URLs []string
+	// HMAC-SHA256 key of the X-Mediaserver-Signature header, requests are
+	// not signed when empty
+	Secret string
+	// event types sent, all of them when empty
+	Events      []string
+	QueueSize   int
+	Workers     int
+	MaxAttempts int
+	Timeout     time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		QueueSize:   1000,
+		Workers:     4,
+		MaxAttempts: 5,
+		Timeout:     5 * time.Second,
+	}
+}
+
+// LoadConfig reads the webhook settings from configuration keys, get returns
+// "" for unset keys.
+func LoadConfig(get func(key string) string) (Config, error) {
+	c := DefaultConfig()
+	c.URLs = splitList(get("WEBHOOK_URLS"))
+	c.Secret = get("WEBHOOK_SECRET")
+	c.Events = splitList(get("WEBHOOK_EVENTS"))
+	for key, target := range map[string]*int{
+		"WEBHOOK_QUEUE_SIZE":   &c.QueueSize,
+		"WEBHOOK_WORKERS":      &c.Workers,
+		"WEBHOOK_MAX_ATTEMPTS": &c.MaxAttempts,
+	} {
+		if v := get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return c, fmt.Errorf("%s: %w", key, err)
+			}
+			*target = n
+		}
+	}
+	if v := get("WEBHOOK_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("WEBHOOK_TIMEOUT: %w", err)
+		}
+		c.Timeout = timeout
+	}
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	for _, raw := range c.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook: %q is not an http(s) URL", raw)
+		}
+	}
+	for _, event := range c.Events {
+		if !knownEvents[event] {
+			return fmt.Errorf("webhook: unknown event %q", event)
+		}
+	}
+	if c.QueueSize <= 0 || c.Workers <= 0 || c.MaxAttempts <= 0 {
+		return fmt.Errorf("webhook: queue size, workers and attempts must be positive")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("webhook: timeout must be positive")
+	}
+	return nil
+}
+
+func (c Config) wants(event string) bool {
+	if len(c.URLs) == 0 {
+		return false
+	}
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is the JSON body POSTed to every webhook URL. Deliveries run in
+// parallel and retry, so receivers should order events by Timestamp.
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	RoomID    string                 `json:"roomId"`
+	UserID    string                 `json:"userId,omitempty"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+var (
+	current atomic.Pointer[Config]
+	queue   chan delivery
+)
+
+// Start creates the delivery queue and workers. Emit drops events until it
+// is called.
+func Start(c Config) {
+	Configure(c)
+	queue = make(chan delivery, c.QueueSize)
+	for i := 0; i < c.Workers; i++ {
+		go worker()
+	}
+}
+
+// Configure replaces the URLs, secret, event filter, attempts and timeout used
+// for the next deliveries. The queue size and worker count stay as started.
+func Configure(c Config) {
+	current.Store(&c)
+}
+
+// Emit queues the event for every webhook URL and returns at once. When the
+// queue is full the event is dropped rather than blocking the caller.
+func Emit(eventType, roomID, userID string, data map[string]interface{}) {
+	c := current.Load()
+	if queue == nil || c == nil || !c.wants(eventType) {
+		return
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	body, err := json.Marshal(Event{
+		ID:        newID(),
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		RoomID:    roomID,
+		UserID:    userID,
+		Data:      data,
+	})
+	if err != nil {
+		logger.Error("event not serializable", "event", eventType, "error", err)
+		return
+	}
+	for _, target := range c.URLs {
+		select {
+		case queue <- delivery{url: target, event: eventType, body: body}:
+		default:
+			metrics.WebhookDeliveries.WithLabelValues(eventType, "dropped").Inc()
+			logger.Warn("webhook queue full, event dropped", "event", eventType, "roomId", roomID, "url", target)
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}